@@ -4,6 +4,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/snebel29/kwatchman/internal/pkg/config"
 	"github.com/snebel29/kwatchman/internal/pkg/kwatchman"
+	"github.com/snebel29/kwatchman/internal/pkg/server"
 	"github.com/snebel29/kwatchman/internal/pkg/watcher/k8s"
 )
 
@@ -17,7 +18,16 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := kwatchman.Start(w); err != nil {
+	srv := server.NewServer(conf.CLI.ListenAddress, w)
+	go func() {
+		if err := srv.Run(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	err = kwatchman.Start(w, conf.CLI.GracePeriod)
+	srv.Shutdown()
+	if err != nil {
 		log.Fatal(err)
 	}
 	log.Info("Finishing kwatchman")
@@ -5,13 +5,19 @@ import (
 	"github.com/snebel29/kwatchman/internal/pkg/version"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"os"
+	"strings"
+	"time"
 )
 
 var (
 	namespace = kingpin.Flag(
 		"namespace",
-		"k8s namespace where to get resources from: default to all").Default(
+		"Comma separated list of k8s namespaces or patterns (prod-*) where to get resources from: default to all").Default(
 		"").Envar("KW_NAMESPACE").Short('n').String()
+	excludeNamespace = kingpin.Flag(
+		"exclude-namespace",
+		"Comma separated list of k8s namespaces or patterns to ignore: default to none").Default(
+		"").Envar("KW_EXCLUDE_NAMESPACE").Short('x').String()
 	kubeconfig = kingpin.Flag(
 		"kubeconfig",
 		"kubeconfig path for running out of k8s").Default(
@@ -24,6 +30,42 @@ var (
 		"label-selector",
 		"k8s label selector string: default to all").Default(
 		"").Envar("KW_LABEL_SELECTOR").Short('l').String()
+	leaderElect = kingpin.Flag(
+		"leader-elect",
+		"Run highly available replicas, only the leader notifies events").Default(
+		"false").Envar("KW_LEADER_ELECT").Bool()
+	leaderElectNamespace = kingpin.Flag(
+		"leader-elect-namespace",
+		"k8s namespace of the leader election lease").Default(
+		"default").Envar("KW_LEADER_ELECT_NAMESPACE").String()
+	leaderElectName = kingpin.Flag(
+		"leader-elect-name",
+		"Name of the leader election lease").Default(
+		"kwatchman").Envar("KW_LEADER_ELECT_NAME").String()
+	leaderElectLeaseDuration = kingpin.Flag(
+		"leader-elect-lease-duration",
+		"Time standby replicas wait before taking over a non renewed lease").Default(
+		"15s").Envar("KW_LEADER_ELECT_LEASE_DURATION").Duration()
+	listenAddress = kingpin.Flag(
+		"listen-address",
+		"Address where to serve kwatchman HTTP endpoints such as /metrics, /healthz and /readyz").Default(
+		":9090").Envar("KW_LISTEN_ADDRESS").String()
+	livenessThreshold = kingpin.Flag(
+		"liveness-threshold",
+		"Time a resource watch can be disconnected before /healthz fails, 0 never fails").Default(
+		"5m").Envar("KW_LIVENESS_THRESHOLD").Duration()
+	gracePeriod = kingpin.Flag(
+		"grace-period",
+		"Time given on shutdown to finish handling the events in flight").Default(
+		"30s").Envar("KW_GRACE_PERIOD").Duration()
+	secretSalt = kingpin.Flag(
+		"secret-salt",
+		"Salt of the hashes replacing secret values, kept across restarts: required along with a diff storageDir, default to a random one").Default(
+		"").Envar("KW_SECRET_SALT").String()
+	stateDir = kingpin.Flag(
+		"state-dir",
+		"Directory where the watched resources are persisted periodically and on shutdown to resume watching them: default to none").Default(
+		"").Envar("KW_STATE_DIR").String()
 	logLevel = kingpin.Flag(
 		"log-level",
 		"The log level (panic, fatal, error, warning, info, debug and trace)").Default("info").Short('z').String()
@@ -31,11 +73,33 @@ var (
 
 // Args holds the command line arguments
 type Args struct {
-	Namespace     string
-	Kubeconfig    string
-	ConfigFile    string
-	LabelSelector string
-	LogLevel      string
+	Namespaces        []string
+	ExcludeNamespaces []string
+	Kubeconfig        string
+	ConfigFile        string
+	LabelSelector     string
+	LogLevel          string
+	ListenAddress     string
+	LivenessThreshold time.Duration
+	GracePeriod       time.Duration
+	SecretSalt        string
+	StateDir          string
+
+	LeaderElect              bool
+	LeaderElectNamespace     string
+	LeaderElectName          string
+	LeaderElectLeaseDuration time.Duration
+}
+
+// splitList return the non empty items from a comma separated list
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 // NewCLI returns a CLI
@@ -44,10 +108,21 @@ func NewCLI() *Args {
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 	return &Args{
-		Namespace:     *namespace,
-		Kubeconfig:    *kubeconfig,
-		ConfigFile:    *configFile,
-		LabelSelector: *labelSelector,
-		LogLevel:      *logLevel,
+		Namespaces:        splitList(*namespace),
+		ExcludeNamespaces: splitList(*excludeNamespace),
+		Kubeconfig:        *kubeconfig,
+		ConfigFile:        *configFile,
+		LabelSelector:     *labelSelector,
+		LogLevel:          *logLevel,
+		ListenAddress:     *listenAddress,
+		LivenessThreshold: *livenessThreshold,
+		GracePeriod:       *gracePeriod,
+		SecretSalt:        *secretSalt,
+		StateDir:          *stateDir,
+
+		LeaderElect:              *leaderElect,
+		LeaderElectNamespace:     *leaderElectNamespace,
+		LeaderElectName:          *leaderElectName,
+		LeaderElectLeaseDuration: *leaderElectLeaseDuration,
 	}
 }
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestCLIWrongArgsExitCode(t *testing.T) {
@@ -23,7 +25,8 @@ func TestCLIWrongArgsExitCode(t *testing.T) {
 }
 
 func TestCliArgs(t *testing.T) {
-	namespace := "myNamespace"
+	namespace := "myNamespace, team-*"
+	excludeNamespace := "kube-system,monitoring"
 	kubeconfig := "myKubeconfig"
 	config := "myConfig"
 	labels := "environment,environment notin (frontend)"
@@ -31,15 +34,27 @@ func TestCliArgs(t *testing.T) {
 	os.Args = []string{
 		"kwatchman",
 		fmt.Sprintf("--namespace=%s", namespace),
+		fmt.Sprintf("--exclude-namespace=%s", excludeNamespace),
 		fmt.Sprintf("--kubeconfig=%s", kubeconfig),
 		fmt.Sprintf("--config=%s", config),
 		fmt.Sprintf("--label-selector=%s", labels),
 		fmt.Sprintf("--log-level=%s", logLevel),
+		"--listen-address=:8080",
+		"--liveness-threshold=1m",
+		"--grace-period=10s",
+		"--secret-salt=mySalt",
+		"--state-dir=/var/lib/kwatchman",
+		"--leader-elect",
+		"--leader-elect-namespace=kwatchman",
+		"--leader-elect-lease-duration=10s",
 	}
 
 	cli := NewCLI()
-	if cli.Namespace != namespace {
-		t.Errorf("%s != %s", cli.Namespace, namespace)
+	if !reflect.DeepEqual(cli.Namespaces, []string{"myNamespace", "team-*"}) {
+		t.Errorf("%#v != %s", cli.Namespaces, namespace)
+	}
+	if !reflect.DeepEqual(cli.ExcludeNamespaces, []string{"kube-system", "monitoring"}) {
+		t.Errorf("%#v != %s", cli.ExcludeNamespaces, excludeNamespace)
 	}
 	if cli.Kubeconfig != kubeconfig {
 		t.Errorf("%s != %s", cli.Kubeconfig, kubeconfig)
@@ -53,4 +68,34 @@ func TestCliArgs(t *testing.T) {
 	if cli.LogLevel != logLevel {
 		t.Errorf("%s != %s", cli.LogLevel, logLevel)
 	}
+	if cli.ListenAddress != ":8080" {
+		t.Errorf("%s != :8080", cli.ListenAddress)
+	}
+	if cli.LivenessThreshold != time.Minute {
+		t.Errorf("%s != 1m", cli.LivenessThreshold)
+	}
+	if cli.GracePeriod != 10*time.Second {
+		t.Errorf("%s != 10s", cli.GracePeriod)
+	}
+	if cli.SecretSalt != "mySalt" {
+		t.Errorf("%s != mySalt", cli.SecretSalt)
+	}
+	if cli.StateDir != "/var/lib/kwatchman" {
+		t.Errorf("%s != /var/lib/kwatchman", cli.StateDir)
+	}
+	if !cli.LeaderElect || cli.LeaderElectNamespace != "kwatchman" || cli.LeaderElectName != "kwatchman" {
+		t.Errorf("leader election arguments are not set correctly %#v", cli)
+	}
+	if cli.LeaderElectLeaseDuration != 10*time.Second {
+		t.Errorf("%s != 10s", cli.LeaderElectLeaseDuration)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	if items := splitList(""); items != nil {
+		t.Errorf("empty list should return nil, got %#v instead", items)
+	}
+	if items := splitList("a, b,,c "); !reflect.DeepEqual(items, []string{"a", "b", "c"}) {
+		t.Errorf("list should have been split, got %#v instead", items)
+	}
 }
@@ -5,6 +5,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/snebel29/kwatchman/internal/pkg/cli"
 	"github.com/spf13/viper"
+	"time"
 )
 
 // Handlers holds a list of Handler
@@ -15,22 +16,64 @@ type Handlers []Handler
 // of the handler to validate them, as well as to avoid naming conflicts, in the future namespacing
 // might me implemented
 type Handler struct {
-	Name         string   // Used by all handlers
-	ClusterName  string   // Used by slack handler
-	WebhookURL   string   // Used by slack handler
-	IgnoreEvents []string `mapstructure:"events"` // Used by ignoreEvents handler
+	Name         string        // Used by all handlers
+	ClusterName  string        // Used by slack handler
+	WebhookURL   string        // Used by slack handler
+	IgnoreEvents []string      `mapstructure:"events"` // Used by ignoreEvents handler
+	Timeout      time.Duration // Time given to every event, defaults to handler.DefaultTimeout
+	Format       string        // Used by diff handler
+	Ignore       []IgnoreRule  // Used by diff handler
+	StorageDir   string        // Used by diff handler
+	StorageMax   int64         // Used by diff handler, compressed manifest bytes kept in memory
+	OnlyAlerts   bool          // Used by escalation handler, only stateful handlers run the events without alerts
+}
+
+// IgnoreRule holds the field paths the diff handler ignores for a resource kind, or for
+// every kind when empty, paths are written as the diff reports them, with * wildcards
+type IgnoreRule struct {
+	Kind  string
+	Paths []string
 }
 
 // Resources holds a list of Resource
 type Resources []Resource
 
-// Resource holds the individual resource configurations
+// Resource holds the individual resource configurations, kind refers to a registered resource,
+// otherwise group, version and resource (or kind alone) identify any other resource
+// such as CRDs, which is then resolved through the discovery API
 type Resource struct {
-	Kind string
+	Kind     string
+	Group    string
+	Version  string
+	Resource string
+
+	// Filters applied to this resource only, taking precedence over the command line ones
+	Namespaces        []string // Namespaces or patterns such as prod-* to watch
+	ExcludeNamespaces []string // Namespaces or patterns to ignore
+	LabelSelector     string
+	FieldSelector     string
+
+	// Controller settings, defaulting to a 30s resync and a single worker
+	ResyncInterval time.Duration // Time between replays of every object as an update event
+	Workers        int           // Objects handled concurrently, events of a same object keep their order
+}
+
+// Clusters holds a list of Cluster
+type Clusters []Cluster
+
+// Cluster holds the connection configuration of every watched cluster, when no cluster
+// is configured kwatchman watches the one given by the command line kubeconfig or the one
+// is running within
+type Cluster struct {
+	Name       string // Identifies the cluster on every event
+	Kubeconfig string // Defaults to the command line kubeconfig
+	Context    string // Defaults to the kubeconfig current context
+	InCluster  bool   // Use the service account of the cluster kwatchman is running within
 }
 
 // Config represent the config file
 type Config struct {
+	Clusters  Clusters  `mapstructure:"cluster"`
 	Handlers  Handlers  `mapstructure:"handler"`
 	Resources Resources `mapstructure:"resource"`
 	CLI       *cli.Args
@@ -68,5 +111,23 @@ func NewConfig() (*Config, error) {
 	if config.Resources == nil || config.Handlers == nil {
 		return nil, fmt.Errorf("malformed %s config file", c.ConfigFile)
 	}
+	if err := validateClusters(config.Clusters); err != nil {
+		return nil, fmt.Errorf("malformed %s config file: %s", c.ConfigFile, err)
+	}
 	return config, nil
 }
+
+// validateClusters ensures every cluster has a unique name, so that events can be told apart
+func validateClusters(clusters Clusters) error {
+	names := make(map[string]bool)
+	for _, cluster := range clusters {
+		if cluster.Name == "" {
+			return fmt.Errorf("every cluster requires a name")
+		}
+		if names[cluster.Name] {
+			return fmt.Errorf("cluster %s is duplicated", cluster.Name)
+		}
+		names[cluster.Name] = true
+	}
+	return nil
+}
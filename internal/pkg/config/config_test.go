@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"runtime"
 	"testing"
+	"time"
 )
 
 var thisFilename string
@@ -43,6 +44,31 @@ func malformedConfigFileHelper(fixture string, t *testing.T) {
 func TestNewConfigReturnErrorWhenFileisMalformed(t *testing.T) {
 	malformedConfigFileHelper("handlerless-config.toml", t)
 	malformedConfigFileHelper("resourcesless-config.toml", t)
+	malformedConfigFileHelper("duplicated-clusters-config.toml", t)
+}
+
+func TestClustersConfigShouldParseCorrectly(t *testing.T) {
+	fixture := "clusters-config.toml"
+	config, err := loadConfigFileHelper(fixture)
+	if err != nil {
+		t.Fatalf("%s file should have NOT returned an error: %s", fixture, err)
+	}
+	expected := Clusters{
+		{Name: "local", InCluster: true},
+		{Name: "prod-eu", Kubeconfig: "/path/to/kubeconfig", Context: "prod-eu"},
+	}
+	if !reflect.DeepEqual(config.Clusters, expected) {
+		t.Errorf("config.Clusters should be %#v, got %#v instead", expected, config.Clusters)
+	}
+}
+
+func TestValidateClusters(t *testing.T) {
+	if err := validateClusters(Clusters{}); err != nil {
+		t.Error(err)
+	}
+	if err := validateClusters(Clusters{{Kubeconfig: "kubeconfig"}}); err == nil {
+		t.Error("clusters without name should return an error")
+	}
 }
 
 func TestGoodNewConfigShouldParseCorrectly(t *testing.T) {
@@ -54,6 +80,16 @@ func TestGoodNewConfigShouldParseCorrectly(t *testing.T) {
 	if len(config.Resources) != 1 {
 		t.Errorf("config.Resources should have 1 item and has %d instead", len(config.Resources))
 	}
+	r := config.Resources[0]
+	if !reflect.DeepEqual(r.Namespaces, []string{"prod-*"}) ||
+		!reflect.DeepEqual(r.ExcludeNamespaces, []string{"prod-sandbox"}) ||
+		r.LabelSelector != "app=myApp" ||
+		r.FieldSelector != "metadata.name!=myName" {
+		t.Errorf("resource filters should have been parsed, got %#v instead", r)
+	}
+	if r.ResyncInterval != 10*time.Minute || r.Workers != 4 {
+		t.Errorf("resource controller settings should have been parsed, got %#v instead", r)
+	}
 	if len(config.Handlers) != 4 {
 		t.Errorf("config.Handlers should have 4 item and has %d instead", len(config.Handlers))
 	}
@@ -68,6 +104,17 @@ func TestGoodNewConfigShouldParseCorrectly(t *testing.T) {
 		t.Errorf("Events should have been found, got %#v instead", config.Handlers)
 	}
 
+	diff := config.Handlers[0]
+	if diff.Format != "yaml" || diff.Timeout != 10*time.Second {
+		t.Errorf("diff format and timeout should have been parsed, got %#v instead", diff)
+	}
+	expectedIgnore := []IgnoreRule{{
+		Kind:  "deployment",
+		Paths: []string{"spec.replicas", `metadata.annotations["sidecar.istio.io/*"]`},
+	}}
+	if !reflect.DeepEqual(diff.Ignore, expectedIgnore) {
+		t.Errorf("diff ignore rules should have been parsed, got %#v instead", diff.Ignore)
+	}
 }
 
 func TestNonExistantConfigShouldReturnError_NewConfig(t *testing.T) {
@@ -44,9 +44,9 @@ func cleanAnnotations(obj *k8sObject, annotationsToClean []string) {
 	)
 }
 
-// cleanK8sManifest cleans metadata information and indent the manifest in preparation for text
-// comparisons
-func cleanK8sManifest(manifest []byte, annotationsToClean []string) ([]byte, error) {
+// cleanK8sManifest cleans metadata information and the ignored paths, and indent the manifest
+// in preparation for text comparisons
+func cleanK8sManifest(manifest []byte, annotationsToClean []string, ignorePaths []ignorePath) ([]byte, error) {
 	obj := &k8sObject{}
 
 	if err := json.Unmarshal(manifest, obj); err != nil {
@@ -60,6 +60,18 @@ func cleanK8sManifest(manifest []byte, annotationsToClean []string) ([]byte, err
 		return nil, errors.Wrap(err, "cleanK8sManifest Marshal")
 	}
 
+	_cleanK8sManifest, err = keepOtherFields(_cleanK8sManifest, manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "cleanK8sManifest keepOtherFields")
+	}
+
+	if len(ignorePaths) > 0 {
+		_cleanK8sManifest, err = removeIgnoredPaths(_cleanK8sManifest, ignorePaths)
+		if err != nil {
+			return nil, errors.Wrap(err, "cleanK8sManifest removeIgnoredPaths")
+		}
+	}
+
 	_json, err := handler.PrettyPrintJSON(_cleanK8sManifest)
 	if err != nil {
 		return nil, errors.Wrap(err, "cleanK8sManifest prettyPrintJSON")
@@ -67,3 +79,34 @@ func cleanK8sManifest(manifest []byte, annotationsToClean []string) ([]byte, err
 
 	return _json, nil
 }
+
+// keepOtherFields adds to the cleaned manifest the top level fields of the manifest beyond the
+// k8sObject ones, such as secrets data, but status
+func keepOtherFields(cleaned, manifest []byte) ([]byte, error) {
+	var fields, obj map[string]json.RawMessage
+	if err := json.Unmarshal(manifest, &fields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(cleaned, &obj); err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		if _, ok := obj[k]; ok || k == "status" {
+			continue
+		}
+		obj[k] = v
+	}
+	return json.Marshal(obj)
+}
+
+// removeIgnoredPaths removes the fields matching any of the paths from the manifest
+func removeIgnoredPaths(manifest []byte, ignorePaths []ignorePath) ([]byte, error) {
+	obj, err := parseManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range ignorePaths {
+		obj = p.remove(obj)
+	}
+	return json.Marshal(obj)
+}
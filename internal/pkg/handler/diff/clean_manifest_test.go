@@ -24,7 +24,7 @@ func TestCleanK8sManifest(t *testing.T) {
 		"deployment.kubernetes.io/revision",
 		"kubectl.kubernetes.io/last-applied-configuration",
 	}
-	cleaned, _ := cleanK8sManifest([]byte(manifest), annotationsToClean)
+	cleaned, _ := cleanK8sManifest([]byte(manifest), annotationsToClean, nil)
 	obj := &k8sObject{}
 	err := json.Unmarshal(cleaned, obj)
 	if err != nil {
@@ -91,3 +91,21 @@ func TestFilterMapByKey(t *testing.T) {
 		t.Errorf("Maps should match, %#v != %#v", m1, m2)
 	}
 }
+
+func TestCleanK8sManifestKeepsOtherFields(t *testing.T) {
+	manifest := `{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "app"}, "data": {"key": "sha256:1f2e"}, "status": {}}`
+	cleaned, err := cleanK8sManifest([]byte(manifest), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(cleaned, &obj); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(obj["data"], map[string]interface{}{"key": "sha256:1f2e"}) {
+		t.Errorf("data should have been kept, got %s", cleaned)
+	}
+	if _, ok := obj["status"]; ok {
+		t.Errorf("status should have been cleaned, got %s", cleaned)
+	}
+}
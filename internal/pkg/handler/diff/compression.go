@@ -0,0 +1,48 @@
+package diff
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"sync"
+)
+
+// gzipWriters reuses the writers, whose compression state is expensive to allocate
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// compress return the gzip compressed value, manifests are usually reduced to a fifth of their size
+func compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, errors.Wrap(err, "compress")
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "compress")
+	}
+	// The buffer grows beyond the compressed size, which would be kept otherwise
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// decompress return the value decompressed, values not starting with the gzip
+// header, such as manifests persisted uncompressed, are returned as they are
+func decompress(value []byte) ([]byte, error) {
+	if len(value) < 2 || value[0] != 0x1f || value[1] != 0x8b {
+		return value, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress")
+	}
+	defer r.Close()
+	v, err := ioutil.ReadAll(r)
+	return v, errors.Wrap(err, "decompress")
+}
@@ -5,89 +5,218 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/snebel29/kooper/operator/common"
 	"github.com/snebel29/kwatchman/internal/pkg/config"
 	"github.com/snebel29/kwatchman/internal/pkg/handler"
+	"github.com/snebel29/kwatchman/internal/pkg/metrics"
 	"github.com/snebel29/kwatchman/internal/pkg/registry"
-	"io/ioutil"
-	"os"
-	"os/exec"
 )
 
 func init() {
 	registry.Register(registry.HANDLER, "diff", NewDiffHandler)
 }
 
+// notComparedPayload is the payload of an update whose previous manifest was not stored
+const notComparedPayload = "Changes not compared, the previous manifest was no longer stored"
+
+// defaultIgnoreRules holds the fields set by kubernetes itself, such as the job controller
+// uid labeling the job and its pods, which would be reported as changes otherwise, status
+// is always cleaned
+var defaultIgnoreRules = []config.IgnoreRule{
+	{
+		Kind: "job",
+		Paths: []string{
+			"spec.selector",
+			`metadata.labels["*controller-uid"]`,
+			`spec.template.metadata.labels["*controller-uid"]`,
+		},
+	},
+	{
+		// Along with status, autoscaling/v1 keeps the current metrics and conditions as annotations
+		Kind: "horizontalpodautoscaler",
+		Paths: []string{
+			`metadata.annotations["autoscaling.alpha.kubernetes.io/current-metrics"]`,
+			`metadata.annotations["autoscaling.alpha.kubernetes.io/conditions"]`,
+		},
+	},
+}
+
 type diffHandler struct {
 	config             config.Handler
 	annotationsToClean []string
-	storage            *storage
-	diffCommand        string
+	storage            storage
+	format             string
+	ignoreRules        []ignoreRule
 }
 
 // NewDiffHandler return a diff handler and defines the default
-// annotations that has to be cleaned to avoid noise due to them chaning on every single event
+// annotations that has to be cleaned to avoid noise due to them chaning on every single event,
+// the differences are rendered in the configured format, unified by default, and the manifests
+// are kept compressed in memory, within the configured size if any, unless a storage directory
+// is configured to persist them across restarts
 func NewDiffHandler(c config.Handler) handler.Handler {
+	format := c.Format
+	if _, ok := renderers[format]; !ok {
+		if format != "" {
+			log.Warnf("Unknown diff format %s, falling back to %s", format, handler.PayloadFormatUnified)
+		}
+		format = handler.PayloadFormatUnified
+	}
+
+	var s storage = newMemoryStorage(c.StorageMax)
+	if c.StorageDir != "" {
+		fs, err := newFileStorage(c.StorageDir)
+		if err != nil {
+			log.Errorf("Diff storage %s can't be used, falling back to memory: %s", c.StorageDir, err)
+		} else {
+			s = fs
+		}
+	}
+
 	return &diffHandler{
 		config: c,
 		annotationsToClean: []string{
 			"deployment.kubernetes.io/revision",
 			"kubectl.kubernetes.io/last-applied-configuration",
 		},
-		storage:     newStorage(),
-		diffCommand: "diff",
+		storage:     s,
+		format:      format,
+		ignoreRules: newIgnoreRules(append(defaultIgnoreRules, c.Ignore...)),
+	}
+}
+
+// Stateful return true, the diff storage must be kept up to date on standby replicas
+func (h *diffHandler) Stateful() bool {
+	return true
+}
+
+// getBucket return the storage bucket of the objects of a resource kind, prefixed by its
+// cluster when configured, since the same object may exist within several clusters
+func getBucket(cluster, resourceKind string) string {
+	if cluster != "" {
+		return fmt.Sprintf("%s/%s", cluster, resourceKind)
 	}
+	return resourceKind
 }
 
-func getObjID(evt *handler.Event) string {
-	return fmt.Sprintf("%s/%s", evt.K8sEvt.Key, evt.ResourceKind)
+func getEventBucket(evt *handler.Event) string {
+	return getBucket(evt.Cluster, evt.ResourceKind)
 }
 
 // runAdd runs the handler when the event is Add
 func (h *diffHandler) runAdd(ctx context.Context, evt *handler.Event) error {
 
 	cleanedManifest := evt.K8sManifest
-	h.storage.Add(getObjID(evt), cleanedManifest)
+	storedManifest, ok, err := h.storage.Get(getEventBucket(evt), evt.K8sEvt.Key)
+	if err != nil {
+		evt.RunNext = false
+		return errors.Wrap(err, "storage Get")
+	}
 
-	// Initial sache sync-up events are "Add", we don't want them to be notified
-	// but we want them to fill up our storage for future comparison
-	if !evt.K8sEvt.HasSynced {
+	if ok {
+		// The object is already known, such as when it's listed on startup from a persisted
+		// storage, the changes made meanwhile are reported as an update
+		if err := h.compare(evt, storedManifest); err != nil {
+			return err
+		}
+		if evt.RunNext {
+			k8sEvt := *evt.K8sEvt
+			k8sEvt.Kind = "Update"
+			evt.K8sEvt = &k8sEvt
+		}
+	} else if !evt.K8sEvt.HasSynced {
+		// Initial sache sync-up events are "Add", we don't want them to be notified
+		// but we want them to fill up our storage for future comparison
 		evt.RunNext = false
 	}
 
-	return nil
+	return errors.Wrap(h.storage.Add(getEventBucket(evt), evt.K8sEvt.Key, cleanedManifest), "storage Add")
 }
 
 // runUpdate runs the handler when the event is Update
 func (h *diffHandler) runUpdate(ctx context.Context, evt *handler.Event) error {
 
-	var diff []byte
-	var err error
 	cleanedManifest := evt.K8sManifest
+	storedManifest, ok, err := h.storage.Get(getEventBucket(evt), evt.K8sEvt.Key)
+	if err != nil {
+		evt.RunNext = false
+		return errors.Wrap(err, "storage Get")
+	}
 
 	// Since this is an update, there should be a cleaned manifest into the storage
 	// for safety we double check, the same apply for HasSynced
-	if storedManifest, ok := h.storage.Get(getObjID(evt)); ok && evt.K8sEvt.HasSynced {
-		diff, err = diffTextLines(h.diffCommand, storedManifest, cleanedManifest)
-		if err != nil {
-			evt.RunNext = false
-			return errors.Wrap(err, "diffTextLines")
-		}
-		// If there is NO difference we do not allow for the next handler to run
-		if len(diff) < 1 {
-			evt.RunNext = false
+	if ok && evt.K8sEvt.HasSynced {
+		if err := h.compare(evt, storedManifest); err != nil {
+			return err
 		}
-		evt.Payload = diff
+	} else if !ok && evt.K8sEvt.HasSynced {
+		// Such as when evicted from a storage with a limited size, the update is reported
+		// without its changes rather than as if nothing changed
+		log.Infof("No stored manifest for %s %s, the update can't be compared", evt.ResourceKind, evt.K8sEvt.Key)
+		evt.Payload = []byte(notComparedPayload)
+		evt.PayloadFormat = ""
+		metrics.IncDiffNotCompared(evt.ResourceKind)
 	}
 
 	// Adding to the storage only after comparison
-	h.storage.Add(getObjID(evt), cleanedManifest)
+	return errors.Wrap(h.storage.Add(getEventBucket(evt), evt.K8sEvt.Key, cleanedManifest), "storage Add")
+}
+
+// compare the event manifest with the stored one, the difference is returned in the
+// payload and the next handler is not run when there is none
+func (h *diffHandler) compare(evt *handler.Event, storedManifest []byte) error {
+	diff, err := diffManifests(storedManifest, evt.K8sManifest, h.format)
+	if err != nil {
+		evt.RunNext = false
+		return errors.Wrap(err, "diffManifests")
+	}
+	// If there is NO difference we do not allow for the next handler to run
+	if len(diff) < 1 {
+		evt.RunNext = false
+		metrics.IncEventSuppressed("diff", evt.ResourceKind)
+	}
+	evt.Payload = diff
+	evt.PayloadFormat = h.format
 	return nil
 }
 
 // runDelete deletes the object from storage and keep moving forward in the chain
 func (h *diffHandler) runDelete(ctx context.Context, evt *handler.Event) error {
-	h.storage.Delete(getObjID(evt))
-	return nil
+	return errors.Wrap(h.storage.Delete(getEventBucket(evt), evt.K8sEvt.Key), "storage Delete")
+}
+
+// Synced return a Delete event for every stored object within the listing scope which is no longer
+// listed, such as those deleted while kwatchman was down, they are removed from the storage
+func (h *diffHandler) Synced(ctx context.Context, listing *handler.Listing) ([]*handler.Event, error) {
+	bucket := getBucket(listing.Cluster, listing.ResourceKind)
+	storedKeys, err := h.storage.Keys(bucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "storage Keys")
+	}
+
+	listed := make(map[string]bool, len(listing.Keys))
+	for _, key := range listing.Keys {
+		listed[key] = true
+	}
+
+	var evts []*handler.Event
+	for _, key := range storedKeys {
+		if listed[key] || (listing.Contains != nil && !listing.Contains(key)) {
+			continue
+		}
+		if err := h.storage.Delete(bucket, key); err != nil {
+			return evts, errors.Wrap(err, "storage Delete")
+		}
+		evts = append(evts, &handler.Event{
+			K8sEvt:       &common.K8sEvent{Kind: "Delete", Key: key, HasSynced: true},
+			RunNext:      true,
+			Cluster:      listing.Cluster,
+			ResourceKind: listing.ResourceKind,
+			K8sManifest:  []byte{},
+			Payload:      []byte{},
+		})
+	}
+	return evts, nil
 }
 
 // Run spits out the differentce between previous versions of K8sManifest
@@ -96,12 +225,16 @@ func (h *diffHandler) runDelete(ctx context.Context, evt *handler.Event) error {
 // from the user perspective, output returns the cleaned manifest and the diff is
 // returned in the payload, next handler is run only if a difference is found
 func (h *diffHandler) Run(ctx context.Context, evt *handler.Event) error {
-	ctx = nil
+	// Watch events have no manifest to compare, they are always notified
+	if handler.IsWatchEvent(evt) {
+		return nil
+	}
 
 	switch evt.K8sEvt.Kind {
 	case "Add", "Update":
 		// Clean only for Add and Update since Delete has no manifest and would fail
-		cleanedManifest, err := cleanK8sManifest(evt.K8sManifest, h.annotationsToClean)
+		cleanedManifest, err := cleanK8sManifest(
+			evt.K8sManifest, h.annotationsToClean, ignorePathsFor(h.ignoreRules, evt.ResourceKind))
 		if err != nil {
 			evt.RunNext = false
 			return err
@@ -123,47 +256,16 @@ func (h *diffHandler) Run(ctx context.Context, evt *handler.Event) error {
 	return fmt.Errorf("Unknown event kind %s", evt.K8sEvt.Kind)
 }
 
-func createTempFile(content []byte) (string, error) {
-	tmpfile, err := ioutil.TempFile("/tmp", "diff-file")
-	if err != nil {
-		return "", err
-	}
-	if _, err := tmpfile.Write(content); err != nil {
-		return "", err
-	}
-	if err := tmpfile.Close(); err != nil {
-		return "", err
-	}
-	return tmpfile.Name(), nil
-}
-
-func diffTextLines(command string, text1, text2 []byte) ([]byte, error) {
-	// This function is currently coupled with POSIX diff command
-	// which is for now a mandatory requirement, in the future we will be able
-	// to configure our own, and eventually make semantic diff using pure go code
-	file1, err := createTempFile(text1)
-	if err != nil {
-		return nil, err
-	}
-	defer os.Remove(file1)
-
-	file2, err := createTempFile(text2)
+// diffManifests return the structural differences between both manifests rendered in the format,
+// which is empty when they are equivalent
+func diffManifests(from, to []byte, format string) ([]byte, error) {
+	fromObj, toObj, err := parseManifests(from, to)
 	if err != nil {
 		return nil, err
 	}
-	defer os.Remove(file2)
-
-	output, err := exec.Command(command, file1, file2).CombinedOutput()
-	if err != nil {
-		switch err.(type) {
-		case *exec.ExitError:
-			// Do nothing, this is expected to have exit code
-
-		default:
-			log.Errorf("%s %s", err, string(output))
-			return nil, err
-		}
+	changes := diffValues("", fromObj, toObj, nil)
+	if len(changes) == 0 {
+		return nil, nil
 	}
-
-	return output, nil
+	return render(format, changes, fromObj, toObj)
 }
@@ -1,13 +1,14 @@
 package diff
 
 import (
-	"bytes"
 	"context"
 	log_test "github.com/sirupsen/logrus/hooks/test"
 	"github.com/snebel29/kooper/operator/common"
 	"github.com/snebel29/kwatchman/internal/pkg/config"
 	"github.com/snebel29/kwatchman/internal/pkg/handler"
 	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -149,29 +150,25 @@ func TestDiffHandler(t *testing.T) {
 	}
 }
 
-func TestUpdateWithWrongHandlerCommandShouldReturnError(t *testing.T) {
+func TestUpdateWithInvalidStoredManifestShouldReturnError(t *testing.T) {
 	h := &diffHandler{
-		config:      config.Handler{},
-		storage:     newStorage(),
-		diffCommand: "UnexistentCommand",
+		config:  config.Handler{},
+		storage: newMemoryStorage(0),
 	}
 
 	evt := &handler.Event{
 		K8sEvt: &common.K8sEvent{
 			Key:       "key",
 			HasSynced: true,
-			Kind:      "Add",
+			Kind:      "Update",
 			Object:    nil,
 		},
 		RunNext:     true,
 		K8sManifest: []byte("{\"kind\": \"whatever\"}\n"),
 		Payload:     []byte{},
 	}
-	// Adding the event to the storage so the next Update will
-	_ = h.Run(context.TODO(), evt)
-
-	// Now we can handler the Update
-	evt.K8sEvt.Kind = "Update"
+	// The stored manifest can't be parsed for the comparison
+	_ = h.storage.Add(getEventBucket(evt), evt.K8sEvt.Key, []byte("{\"kind\":"))
 
 	err := h.Run(context.TODO(), evt)
 	if err == nil {
@@ -180,54 +177,209 @@ func TestUpdateWithWrongHandlerCommandShouldReturnError(t *testing.T) {
 	if evt.RunNext != false {
 		t.Error("Should have stopped")
 	}
+}
 
+func TestUpdateWithoutStoredManifestIsReportedNotCompared(t *testing.T) {
+	h := &diffHandler{
+		config:  config.Handler{},
+		storage: newMemoryStorage(0),
+		format:  handler.PayloadFormatUnified,
+	}
+
+	evt := &handler.Event{
+		K8sEvt: &common.K8sEvent{
+			Key:       "key",
+			HasSynced: true,
+			Kind:      "Update",
+		},
+		RunNext:     true,
+		K8sManifest: []byte("{\"kind\": \"whatever\"}\n"),
+	}
+	// Such as when evicted from the storage
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if !evt.RunNext || string(evt.Payload) != notComparedPayload || evt.PayloadFormat != "" {
+		t.Errorf("the update should have been reported as not compared, got %q as %q", evt.Payload, evt.PayloadFormat)
+	}
+	if _, ok, _ := h.storage.Get(getEventBucket(evt), evt.K8sEvt.Key); !ok {
+		t.Error("the manifest should have been stored for the next update")
+	}
 }
 
-func TestDiffTextLines(t *testing.T) {
-	diff, err := diffTextLines(
-		"diff",
+func TestDiffManifests(t *testing.T) {
+	diff, err := diffManifests(
 		[]byte("{\"a\": 1}\n"),
 		[]byte("{\"a\": 2}\n"),
+		handler.PayloadFormatUnified,
 	)
 	if err != nil {
 		t.Error(err)
 	}
-
-	if len(diff) == 0 {
-		t.Errorf("There should have been some difference in the output got %d instead", len(diff))
+	expected := "@@ a @@\n- 1\n+ 2\n"
+	if string(diff) != expected {
+		t.Errorf("diff should be %q got %q instead", expected, string(diff))
 	}
 
-	diff, err = diffTextLines(
-		"diff",
-		[]byte("{\"a\": 1}\n"),
+	diff, err = diffManifests(
 		[]byte("{\"a\": 1}\n"),
+		[]byte("{\n \"a\": 1\n}\n"),
+		handler.PayloadFormatJSONPatch,
 	)
 	if err != nil {
 		t.Error(err)
 	}
-
 	if len(diff) != 0 {
 		t.Errorf("There should have been no differences in the output got %d instead", len(diff))
 	}
 
-	diff, err = diffTextLines(
-		"unexistentcommand",
-		[]byte("{\"a\": 1}\n"),
+	_, err = diffManifests(
 		[]byte("{\"a\": 1}\n"),
+		[]byte("not json"),
+		handler.PayloadFormatUnified,
 	)
 	if err == nil {
-		t.Error("Unexistent command should return an error")
+		t.Error("Invalid manifest should return an error")
+	}
+}
+
+func TestGetEventBucket(t *testing.T) {
+	evt := &handler.Event{
+		K8sEvt:       &common.K8sEvent{Key: "namespace/name"},
+		ResourceKind: "deployment",
+	}
+	if getEventBucket(evt) != "deployment" {
+		t.Errorf("unexpected bucket %s", getEventBucket(evt))
+	}
+
+	evt.Cluster = "production"
+	if getEventBucket(evt) != "production/deployment" {
+		t.Errorf("bucket should be prefixed by its cluster, got %s instead", getEventBucket(evt))
 	}
 }
 
-func TestCreateTempFile(t *testing.T) {
-	content := []byte("AnyContent")
-	name, err := createTempFile(content)
+func newSyncedEvent(kind, key, manifest string, hasSynced bool) *handler.Event {
+	return &handler.Event{
+		K8sEvt:       &common.K8sEvent{Kind: kind, Key: key, HasSynced: hasSynced},
+		RunNext:      true,
+		ResourceKind: "deployment",
+		K8sManifest:  []byte(manifest),
+		Payload:      []byte{},
+	}
+}
+
+func TestDiffHandlerReportsOfflineChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff-storage")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// First run, every object is initially listed and stored
+	h := NewDiffHandler(config.Handler{StorageDir: dir})
+	for _, evt := range []*handler.Event{
+		newSyncedEvent("Add", "default/web", `{"spec": {"replicas": 1}}`, false),
+		newSyncedEvent("Add", "default/api", `{"spec": {"replicas": 1}}`, false),
+		newSyncedEvent("Add", "default/gone", `{"spec": {"replicas": 1}}`, false),
+	} {
+		if err := h.Run(context.TODO(), evt); err != nil {
+			t.Fatal(err)
+		}
+		if evt.RunNext {
+			t.Error("initial list should not be notified")
+		}
+	}
+
+	// Restart, web changed and gone was deleted meanwhile
+	h = NewDiffHandler(config.Handler{StorageDir: dir})
+	evt := newSyncedEvent("Add", "default/web", `{"spec": {"replicas": 3}}`, false)
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if !evt.RunNext || evt.K8sEvt.Kind != "Update" || len(evt.Payload) == 0 {
+		t.Errorf("offline change should be notified as an Update, got %#v", evt)
+	}
+
+	evt = newSyncedEvent("Add", "default/api", `{"spec": {"replicas": 1}}`, false)
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if evt.RunNext {
+		t.Error("unchanged objects should not be notified")
+	}
+
+	evts, err := h.(handler.Syncer).Synced(context.TODO(), &handler.Listing{
+		ResourceKind: "deployment",
+		Keys:         []string{"default/web", "default/api", "other/outofscope"},
+		Contains:     func(key string) bool { return strings.HasPrefix(key, "default/") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evts) != 1 || evts[0].K8sEvt.Kind != "Delete" || evts[0].K8sEvt.Key != "default/gone" {
+		t.Fatalf("a Delete event should be returned for the vanished object, got %#v", evts)
+	}
+
+	evts, err = h.(handler.Syncer).Synced(context.TODO(), &handler.Listing{ResourceKind: "deployment"})
+	if err != nil {
+		t.Fatal(err)
 	}
-	_content, _ := ioutil.ReadFile(name)
-	if !bytes.Equal(content, _content) {
-		t.Error("File content mismatch")
+	if len(evts) != 2 {
+		t.Errorf("every remaining object should be deleted once no longer listed, got %d", len(evts))
+	}
+}
+
+func TestSyncedKeepsObjectsOutOfScope(t *testing.T) {
+	h := NewDiffHandler(config.Handler{})
+	if err := h.Run(context.TODO(), newSyncedEvent("Add", "other/web", `{}`, false)); err != nil {
+		t.Fatal(err)
+	}
+
+	evts, err := h.(handler.Syncer).Synced(context.TODO(), &handler.Listing{
+		ResourceKind: "deployment",
+		Contains:     func(key string) bool { return strings.HasPrefix(key, "default/") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evts) != 0 {
+		t.Errorf("objects out of the listing scope should be kept, got %#v", evts)
+	}
+}
+
+func TestDiffHandlerIsStateful(t *testing.T) {
+	h, ok := NewDiffHandler(config.Handler{}).(handler.StatefulHandler)
+	if !ok || !h.Stateful() {
+		t.Error("diff handler should be stateful to keep its storage warm on standby replicas")
+	}
+}
+
+func TestNewDiffHandlerFormat(t *testing.T) {
+	for _, test := range []struct {
+		format   string
+		expected string
+	}{
+		{"", handler.PayloadFormatUnified},
+		{"mergepatch", handler.PayloadFormatMergePatch},
+		{"unknown", handler.PayloadFormatUnified},
+	} {
+		h := NewDiffHandler(config.Handler{Format: test.format}).(*diffHandler)
+		if h.format != test.expected {
+			t.Errorf("format %q should be %s, got %s instead", test.format, test.expected, h.format)
+		}
+	}
+}
+
+func TestDiffHandlerPassesWatchEvents(t *testing.T) {
+	h := NewDiffHandler(config.Handler{})
+	for _, kind := range []string{handler.WatchErrorEvent, handler.WatchRecoveredEvent} {
+		evt := newSyncedEvent(kind, "", "", true)
+		evt.Payload = []byte("forbidden")
+		if err := h.Run(context.TODO(), evt); err != nil {
+			t.Fatal(err)
+		}
+		if !evt.RunNext || string(evt.Payload) != "forbidden" {
+			t.Errorf("%s events should have been passed through, got %#v instead", kind, evt)
+		}
 	}
 }
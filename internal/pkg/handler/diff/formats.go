@@ -0,0 +1,121 @@
+package diff
+
+import (
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"github.com/snebel29/kwatchman/internal/pkg/handler"
+	"reflect"
+	"strings"
+)
+
+// renderers render the differences between both manifests, given their structural changes,
+// in every supported payload format
+var renderers = map[string]func(changes []change, from, to interface{}) ([]byte, error){
+	handler.PayloadFormatUnified: func(changes []change, _, _ interface{}) ([]byte, error) {
+		return renderUnified(changes, marshalJSON)
+	},
+	handler.PayloadFormatYAML: func(changes []change, _, _ interface{}) ([]byte, error) {
+		return renderUnified(changes, marshalYAML)
+	},
+	handler.PayloadFormatJSONPatch: func(_ []change, from, to interface{}) ([]byte, error) {
+		return marshalJSON(jsonPatch("", from, to, []jsonPatchOperation{}))
+	},
+	handler.PayloadFormatMergePatch: func(_ []change, from, to interface{}) ([]byte, error) {
+		return marshalJSON(mergePatch(from, to))
+	},
+}
+
+// marshalYAML return the value as YAML, going through JSON so that numbers are kept as written
+func marshalYAML(value interface{}) ([]byte, error) {
+	raw, err := marshalJSON(value)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML(raw)
+}
+
+// jsonPatchOperation is an RFC 6902 operation, a map keeps the value of the
+// operations that have one, even when null, and marshals op, path and value in order
+type jsonPatchOperation map[string]interface{}
+
+// jsonPatch appends the operations turning from into to, list items are patched by their position
+// so that the operations can be applied one after the other, items are appended or removed from
+// the end when the list length changes
+func jsonPatch(pointer string, from, to interface{}, ops []jsonPatchOperation) []jsonPatchOperation {
+	switch f := from.(type) {
+	case map[string]interface{}:
+		if t, ok := to.(map[string]interface{}); ok {
+			for _, k := range sortedKeys(f, t) {
+				fromValue, inFrom := f[k]
+				toValue, inTo := t[k]
+				keyPointer := pointer + "/" + escapePointer(k)
+
+				switch {
+				case !inTo:
+					ops = append(ops, jsonPatchOperation{"op": "remove", "path": keyPointer})
+				case !inFrom:
+					ops = append(ops, jsonPatchOperation{"op": "add", "path": keyPointer, "value": toValue})
+				default:
+					ops = jsonPatch(keyPointer, fromValue, toValue, ops)
+				}
+			}
+			return ops
+		}
+	case []interface{}:
+		if t, ok := to.([]interface{}); ok {
+			for i := 0; i < len(f) && i < len(t); i++ {
+				ops = jsonPatch(fmt.Sprintf("%s/%d", pointer, i), f[i], t[i], ops)
+			}
+			for i := len(f); i < len(t); i++ {
+				ops = append(ops, jsonPatchOperation{"op": "add", "path": pointer + "/-", "value": t[i]})
+			}
+			for i := len(f) - 1; i >= len(t); i-- {
+				ops = append(ops, jsonPatchOperation{"op": "remove", "path": fmt.Sprintf("%s/%d", pointer, i)})
+			}
+			return ops
+		}
+	}
+	if reflect.DeepEqual(from, to) {
+		return ops
+	}
+	return append(ops, jsonPatchOperation{"op": "replace", "path": pointer, "value": to})
+}
+
+// escapePointer escapes a key as a JSON pointer reference token, RFC 6901
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+// mergePatch return the RFC 7386 merge patch turning from into to, objects are merged
+// field by field with removed fields set to null, while any other value is replaced whole
+func mergePatch(from, to interface{}) interface{} {
+	f, fromIsMap := from.(map[string]interface{})
+	t, toIsMap := to.(map[string]interface{})
+	if !fromIsMap || !toIsMap {
+		return to
+	}
+
+	patch := map[string]interface{}{}
+	for _, k := range sortedKeys(f, t) {
+		fromValue, inFrom := f[k]
+		toValue, inTo := t[k]
+
+		switch {
+		case !inTo:
+			patch[k] = nil
+		case !inFrom || !reflect.DeepEqual(fromValue, toValue):
+			patch[k] = mergePatch(fromValue, toValue)
+		}
+	}
+	return patch
+}
+
+// render the differences in the given format, which must be supported
+func render(format string, changes []change, from, to interface{}) ([]byte, error) {
+	r, ok := renderers[format]
+	if !ok {
+		return nil, errors.Errorf("unknown diff format %s", format)
+	}
+	return r(changes, from, to)
+}
@@ -0,0 +1,130 @@
+package diff
+
+import (
+	"github.com/snebel29/kwatchman/internal/pkg/handler"
+	"testing"
+)
+
+var (
+	fromManifest = []byte(`{
+ "metadata": {"labels": {"app": "web", "tier": "front"}, "annotations": {"owner/team": "a"}},
+ "spec": {"replicas": 2, "containers": [{"name": "app", "image": "web:1.0"}, {"name": "sidecar", "image": "envoy"}]}
+}`)
+	toManifest = []byte(`{
+ "metadata": {"labels": {"app": "web"}, "annotations": {"owner/team": "b"}},
+ "spec": {"replicas": 3, "containers": [{"name": "app", "image": "web:1.1"}]}
+}`)
+)
+
+func TestRenderFormats(t *testing.T) {
+	for _, test := range []struct {
+		format   string
+		expected string
+	}{
+		{
+			format: handler.PayloadFormatYAML,
+			expected: `@@ metadata.annotations["owner/team"] @@
+- a
++ b
+@@ metadata.labels.tier @@
+- front
+@@ spec.containers[name=app].image @@
+- web:1.0
++ web:1.1
+@@ spec.containers[name=sidecar] @@
+- image: envoy
+- name: sidecar
+@@ spec.replicas @@
+- 2
++ 3
+`,
+		},
+		{
+			format: handler.PayloadFormatJSONPatch,
+			expected: `[
+ {
+  "op": "replace",
+  "path": "/metadata/annotations/owner~1team",
+  "value": "b"
+ },
+ {
+  "op": "remove",
+  "path": "/metadata/labels/tier"
+ },
+ {
+  "op": "replace",
+  "path": "/spec/containers/0/image",
+  "value": "web:1.1"
+ },
+ {
+  "op": "remove",
+  "path": "/spec/containers/1"
+ },
+ {
+  "op": "replace",
+  "path": "/spec/replicas",
+  "value": 3
+ }
+]
+`,
+		},
+		{
+			format: handler.PayloadFormatMergePatch,
+			expected: `{
+ "metadata": {
+  "annotations": {
+   "owner/team": "b"
+  },
+  "labels": {
+   "tier": null
+  }
+ },
+ "spec": {
+  "containers": [
+   {
+    "image": "web:1.1",
+    "name": "app"
+   }
+  ],
+  "replicas": 3
+ }
+}
+`,
+		},
+	} {
+		out, err := diffManifests(fromManifest, toManifest, test.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != test.expected {
+			t.Errorf("%s output should be\n%s\ngot\n%s", test.format, test.expected, string(out))
+		}
+	}
+}
+
+func TestJSONPatchResizedLists(t *testing.T) {
+	ops := jsonPatch("", []interface{}{"a", "b", "c"}, []interface{}{"x"}, nil)
+	expected := []string{"replace /0", "remove /2", "remove /1"}
+	if len(ops) != len(expected) {
+		t.Fatalf("operations should be %v, got %v", expected, ops)
+	}
+	for i, op := range ops {
+		if got := op["op"].(string) + " " + op["path"].(string); got != expected[i] {
+			t.Errorf("operation %d should be %s, got %s instead", i, expected[i], got)
+		}
+	}
+
+	ops = jsonPatch("/args", []interface{}{}, []interface{}{"a", nil}, nil)
+	if len(ops) != 2 || ops[1]["path"] != "/args/-" {
+		t.Errorf("items should be appended, got %v", ops)
+	}
+	if _, ok := ops[1]["value"]; !ok {
+		t.Error("null values should be kept on add operations")
+	}
+}
+
+func TestRenderUnknownFormat(t *testing.T) {
+	if _, err := render("unknown", nil, nil, nil); err == nil {
+		t.Error("an unknown format should return an error")
+	}
+}
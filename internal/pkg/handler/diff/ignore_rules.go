@@ -0,0 +1,200 @@
+package diff
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/snebel29/kwatchman/internal/pkg/config"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ignorePath is a parsed field path whose fields are removed from manifests before their comparison,
+// written as the diff reports them such as spec.template.spec.containers[name=app].image, with *
+// wildcards matching any characters within a key, list index or list item field value
+type ignorePath []pathSegment
+
+// pathSegment matches map keys, or list items either by their index or by one of their fields
+type pathSegment struct {
+	list    bool           // Matches list items, otherwise map keys
+	field   string         // List item field matched against, the item index when empty
+	pattern *regexp.Regexp // Anchored pattern the key, index or field value has to match
+}
+
+// ignoreRule holds the paths ignored for a resource kind, every kind when empty
+type ignoreRule struct {
+	kind  string
+	paths []ignorePath
+}
+
+// newIgnoreRules parses the configured rules, invalid paths are skipped
+func newIgnoreRules(rules []config.IgnoreRule) []ignoreRule {
+	var ignoreRules []ignoreRule
+	for _, r := range rules {
+		rule := ignoreRule{kind: r.Kind}
+		for _, p := range r.Paths {
+			path, err := parseIgnorePath(p)
+			if err != nil {
+				log.Warnf("Skipping diff ignore path %s: %s", p, err)
+				continue
+			}
+			rule.paths = append(rule.paths, path)
+		}
+		ignoreRules = append(ignoreRules, rule)
+	}
+	return ignoreRules
+}
+
+// ignorePathsFor return the paths ignored for the resource kind
+func ignorePathsFor(rules []ignoreRule, kind string) []ignorePath {
+	var paths []ignorePath
+	for _, r := range rules {
+		if r.kind == "" || strings.EqualFold(r.kind, kind) {
+			paths = append(paths, r.paths...)
+		}
+	}
+	return paths
+}
+
+// parseIgnorePath parses paths such as metadata.annotations["sidecar.istio.io/*"], spec.ports[0]
+// or spec.template.spec.containers[name=app].image
+func parseIgnorePath(p string) (ignorePath, error) {
+	var path ignorePath
+	for i := 0; i < len(p); {
+		switch p[i] {
+		case '.':
+			if i == 0 || i == len(p)-1 || p[i+1] == '.' || p[i+1] == '[' {
+				return nil, errors.Errorf("empty key at %d", i)
+			}
+			i++
+
+		case '[':
+			end, segment, err := parseBracketSegment(p, i)
+			if err != nil {
+				return nil, err
+			}
+			if end < len(p) && p[end] != '.' && p[end] != '[' {
+				return nil, errors.Errorf("unexpected %q at %d", p[end], end)
+			}
+			path = append(path, segment)
+			i = end
+
+		default:
+			end := strings.IndexAny(p[i:], ".[")
+			if end == -1 {
+				end = len(p)
+			} else {
+				end += i
+			}
+			path = append(path, pathSegment{pattern: globPattern(p[i:end])})
+			i = end
+		}
+	}
+	if len(path) == 0 {
+		return nil, errors.New("empty path")
+	}
+	return path, nil
+}
+
+// parseBracketSegment parses the bracket segment starting at i, either a quoted map key or a list
+// item selector, and return the position following it
+func parseBracketSegment(p string, i int) (int, pathSegment, error) {
+	if strings.HasPrefix(p[i:], `["`) {
+		// The quoted key ends on the first unescaped quote
+		for j := i + 2; j < len(p); j++ {
+			if p[j] == '\\' {
+				j++
+				continue
+			}
+			if p[j] != '"' {
+				continue
+			}
+			if j+1 >= len(p) || p[j+1] != ']' {
+				return 0, pathSegment{}, errors.Errorf("missing ] at %d", j+1)
+			}
+			key, err := strconv.Unquote(p[i+1 : j+1])
+			if err != nil {
+				return 0, pathSegment{}, errors.Wrapf(err, "quoted key at %d", i)
+			}
+			return j + 2, pathSegment{pattern: globPattern(key)}, nil
+		}
+		return 0, pathSegment{}, errors.Errorf("unterminated quoted key at %d", i)
+	}
+
+	end := strings.IndexByte(p[i:], ']')
+	if end == -1 {
+		return 0, pathSegment{}, errors.Errorf("missing ] at %d", i)
+	}
+	selector := p[i+1 : i+end]
+	if selector == "" {
+		return 0, pathSegment{}, errors.Errorf("empty list selector at %d", i)
+	}
+
+	segment := pathSegment{list: true}
+	if eq := strings.IndexByte(selector, '='); eq != -1 {
+		segment.field = selector[:eq]
+		segment.pattern = globPattern(selector[eq+1:])
+	} else {
+		segment.pattern = globPattern(selector)
+	}
+	return i + end + 1, segment, nil
+}
+
+// globPattern return the anchored regular expression of a pattern where * matches any characters
+func globPattern(glob string) *regexp.Regexp {
+	parts := strings.Split(glob, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// remove the fields matching the path from the parsed manifest, return the value without them
+func (p ignorePath) remove(value interface{}) interface{} {
+	if len(p) == 0 {
+		return value
+	}
+	segment, last := p[0], len(p) == 1
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if segment.list {
+			return value
+		}
+		for k, child := range v {
+			if !segment.pattern.MatchString(k) {
+				continue
+			}
+			if last {
+				delete(v, k)
+			} else {
+				v[k] = p[1:].remove(child)
+			}
+		}
+
+	case []interface{}:
+		if !segment.list {
+			return value
+		}
+		kept := v[:0]
+		for i, item := range v {
+			if !segment.matches(i, item) {
+				kept = append(kept, item)
+				continue
+			}
+			if !last {
+				kept = append(kept, p[1:].remove(item))
+			}
+		}
+		return kept
+	}
+	return value
+}
+
+func (s pathSegment) matches(index int, item interface{}) bool {
+	if s.field == "" {
+		return s.pattern.MatchString(strconv.Itoa(index))
+	}
+	value := itemKey(item, s.field)
+	return value != "" && s.pattern.MatchString(value)
+}
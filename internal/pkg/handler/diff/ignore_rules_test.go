@@ -0,0 +1,220 @@
+package diff
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/snebel29/kooper/operator/common"
+	"github.com/snebel29/kwatchman/internal/pkg/config"
+	"github.com/snebel29/kwatchman/internal/pkg/handler"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIgnorePath(t *testing.T) {
+	for _, p := range []string{
+		"spec.replicas",
+		`metadata.annotations["sidecar.istio.io/*"]`,
+		`spec.template.metadata.annotations["kubectl.kubernetes.io/restartedAt"]`,
+		"spec.template.spec.containers[name=istio-*].image",
+		"spec.ports[*].nodePort",
+		"metadata.labels.*",
+	} {
+		if _, err := parseIgnorePath(p); err != nil {
+			t.Errorf("%s should be a valid path: %s", p, err)
+		}
+	}
+
+	for _, p := range []string{
+		"",
+		".spec",
+		"spec.",
+		"spec..replicas",
+		"spec.ports[",
+		"spec.ports[]",
+		`metadata.annotations["unterminated]`,
+		"spec.ports[0]name",
+	} {
+		if _, err := parseIgnorePath(p); err == nil {
+			t.Errorf("%q should be an invalid path", p)
+		}
+	}
+}
+
+func TestIgnorePathRemove(t *testing.T) {
+	manifest := []byte(`{
+ "metadata": {"annotations": {"sidecar.istio.io/status": "{}", "sidecar.istio.io/inject": "true", "owner": "a"}},
+ "spec": {
+  "replicas": 3,
+  "ports": [{"port": 80, "nodePort": 30080}, {"port": 443, "nodePort": 30443}],
+  "containers": [{"name": "app", "image": "web"}, {"name": "istio-proxy", "image": "envoy"}],
+  "args": ["a", "b", "c"]
+ }
+}`)
+	expected := map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{"owner": "a"}},
+		"spec": map[string]interface{}{
+			"ports": []interface{}{
+				map[string]interface{}{"port": json.Number("80")},
+				map[string]interface{}{"port": json.Number("443")},
+			},
+			"containers": []interface{}{map[string]interface{}{"name": "app", "image": "web"}},
+			"args":       []interface{}{"a", "c"},
+		},
+	}
+
+	obj, err := parseManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{
+		"spec.replicas",
+		`metadata.annotations["sidecar.istio.io/*"]`,
+		"spec.ports[*].nodePort",
+		"spec.containers[name=istio-*]",
+		"spec.args[1]",
+		"spec.unexistent.field",
+		"spec.replicas[0]",
+	} {
+		path, err := parseIgnorePath(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj = path.remove(obj)
+	}
+
+	cleaned, err := marshalJSON(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedJSON, _ := marshalJSON(expected)
+	if string(cleaned) != string(expectedJSON) {
+		t.Errorf("cleaned manifest should be\n%s\ngot\n%s", expectedJSON, cleaned)
+	}
+}
+
+func TestIgnorePathsFor(t *testing.T) {
+	rules := newIgnoreRules([]config.IgnoreRule{
+		{Paths: []string{"metadata.labels.*"}},
+		{Kind: "Deployment", Paths: []string{"spec.replicas", "invalid["}},
+		{Kind: "service", Paths: []string{"spec.clusterIP"}},
+	})
+
+	if paths := ignorePathsFor(rules, "deployment"); len(paths) != 2 {
+		t.Errorf("deployment should have 2 valid paths, got %d instead", len(paths))
+	}
+	if paths := ignorePathsFor(rules, "statefulset"); len(paths) != 1 {
+		t.Errorf("statefulset should only have the paths for every kind, got %d instead", len(paths))
+	}
+}
+
+func TestDiffHandlerIgnoresPaths(t *testing.T) {
+	h := NewDiffHandler(config.Handler{
+		Ignore: []config.IgnoreRule{{Kind: "deployment", Paths: []string{"spec.replicas"}}},
+	})
+
+	newEvent := func(kind string, manifest string) *handler.Event {
+		return &handler.Event{
+			K8sEvt:       &common.K8sEvent{Key: "default/web", HasSynced: true, Kind: kind},
+			RunNext:      true,
+			ResourceKind: "deployment",
+			K8sManifest:  []byte(manifest),
+		}
+	}
+
+	if err := h.Run(context.TODO(), newEvent("Add", `{"spec": {"replicas": 1}}`)); err != nil {
+		t.Fatal(err)
+	}
+	evt := newEvent("Update", `{"spec": {"replicas": 5}}`)
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if evt.RunNext {
+		t.Errorf("ignored spec.replicas changes should not be reported, got %s", evt.Payload)
+	}
+
+	evt = newEvent("Update", `{"spec": {"replicas": 5, "paused": true}}`)
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if !evt.RunNext || reflect.DeepEqual(evt.Payload, []byte{}) {
+		t.Error("changes other than spec.replicas should be reported")
+	}
+}
+
+func TestDiffHandlerIgnoresJobControllerFields(t *testing.T) {
+	h := NewDiffHandler(config.Handler{})
+
+	newEvent := func(kind, uid, image string) *handler.Event {
+		return &handler.Event{
+			K8sEvt:       &common.K8sEvent{Key: "default/backup", HasSynced: true, Kind: kind},
+			RunNext:      true,
+			ResourceKind: "job",
+			K8sManifest: []byte(`{
+ "metadata": {"name": "backup", "labels": {"app": "backup", "controller-uid": "` + uid + `"}},
+ "spec": {
+  "selector": {"matchLabels": {"controller-uid": "` + uid + `"}},
+  "template": {
+   "metadata": {"labels": {"batch.kubernetes.io/controller-uid": "` + uid + `", "job-name": "backup"}},
+   "spec": {"containers": [{"name": "backup", "image": "` + image + `"}]}
+  }
+ }
+}`),
+		}
+	}
+
+	if err := h.Run(context.TODO(), newEvent("Add", "1", "backup:1")); err != nil {
+		t.Fatal(err)
+	}
+	evt := newEvent("Update", "2", "backup:1")
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if evt.RunNext {
+		t.Errorf("job controller fields should not be reported, got %s", evt.Payload)
+	}
+
+	evt = newEvent("Update", "3", "backup:2")
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if !evt.RunNext || !strings.Contains(string(evt.Payload), "backup:2") {
+		t.Errorf("the image change should be reported, got %s", evt.Payload)
+	}
+}
+
+func TestDiffHandlerIgnoresHPAMetrics(t *testing.T) {
+	h := NewDiffHandler(config.Handler{})
+
+	newEvent := func(kind, replicas, metrics string) *handler.Event {
+		return &handler.Event{
+			K8sEvt:       &common.K8sEvent{Key: "default/web", HasSynced: true, Kind: kind},
+			RunNext:      true,
+			ResourceKind: "horizontalpodautoscaler",
+			K8sManifest: []byte(`{
+ "metadata": {"name": "web", "annotations": {"autoscaling.alpha.kubernetes.io/current-metrics": "` + metrics + `"}},
+ "spec": {"maxReplicas": ` + replicas + `},
+ "status": {"currentReplicas": 3, "currentCPUUtilizationPercentage": ` + metrics + `}
+}`),
+		}
+	}
+
+	if err := h.Run(context.TODO(), newEvent("Add", "10", "50")); err != nil {
+		t.Fatal(err)
+	}
+	evt := newEvent("Update", "10", "80")
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if evt.RunNext {
+		t.Errorf("hpa current metrics should not be reported, got %s", evt.Payload)
+	}
+
+	evt = newEvent("Update", "20", "80")
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if !evt.RunNext || !strings.Contains(string(evt.Payload), "maxReplicas") {
+		t.Errorf("the max replicas change should be reported, got %s", evt.Payload)
+	}
+}
@@ -0,0 +1,156 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	// lineContext is the number of unchanged lines shown around the changed ones
+	lineContext = 2
+
+	// maxLineDiffCells bounds the lines compared with each other, beyond it the
+	// changed lines are reported as removed and added as a whole
+	maxLineDiffCells = 4 * 1000 * 1000
+)
+
+// lineEdit is a line kept, removed or added, prefixed by " ", "-" or "+" respectively
+type lineEdit struct {
+	prefix string
+	line   string
+}
+
+// multilineStrings return both values of the change when they are strings and any of them spans
+// several lines, such as configuration files within configmaps, missing values are empty
+func multilineStrings(c change) (string, string, bool) {
+	from, fromOk := c.From.(string)
+	to, toOk := c.To.(string)
+	if (!fromOk && c.From != nil) || (!toOk && c.To != nil) {
+		return "", "", false
+	}
+	if !strings.Contains(from, "\n") && !strings.Contains(to, "\n") {
+		return "", "", false
+	}
+	return from, to, true
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines return the edits turning from lines into to lines, as the longest common
+// subsequence of lines between the common prefix and suffix
+func diffLines(from, to []string) []lineEdit {
+	prefix := 0
+	for prefix < len(from) && prefix < len(to) && from[prefix] == to[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(from)-prefix && suffix < len(to)-prefix &&
+		from[len(from)-1-suffix] == to[len(to)-1-suffix] {
+		suffix++
+	}
+
+	var edits []lineEdit
+	for _, line := range from[:prefix] {
+		edits = append(edits, lineEdit{" ", line})
+	}
+	edits = append(edits, diffChangedLines(from[prefix:len(from)-suffix], to[prefix:len(to)-suffix])...)
+	for _, line := range from[len(from)-suffix:] {
+		edits = append(edits, lineEdit{" ", line})
+	}
+	return edits
+}
+
+func diffChangedLines(from, to []string) []lineEdit {
+	var edits []lineEdit
+	if len(from)*len(to) > maxLineDiffCells {
+		for _, line := range from {
+			edits = append(edits, lineEdit{"-", line})
+		}
+		for _, line := range to {
+			edits = append(edits, lineEdit{"+", line})
+		}
+		return edits
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of from[i:] and to[j:]
+	lcs := make([][]int, len(from)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if from[i] == to[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(from) || j < len(to) {
+		switch {
+		case i < len(from) && j < len(to) && from[i] == to[j]:
+			edits = append(edits, lineEdit{" ", from[i]})
+			i++
+			j++
+		case j >= len(to) || (i < len(from) && lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, lineEdit{"-", from[i]})
+			i++
+		default:
+			edits = append(edits, lineEdit{"+", to[j]})
+			j++
+		}
+	}
+	return edits
+}
+
+// writeLineDiff writes the changed lines between both values along with the lines around them,
+// unchanged lines further away are skipped and marked by ..., return false when no line changed,
+// such as when only the trailing new line did
+func writeLineDiff(buf *bytes.Buffer, from, to string) bool {
+	edits := diffLines(splitLines(from), splitLines(to))
+
+	// Lines to be written are those within the context of any change
+	show := make([]bool, len(edits))
+	changed := false
+	for i, e := range edits {
+		if e.prefix == " " {
+			continue
+		}
+		changed = true
+		for j := i - lineContext; j <= i+lineContext; j++ {
+			if j >= 0 && j < len(edits) {
+				show[j] = true
+			}
+		}
+	}
+	if !changed {
+		return false
+	}
+
+	skipped := false
+	for i, e := range edits {
+		if !show[i] {
+			skipped = true
+			continue
+		}
+		if skipped {
+			buf.WriteString("  ...\n")
+			skipped = false
+		}
+		fmt.Fprintf(buf, "%s %s\n", e.prefix, e.line)
+	}
+	if skipped {
+		buf.WriteString("  ...\n")
+	}
+	return true
+}
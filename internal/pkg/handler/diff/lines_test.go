@@ -0,0 +1,73 @@
+package diff
+
+import (
+	"bytes"
+	"github.com/snebel29/kwatchman/internal/pkg/handler"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	edits := diffLines([]string{"a", "b", "c", "d"}, []string{"a", "c", "x", "d"})
+	expected := []lineEdit{{" ", "a"}, {"-", "b"}, {" ", "c"}, {"+", "x"}, {" ", "d"}}
+	if len(edits) != len(expected) {
+		t.Fatalf("edits should be %v, got %v", expected, edits)
+	}
+	for i := range edits {
+		if edits[i] != expected[i] {
+			t.Errorf("edit %d should be %v, got %v", i, expected[i], edits[i])
+		}
+	}
+}
+
+func TestWriteLineDiff(t *testing.T) {
+	from := "1\n2\n3\n4\n5\n6\n7\n8\n9\n"
+	to := "1\n2\n3\n4\n5\nsix\n7\n8\n9\n"
+	expected := `  ...
+  4
+  5
+- 6
++ six
+  7
+  8
+  ...
+`
+	var buf bytes.Buffer
+	if !writeLineDiff(&buf, from, to) {
+		t.Fatal("the changed line should have been written")
+	}
+	if buf.String() != expected {
+		t.Errorf("line diff should be\n%s\ngot\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	if writeLineDiff(&buf, "a\nb", "a\nb\n") || buf.Len() != 0 {
+		t.Error("only the trailing new line changing should not be written as lines")
+	}
+}
+
+func TestRenderMultilineValues(t *testing.T) {
+	from := []byte(`{"data": {"app.properties": "color=blue\nsize=10\nlog=info\n", "removed": "a\nb\n", "mode": "dark"}}`)
+	to := []byte(`{"data": {"app.properties": "color=red\nsize=10\nlog=info\n", "added": "x\ny\n", "mode": "light"}}`)
+	expected := `@@ data.added @@
++ x
++ y
+@@ data["app.properties"] @@
+- color=blue
++ color=red
+  size=10
+  log=info
+@@ data.mode @@
+- "dark"
++ "light"
+@@ data.removed @@
+- a
+- b
+`
+	out, err := diffManifests(from, to, handler.PayloadFormatUnified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != expected {
+		t.Errorf("output should be\n%s\ngot\n%s", expected, out)
+	}
+}
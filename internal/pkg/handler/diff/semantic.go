@@ -0,0 +1,264 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// changeType tells how a field changed between two manifests
+type changeType string
+
+const (
+	fieldAdded   changeType = "added"
+	fieldRemoved changeType = "removed"
+	fieldChanged changeType = "changed"
+)
+
+// change is a difference found at a field path, such as spec.template.spec.containers[name=app].image
+type change struct {
+	Type changeType
+	Path string
+	From interface{} // Previous value, nil when added
+	To   interface{} // Current value, nil when removed
+}
+
+// listMergeKeys are the fields identifying list items, the first one found unique within both
+// lists is used to match their items regardless of their position, as kubernetes does for
+// containers, volumes, ports, etc
+var listMergeKeys = []string{"name", "mountPath", "containerPort", "devicePath", "ip"}
+
+// plainKey matches the map keys that can be written as is within a field path
+var plainKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// parseManifests parses both JSON manifests to be compared
+func parseManifests(from, to []byte) (interface{}, interface{}, error) {
+	fromObj, err := parseManifest(from)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "previous manifest")
+	}
+	toObj, err := parseManifest(to)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "current manifest")
+	}
+	return fromObj, toObj, nil
+}
+
+// parseManifest keeps numbers as they are written, so that they are compared and rendered
+// without the float64 precision loss
+func parseManifest(manifest []byte) (interface{}, error) {
+	var obj interface{}
+	d := json.NewDecoder(bytes.NewReader(manifest))
+	d.UseNumber()
+	if err := d.Decode(&obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// diffValues appends the differences between from and to found at path, objects and lists are
+// walked down to their fields while any other value, or a value changing its type, is compared whole
+func diffValues(path string, from, to interface{}, changes []change) []change {
+	switch f := from.(type) {
+	case map[string]interface{}:
+		if t, ok := to.(map[string]interface{}); ok {
+			return diffMaps(path, f, t, changes)
+		}
+	case []interface{}:
+		if t, ok := to.([]interface{}); ok {
+			return diffLists(path, f, t, changes)
+		}
+	default:
+		if reflect.DeepEqual(from, to) {
+			return changes
+		}
+	}
+	return append(changes, change{Type: fieldChanged, Path: path, From: from, To: to})
+}
+
+func diffMaps(path string, from, to map[string]interface{}, changes []change) []change {
+	for _, k := range sortedKeys(from, to) {
+		fromValue, inFrom := from[k]
+		toValue, inTo := to[k]
+		fieldPath := joinPath(path, k)
+
+		switch {
+		case !inTo:
+			changes = append(changes, change{Type: fieldRemoved, Path: fieldPath, From: fromValue})
+		case !inFrom:
+			changes = append(changes, change{Type: fieldAdded, Path: fieldPath, To: toValue})
+		default:
+			changes = diffValues(fieldPath, fromValue, toValue, changes)
+		}
+	}
+	return changes
+}
+
+// diffLists matches the list items by their merge key when they have one,
+// and by their position otherwise
+func diffLists(path string, from, to []interface{}, changes []change) []change {
+	if key := listMergeKey(from, to); key != "" {
+		return diffKeyedLists(path, key, from, to, changes)
+	}
+
+	for i := 0; i < len(from) || i < len(to); i++ {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case i >= len(to):
+			changes = append(changes, change{Type: fieldRemoved, Path: itemPath, From: from[i]})
+		case i >= len(from):
+			changes = append(changes, change{Type: fieldAdded, Path: itemPath, To: to[i]})
+		default:
+			changes = diffValues(itemPath, from[i], to[i], changes)
+		}
+	}
+	return changes
+}
+
+func diffKeyedLists(path, key string, from, to []interface{}, changes []change) []change {
+	toItems := make(map[string]interface{}, len(to))
+	for _, item := range to {
+		toItems[itemKey(item, key)] = item
+	}
+	fromItems := make(map[string]interface{}, len(from))
+
+	for _, item := range from {
+		value := itemKey(item, key)
+		fromItems[value] = item
+		itemPath := fmt.Sprintf("%s[%s=%s]", path, key, value)
+		if toItem, ok := toItems[value]; ok {
+			changes = diffValues(itemPath, item, toItem, changes)
+		} else {
+			changes = append(changes, change{Type: fieldRemoved, Path: itemPath, From: item})
+		}
+	}
+	for _, item := range to {
+		value := itemKey(item, key)
+		if _, ok := fromItems[value]; !ok {
+			itemPath := fmt.Sprintf("%s[%s=%s]", path, key, value)
+			changes = append(changes, change{Type: fieldAdded, Path: itemPath, To: item})
+		}
+	}
+	return changes
+}
+
+// listMergeKey return the first merge key unique within both lists, or an empty string
+// when their items can only be matched by position
+func listMergeKey(from, to []interface{}) string {
+	if len(from) == 0 && len(to) == 0 {
+		return ""
+	}
+	for _, key := range listMergeKeys {
+		if isUniqueKey(from, key) && isUniqueKey(to, key) {
+			return key
+		}
+	}
+	return ""
+}
+
+func isUniqueKey(list []interface{}, key string) bool {
+	seen := make(map[string]bool, len(list))
+	for _, item := range list {
+		value := itemKey(item, key)
+		if value == "" || seen[value] {
+			return false
+		}
+		seen[value] = true
+	}
+	return true
+}
+
+// itemKey return the value of the item key when it's a string or a number, or an empty string
+func itemKey(item interface{}, key string) string {
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	switch v := m[key].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+func sortedKeys(maps ...map[string]interface{}) []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, m := range maps {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// joinPath appends the key to the path, keys such as annotations with dots or slashes are quoted
+func joinPath(path, key string) string {
+	if !plainKey.MatchString(key) {
+		return fmt.Sprintf("%s[%q]", path, key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// renderUnified renders the changes as unified text, a hunk per field path with its previous and
+// current values marshalled as lines, prefixed by - and + respectively, or with the changed
+// lines of multi-line strings
+func renderUnified(changes []change, marshal func(interface{}) ([]byte, error)) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, c := range changes {
+		fmt.Fprintf(&buf, "@@ %s @@\n", c.Path)
+		// Multi-line strings are diffed line by line rather than as a whole
+		if from, to, ok := multilineStrings(c); ok && writeLineDiff(&buf, from, to) {
+			continue
+		}
+		if c.Type != fieldAdded {
+			if err := writeValueLines(&buf, "-", c.From, marshal); err != nil {
+				return nil, err
+			}
+		}
+		if c.Type != fieldRemoved {
+			if err := writeValueLines(&buf, "+", c.To, marshal); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func writeValueLines(buf *bytes.Buffer, prefix string, value interface{}, marshal func(interface{}) ([]byte, error)) error {
+	raw, err := marshal(value)
+	if err != nil {
+		return errors.Wrap(err, "renderUnified")
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n") {
+		fmt.Fprintf(buf, "%s %s\n", prefix, line)
+	}
+	return nil
+}
+
+// marshalJSON return the value as indented JSON, without escaping HTML characters
+// such as those found within images or selectors
+func marshalJSON(value interface{}) ([]byte, error) {
+	var raw bytes.Buffer
+	e := json.NewEncoder(&raw)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", " ")
+	if err := e.Encode(value); err != nil {
+		return nil, err
+	}
+	return raw.Bytes(), nil
+}
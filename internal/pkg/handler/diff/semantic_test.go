@@ -0,0 +1,120 @@
+package diff
+
+import (
+	"github.com/snebel29/kwatchman/internal/pkg/handler"
+	"reflect"
+	"testing"
+)
+
+func TestDiffValues(t *testing.T) {
+	from := []byte(`{
+ "kind": "Deployment",
+ "metadata": {"annotations": {"app.kubernetes.io/owner": "team-a"}, "labels": {"app": "web"}},
+ "spec": {"replicas": 2, "template": {"spec": {
+  "containers": [
+   {"name": "sidecar", "image": "envoy:1.10"},
+   {"name": "app", "image": "web:1.0", "args": ["--port", "80"]}
+  ]
+ }}}
+}`)
+	to := []byte(`{
+ "kind": "Deployment",
+ "metadata": {"annotations": {"app.kubernetes.io/owner": "team-b"}, "labels": {"app": "web", "tier": "front"}},
+ "spec": {"template": {"spec": {
+  "containers": [
+   {"name": "app", "image": "web:1.1", "args": ["--port"]},
+   {"name": "sidecar", "image": "envoy:1.10"},
+   {"name": "debug", "image": "busybox"}
+  ]
+ }}}
+}`)
+
+	fromObj, toObj, err := parseManifests(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := diffValues("", fromObj, toObj, nil)
+
+	var paths []string
+	for _, c := range changes {
+		paths = append(paths, string(c.Type)+" "+c.Path)
+	}
+	expected := []string{
+		`changed metadata.annotations["app.kubernetes.io/owner"]`,
+		`added metadata.labels.tier`,
+		`removed spec.replicas`,
+		`removed spec.template.spec.containers[name=app].args[1]`,
+		`changed spec.template.spec.containers[name=app].image`,
+		`added spec.template.spec.containers[name=debug]`,
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("changes should be\n%v\ngot\n%v", expected, paths)
+	}
+}
+
+func TestDiffManifestsWithoutChanges(t *testing.T) {
+	diff, err := diffManifests(
+		[]byte(`{"spec": {"ports": [{"port": 80}, {"port": 443}], "replicas": 1.0}}`),
+		[]byte(`{"spec": {"replicas": 1.0, "ports": [{"port": 80}, {"port": 443}]}}`),
+		handler.PayloadFormatUnified,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != nil {
+		t.Errorf("there should be no changes, got %s", diff)
+	}
+}
+
+func TestListMergeKey(t *testing.T) {
+	for _, test := range []struct {
+		from, to []interface{}
+		expected string
+	}{
+		{nil, nil, ""},
+		{[]interface{}{"a", "b"}, []interface{}{"a"}, ""},
+		{
+			[]interface{}{map[string]interface{}{"name": "a"}},
+			[]interface{}{map[string]interface{}{"name": "b"}},
+			"name",
+		},
+		{
+			[]interface{}{map[string]interface{}{"name": "a", "mountPath": "/a"}, map[string]interface{}{"name": "a", "mountPath": "/b"}},
+			nil,
+			"mountPath",
+		},
+		{
+			[]interface{}{map[string]interface{}{"port": "80"}},
+			[]interface{}{map[string]interface{}{"port": "80"}},
+			"",
+		},
+	} {
+		if key := listMergeKey(test.from, test.to); key != test.expected {
+			t.Errorf("merge key of %v and %v should be %q, got %q instead", test.from, test.to, test.expected, key)
+		}
+	}
+}
+
+func TestRenderUnified(t *testing.T) {
+	out, err := renderUnified([]change{
+		{Type: fieldChanged, Path: "spec.image", From: "web:1.0", To: "web:<1.1>"},
+		{Type: fieldAdded, Path: "metadata.labels", To: map[string]interface{}{"app": "web"}},
+		{Type: fieldRemoved, Path: "spec.replicas", From: 2},
+	}, marshalJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `@@ spec.image @@
+- "web:1.0"
++ "web:<1.1>"
+@@ metadata.labels @@
++ {
++  "app": "web"
++ }
+@@ spec.replicas @@
+- 2
+`
+	if string(out) != expected {
+		t.Errorf("unified output should be\n%s\ngot\n%s", expected, string(out))
+	}
+}
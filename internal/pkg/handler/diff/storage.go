@@ -1,43 +1,231 @@
 package diff
 
-import "sync"
+import (
+	"container/list"
+	"github.com/pkg/errors"
+	"github.com/snebel29/kwatchman/internal/pkg/metrics"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
 
-type storage struct {
-	sync.RWMutex
-	repository map[string][]byte
+// storage keeps the last manifest of every object, grouped in buckets such as
+// the objects of a resource kind from a cluster
+type storage interface {
+	Add(bucket, key string, value []byte) error
+	Get(bucket, key string) ([]byte, bool, error)
+	Delete(bucket, key string) error
+	Keys(bucket string) ([]string, error)
 }
 
-// Return a new storage object, every diff handler should have its own
-// so singleton pattern was finally not necessary
-func newStorage() *storage {
-	r := make(map[string][]byte)
-	return &storage{
-		repository: r,
+// memoryStorage keeps the compressed manifests in memory, the least recently used ones
+// are evicted once their size goes over maxBytes, unless it's 0
+type memoryStorage struct {
+	sync.Mutex
+	repository map[string]map[string]*list.Element
+	lru        *list.List // Stored entries, the most recently used at the front
+	size       int64
+	maxBytes   int64
+}
+
+type memoryEntry struct {
+	bucket string
+	key    string
+	value  []byte
+}
+
+// newMemoryStorage return a memory storage evicting the least recently used
+// manifests when their compressed size is over maxBytes, unbounded when 0
+func newMemoryStorage(maxBytes int64) *memoryStorage {
+	return &memoryStorage{
+		repository: make(map[string]map[string]*list.Element),
+		lru:        list.New(),
+		maxBytes:   maxBytes,
 	}
 }
 
-func (s *storage) Add(key string, value []byte) {
+func (s *memoryStorage) Add(bucket, key string, value []byte) error {
+	compressed, err := compress(value)
+	if err != nil {
+		return err
+	}
+
 	s.Lock()
 	defer s.Unlock()
-	s.repository[key] = value
+	if s.repository[bucket] == nil {
+		s.repository[bucket] = make(map[string]*list.Element)
+	}
+
+	e, ok := s.repository[bucket][key]
+	if ok {
+		entry := e.Value.(*memoryEntry)
+		s.resize(int64(len(compressed)-len(entry.value)), 0)
+		entry.value = compressed
+		s.lru.MoveToFront(e)
+	} else {
+		e = s.lru.PushFront(&memoryEntry{bucket: bucket, key: key, value: compressed})
+		s.repository[bucket][key] = e
+		s.resize(int64(len(compressed)), 1)
+	}
+
+	// The added manifest is kept even when it's bigger than the limit on its own
+	for s.maxBytes > 0 && s.size > s.maxBytes && s.lru.Back() != e {
+		s.remove(s.lru.Back())
+		metrics.IncDiffStorageEviction()
+	}
+	return nil
 }
 
-func (s *storage) Delete(key string) {
+func (s *memoryStorage) Delete(bucket, key string) error {
 	s.Lock()
 	defer s.Unlock()
-	delete(s.repository, key)
+	if e, ok := s.repository[bucket][key]; ok {
+		s.remove(e)
+	}
+	return nil
 }
 
-func (s *storage) Get(key string) ([]byte, bool) {
-	s.RLock()
-	defer s.RUnlock()
-	v, ok := s.repository[key]
-	return v, ok
+func (s *memoryStorage) Get(bucket, key string) ([]byte, bool, error) {
+	s.Lock()
+	e, ok := s.repository[bucket][key]
+	if !ok {
+		s.Unlock()
+		return nil, false, nil
+	}
+	s.lru.MoveToFront(e)
+	compressed := e.Value.(*memoryEntry).value
+	s.Unlock()
+
+	v, err := decompress(compressed)
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+func (s *memoryStorage) Keys(bucket string) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	keys := make([]string, 0, len(s.repository[bucket]))
+	for k := range s.repository[bucket] {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// remove the entry from the storage, the lock must be held
+func (s *memoryStorage) remove(e *list.Element) {
+	entry := s.lru.Remove(e).(*memoryEntry)
+	delete(s.repository[entry.bucket], entry.key)
+	if len(s.repository[entry.bucket]) == 0 {
+		delete(s.repository, entry.bucket)
+	}
+	s.resize(-int64(len(entry.value)), -1)
+}
+
+// resize records the change of the stored size and objects, the lock must be held
+func (s *memoryStorage) resize(bytes int64, objects int) {
+	s.size += bytes
+	metrics.AddDiffStorage(bytes, objects)
+}
+
+// tmpFilePrefix prefixes the files being written, escaped keys never start with a dot
+const tmpFilePrefix = ".tmp-"
+
+// fileStorage persists every compressed manifest as a file within a directory per bucket, so
+// that it survives restarts, bucket and key are escaped to be used as file names
+type fileStorage struct {
+	dir string
 }
 
-func (s *storage) Has(key string) bool {
-	s.RLock()
-	defer s.RUnlock()
-	_, ok := s.repository[key]
-	return ok
+// newFileStorage return a storage persisted within dir, which is created when missing
+func newFileStorage(dir string) (storage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "newFileStorage")
+	}
+	return &fileStorage{dir: dir}, nil
+}
+
+func (s *fileStorage) bucketDir(bucket string) string {
+	return filepath.Join(s.dir, url.PathEscape(bucket))
+}
+
+func (s *fileStorage) path(bucket, key string) string {
+	return filepath.Join(s.bucketDir(bucket), url.PathEscape(key))
+}
+
+// Add writes the value into a temporary file renamed afterwards, so that a
+// stored manifest is never read half written
+func (s *fileStorage) Add(bucket, key string, value []byte) error {
+	dir := s.bucketDir(bucket)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "fileStorage Add")
+	}
+
+	tmpFile, err := ioutil.TempFile(dir, tmpFilePrefix)
+	if err != nil {
+		return errors.Wrap(err, "fileStorage Add")
+	}
+	defer os.Remove(tmpFile.Name())
+
+	compressed, err := compress(value)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if _, err := tmpFile.Write(compressed); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "fileStorage Add")
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrap(err, "fileStorage Add")
+	}
+	return errors.Wrap(os.Rename(tmpFile.Name(), s.path(bucket, key)), "fileStorage Add")
+}
+
+func (s *fileStorage) Delete(bucket, key string) error {
+	if err := os.Remove(s.path(bucket, key)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "fileStorage Delete")
+	}
+	return nil
+}
+
+func (s *fileStorage) Get(bucket, key string) ([]byte, bool, error) {
+	v, err := ioutil.ReadFile(s.path(bucket, key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "fileStorage Get")
+	}
+	if v, err = decompress(v); err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+func (s *fileStorage) Keys(bucket string) ([]string, error) {
+	files, err := ioutil.ReadDir(s.bucketDir(bucket))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "fileStorage Keys")
+	}
+
+	var keys []string
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), tmpFilePrefix) {
+			continue
+		}
+		key, err := url.PathUnescape(f.Name())
+		if err != nil {
+			return nil, errors.Wrapf(err, "fileStorage Keys %s", f.Name())
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
 }
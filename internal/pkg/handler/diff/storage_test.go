@@ -1,21 +1,32 @@
 package diff
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
 )
 
-func TestStorage_Add(t *testing.T) {
-	s := newStorage()
-	key := "a"
+func testStorage(t *testing.T, s storage) {
+	bucket := "cluster/deployment"
+	key := "namespace/a"
 	value := []byte("a_value")
 
-	s.Add(key, value)
-	if !s.Has(key) {
-		t.Errorf("Storage should have key %s", key)
+	if _, ok, err := s.Get(bucket, key); ok || err != nil {
+		t.Errorf("Storage should NOT have key %s, err: %v", key, err)
 	}
 
-	v, ok := s.Get(key)
+	if err := s.Add(bucket, key, value); err != nil {
+		t.Fatal(err)
+	}
+	v, ok, err := s.Get(bucket, key)
+	if err != nil {
+		t.Error(err)
+	}
 	if !reflect.DeepEqual(v, value) {
 		t.Errorf("returned value should have beem %#v", value)
 	}
@@ -23,8 +34,222 @@ func TestStorage_Add(t *testing.T) {
 		t.Error("ok should be true")
 	}
 
-	s.Delete(key)
-	if s.Has(key) {
+	if err := s.Add(bucket, "namespace/b", value); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add("other", "namespace/c", value); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := s.Keys(bucket)
+	if err != nil {
+		t.Error(err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"namespace/a", "namespace/b"}) {
+		t.Errorf("bucket keys should be returned, got %v instead", keys)
+	}
+
+	if err := s.Delete(bucket, key); err != nil {
+		t.Error(err)
+	}
+	if _, ok, _ := s.Get(bucket, key); ok {
 		t.Errorf("Storage should NOT have key %s", key)
 	}
+	if err := s.Delete(bucket, key); err != nil {
+		t.Errorf("deleting a missing key should not fail: %s", err)
+	}
+	if keys, err := s.Keys("missing"); err != nil || len(keys) != 0 {
+		t.Errorf("a missing bucket should have no keys, got %v, err: %v", keys, err)
+	}
+}
+
+func TestStorage_Add(t *testing.T) {
+	testStorage(t, newMemoryStorage(0))
+}
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+
+	// A new storage on the same directory finds the persisted manifests
+	s, err = newFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := s.Get("other", "namespace/c"); !ok || err != nil || string(v) != "a_value" {
+		t.Errorf("persisted value should have been found, got %s, err: %v", v, err)
+	}
+}
+
+func TestMemoryStorageEviction(t *testing.T) {
+	value := []byte(strings.Repeat("manifest ", 100))
+	compressed, err := compress(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newMemoryStorage(int64(2 * len(compressed)))
+
+	for _, key := range []string{"a", "b"} {
+		if err := s.Add("bucket", key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reading a makes b the least recently used
+	if _, ok, _ := s.Get("bucket", "a"); !ok {
+		t.Fatal("a should be stored")
+	}
+	if err := s.Add("bucket", "c", value); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _ := s.Keys("bucket")
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Errorf("b should have been evicted, got %v instead", keys)
+	}
+	if s.size != int64(2*len(compressed)) {
+		t.Errorf("the storage size should be %d, got %d instead", 2*len(compressed), s.size)
+	}
+
+	if err := s.Delete("bucket", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("bucket", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if s.size != 0 || s.lru.Len() != 0 || len(s.repository) != 0 {
+		t.Errorf("the storage should be empty, got %d bytes", s.size)
+	}
+}
+
+func TestFileStorageUncompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := s.(*fileStorage)
+	if err := os.MkdirAll(fs.bucketDir("bucket"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Manifests persisted before being compressed are still read
+	if err := ioutil.WriteFile(fs.path("bucket", "key"), []byte(`{"kind": "Service"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := s.Get("bucket", "key"); !ok || err != nil || string(v) != `{"kind": "Service"}` {
+		t.Errorf("uncompressed manifest should have been read, got %s, err: %v", v, err)
+	}
+}
+
+// benchmarkManifests return n manifests such as those stored by the diff handler
+func benchmarkManifests(n int) [][]byte {
+	manifests := make([][]byte, n)
+	for i := range manifests {
+		name := fmt.Sprintf("app-%d", i)
+		manifest, err := marshalJSON(map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "default",
+				"labels":    map[string]interface{}{"app": name, "tier": "backend", "team": "payments"},
+			},
+			"spec": map[string]interface{}{
+				"replicas": i%5 + 1,
+				"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": name}},
+				"template": map[string]interface{}{
+					"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": name}},
+					"spec": map[string]interface{}{
+						"containers": []interface{}{map[string]interface{}{
+							"name":  name,
+							"image": fmt.Sprintf("registry.example.com/%s:1.%d", name, i),
+							"ports": []interface{}{map[string]interface{}{"containerPort": 8080, "protocol": "TCP"}},
+							"env": []interface{}{
+								map[string]interface{}{"name": "LOG_LEVEL", "value": "info"},
+								map[string]interface{}{"name": "DATABASE_URL", "value": "postgres://db.default.svc:5432/" + name},
+							},
+							"resources": map[string]interface{}{
+								"limits":   map[string]interface{}{"cpu": "500m", "memory": "512Mi"},
+								"requests": map[string]interface{}{"cpu": "100m", "memory": "128Mi"},
+							},
+							"readinessProbe": map[string]interface{}{
+								"httpGet": map[string]interface{}{"path": "/healthz", "port": 8080},
+							},
+						}},
+					},
+				},
+			},
+		})
+		if err != nil {
+			panic(err)
+		}
+		manifests[i] = manifest
+	}
+	return manifests
+}
+
+// BenchmarkStorage stores a thousand manifests, reporting the memory retained per manifest by
+// the former plain map storage and by the compressed memory storage
+func BenchmarkStorage(b *testing.B) {
+	manifests := benchmarkManifests(1000)
+
+	for _, bench := range []struct {
+		name  string
+		store func(manifests [][]byte) interface{}
+	}{
+		{
+			name: "map",
+			store: func(manifests [][]byte) interface{} {
+				s := make(map[string][]byte)
+				for i, m := range manifests {
+					s[fmt.Sprintf("default/app-%d", i)] = append([]byte(nil), m...)
+				}
+				return s
+			},
+		},
+		{
+			name: "memory",
+			store: func(manifests [][]byte) interface{} {
+				s := newMemoryStorage(0)
+				for i, m := range manifests {
+					if err := s.Add("deployment", fmt.Sprintf("default/app-%d", i), m); err != nil {
+						b.Fatal(err)
+					}
+				}
+				return s
+			},
+		},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			var retained int64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				s := bench.store(manifests)
+				// Pooled objects, such as the gzip writers, are released on the second collection
+				runtime.GC()
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				// Signed since other allocations may be released meanwhile
+				retained = int64(after.HeapAlloc) - int64(before.HeapAlloc)
+				runtime.KeepAlive(s)
+			}
+			b.ReportMetric(float64(retained)/float64(len(manifests)), "retained-B/manifest")
+		})
+	}
 }
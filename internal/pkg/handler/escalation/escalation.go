@@ -0,0 +1,194 @@
+package escalation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/snebel29/kwatchman/internal/pkg/config"
+	"github.com/snebel29/kwatchman/internal/pkg/handler"
+	"github.com/snebel29/kwatchman/internal/pkg/registry"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"sort"
+	"strings"
+	"sync"
+)
+
+func init() {
+	registry.Register(registry.HANDLER, "escalation", NewEscalationHandler)
+}
+
+// rbacKinds are the resource kinds whose grants are checked, as registered by the resources
+var rbacKinds = map[string]bool{
+	"role":               true,
+	"clusterrole":        true,
+	"rolebinding":        true,
+	"clusterrolebinding": true,
+}
+
+// escalationVerbs allow to grant permissions beyond the ones held, or to act as someone else
+var escalationVerbs = []string{"escalate", "bind", "impersonate"}
+
+// rbacObject holds the fields of roles and bindings, either namespaced or cluster scoped
+type rbacObject struct {
+	Rules    []rbacv1.PolicyRule `json:"rules"`
+	RoleRef  *rbacv1.RoleRef     `json:"roleRef"`
+	Subjects []rbacv1.Subject    `json:"subjects"`
+}
+
+type escalationHandler struct {
+	sync.Mutex
+	config config.Handler
+	grants map[string]map[string]bool // Risky grants of every object, by cluster, resource kind and key
+}
+
+// NewEscalationHandler return a handler flagging the RBAC changes which grant wildcard verbs or
+// resources, secrets access, the escalate, bind and impersonate verbs or bind cluster-admin
+func NewEscalationHandler(c config.Handler) handler.Handler {
+	return &escalationHandler{
+		config: c,
+		grants: make(map[string]map[string]bool),
+	}
+}
+
+// Stateful return true, the grants already known must be kept up to date on standby replicas
+func (h *escalationHandler) Stateful() bool {
+	return true
+}
+
+// Run adds an alert to the event for every risky grant the object didn't have before, grants
+// found on the initial sync are only recorded, only the next stateful handlers, such as diff which
+// stores the manifests, run events without alerts when configured with onlyAlerts, except watch
+// events since a blind watch misses grants
+func (h *escalationHandler) Run(ctx context.Context, evt *handler.Event) error {
+	if handler.IsWatchEvent(evt) {
+		return nil
+	}
+	if rbacKinds[strings.ToLower(evt.ResourceKind)] {
+		if err := h.checkGrants(evt); err != nil {
+			evt.RunNext = false
+			return err
+		}
+	}
+	if h.config.OnlyAlerts && len(evt.Alerts) == 0 {
+		evt.OnlyStateful = true
+	}
+	return nil
+}
+
+func (h *escalationHandler) checkGrants(evt *handler.Event) error {
+	key := fmt.Sprintf("%s/%s/%s", evt.Cluster, evt.ResourceKind, evt.K8sEvt.Key)
+
+	var grants []string
+	switch evt.K8sEvt.Kind {
+	case "Add", "Update":
+		var err error
+		if grants, err = riskyGrants(evt.K8sManifest); err != nil {
+			return errors.Wrap(err, "riskyGrants")
+		}
+	case "Delete":
+	default:
+		return fmt.Errorf("Unknown event kind %s", evt.K8sEvt.Kind)
+	}
+
+	h.Lock()
+	previous := h.grants[key]
+	if len(grants) > 0 {
+		current := make(map[string]bool, len(grants))
+		for _, g := range grants {
+			current[g] = true
+		}
+		h.grants[key] = current
+	} else {
+		delete(h.grants, key)
+	}
+	h.Unlock()
+
+	if !evt.K8sEvt.HasSynced {
+		return nil
+	}
+	for _, g := range grants {
+		if !previous[g] {
+			evt.Alerts = append(evt.Alerts, g)
+		}
+	}
+	return nil
+}
+
+// riskyGrants return the sorted risky grants of a role or binding manifest
+func riskyGrants(manifest []byte) ([]string, error) {
+	obj := &rbacObject{}
+	if err := json.Unmarshal(manifest, obj); err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	for _, rule := range obj.Rules {
+		for _, g := range ruleGrants(rule) {
+			found[g] = true
+		}
+	}
+	if obj.RoleRef != nil && obj.RoleRef.Kind == "ClusterRole" && obj.RoleRef.Name == "cluster-admin" {
+		found[fmt.Sprintf("binds cluster-admin to %s", describeSubjects(obj.Subjects))] = true
+	}
+
+	grants := make([]string, 0, len(found))
+	for g := range found {
+		grants = append(grants, g)
+	}
+	sort.Strings(grants)
+	return grants, nil
+}
+
+// ruleGrants return the risky grants of a policy rule
+func ruleGrants(rule rbacv1.PolicyRule) []string {
+	var grants []string
+	on := describeRuleTargets(rule)
+
+	if contains(rule.Verbs, "*") {
+		grants = append(grants, fmt.Sprintf("grants wildcard verbs on %s", on))
+	}
+	if contains(rule.Resources, "*") {
+		grants = append(grants, fmt.Sprintf("grants %s on wildcard resources", strings.Join(rule.Verbs, ", ")))
+	} else if contains(rule.Resources, "secrets") && (contains(rule.APIGroups, "") || contains(rule.APIGroups, "*")) {
+		grants = append(grants, fmt.Sprintf("grants %s on secrets", strings.Join(rule.Verbs, ", ")))
+	}
+	for _, verb := range escalationVerbs {
+		if contains(rule.Verbs, verb) {
+			grants = append(grants, fmt.Sprintf("grants the %s verb on %s", verb, on))
+		}
+	}
+	return grants
+}
+
+func describeRuleTargets(rule rbacv1.PolicyRule) string {
+	targets := append(append([]string{}, rule.Resources...), rule.NonResourceURLs...)
+	if len(targets) == 0 {
+		return "nothing"
+	}
+	return strings.Join(targets, ", ")
+}
+
+func describeSubjects(subjects []rbacv1.Subject) string {
+	if len(subjects) == 0 {
+		return "no subjects"
+	}
+	described := make([]string, 0, len(subjects))
+	for _, s := range subjects {
+		name := s.Name
+		if s.Namespace != "" {
+			name = s.Namespace + "/" + s.Name
+		}
+		described = append(described, fmt.Sprintf("%s %s", s.Kind, name))
+	}
+	return strings.Join(described, ", ")
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package escalation
+
+import (
+	"context"
+	"github.com/snebel29/kooper/operator/common"
+	"github.com/snebel29/kwatchman/internal/pkg/config"
+	"github.com/snebel29/kwatchman/internal/pkg/handler"
+	"github.com/snebel29/kwatchman/internal/pkg/handler/diff"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newEvent(kind, resourceKind, manifest string, synced bool) *handler.Event {
+	return &handler.Event{
+		K8sEvt:       &common.K8sEvent{Kind: kind, Key: "default/app", HasSynced: synced},
+		RunNext:      true,
+		ResourceKind: resourceKind,
+		K8sManifest:  []byte(manifest),
+		Payload:      []byte{},
+	}
+}
+
+func TestRiskyGrants(t *testing.T) {
+	for _, test := range []struct {
+		manifest string
+		expected []string
+	}{
+		{
+			manifest: `{"rules": [{"apiGroups": ["apps"], "resources": ["deployments"], "verbs": ["get", "list"]}]}`,
+			expected: []string{},
+		},
+		{
+			manifest: `{"rules": [{"apiGroups": ["apps"], "resources": ["deployments"], "verbs": ["*"]}]}`,
+			expected: []string{"grants wildcard verbs on deployments"},
+		},
+		{
+			manifest: `{"rules": [{"apiGroups": [""], "resources": ["secrets", "pods"], "verbs": ["get"]}]}`,
+			expected: []string{"grants get on secrets"},
+		},
+		{
+			manifest: `{"rules": [{"apiGroups": ["*"], "resources": ["*"], "verbs": ["list"]}, {"nonResourceURLs": ["/metrics"], "verbs": ["*"]}]}`,
+			expected: []string{"grants list on wildcard resources", "grants wildcard verbs on /metrics"},
+		},
+		{
+			manifest: `{"rules": [{"apiGroups": ["rbac.authorization.k8s.io"], "resources": ["clusterroles"], "verbs": ["bind", "escalate"]}, {"apiGroups": [""], "resources": ["users"], "verbs": ["impersonate"]}]}`,
+			expected: []string{
+				"grants the bind verb on clusterroles",
+				"grants the escalate verb on clusterroles",
+				"grants the impersonate verb on users",
+			},
+		},
+		{
+			manifest: `{"roleRef": {"kind": "ClusterRole", "name": "cluster-admin"}, "subjects": [{"kind": "User", "name": "jane"}, {"kind": "ServiceAccount", "name": "ci", "namespace": "build"}]}`,
+			expected: []string{"binds cluster-admin to User jane, ServiceAccount build/ci"},
+		},
+		{
+			manifest: `{"roleRef": {"kind": "ClusterRole", "name": "view"}, "subjects": [{"kind": "User", "name": "jane"}]}`,
+			expected: []string{},
+		},
+	} {
+		grants, err := riskyGrants([]byte(test.manifest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(grants, test.expected) {
+			t.Errorf("grants of %s should be %q, got %q instead", test.manifest, test.expected, grants)
+		}
+	}
+
+	if _, err := riskyGrants([]byte("invalid")); err == nil {
+		t.Error("an invalid manifest should return an error")
+	}
+}
+
+func TestEscalationHandlerAlertsNewGrants(t *testing.T) {
+	h := NewEscalationHandler(config.Handler{})
+	readSecrets := `{"rules": [{"apiGroups": [""], "resources": ["secrets"], "verbs": ["get"]}]}`
+	readAll := `{"rules": [{"apiGroups": [""], "resources": ["secrets"], "verbs": ["get"]}, {"apiGroups": ["apps"], "resources": ["deployments"], "verbs": ["*"]}]}`
+
+	// Grants found on the initial sync are not changes
+	evt := newEvent("Add", "role", readSecrets, false)
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if len(evt.Alerts) != 0 {
+		t.Errorf("initially synced grants should not be alerted, got %v", evt.Alerts)
+	}
+
+	evt = newEvent("Update", "role", readAll, true)
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(evt.Alerts, []string{"grants wildcard verbs on deployments"}) {
+		t.Errorf("only the new grant should be alerted, got %v", evt.Alerts)
+	}
+
+	evt = newEvent("Update", "role", readAll, true)
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if len(evt.Alerts) != 0 {
+		t.Errorf("unchanged grants should not be alerted, got %v", evt.Alerts)
+	}
+
+	// A recreated object grants them again
+	if err := h.Run(context.TODO(), newEvent("Delete", "role", "", true)); err != nil {
+		t.Fatal(err)
+	}
+	evt = newEvent("Add", "role", readSecrets, true)
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(evt.Alerts, []string{"grants get on secrets"}) {
+		t.Errorf("the recreated grant should be alerted, got %v", evt.Alerts)
+	}
+}
+
+func TestEscalationHandlerOnlyAlerts(t *testing.T) {
+	h := NewEscalationHandler(config.Handler{OnlyAlerts: true})
+
+	evt := newEvent("Update", "deployment", `{"spec": {}}`, true)
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if !evt.RunNext || !evt.OnlyStateful {
+		t.Error("events without alerts should only run the stateful handlers")
+	}
+
+	evt = newEvent("Add", "ClusterRoleBinding", `{"roleRef": {"kind": "ClusterRole", "name": "cluster-admin"}}`, true)
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if !evt.RunNext || evt.OnlyStateful || len(evt.Alerts) != 1 {
+		t.Errorf("events with alerts should keep running, got %v", evt.Alerts)
+	}
+
+	evt = newEvent("Update", "role", "invalid", true)
+	if err := h.Run(context.TODO(), evt); err == nil || evt.RunNext {
+		t.Error("an invalid manifest should stop the event with an error")
+	}
+
+	evt = newEvent(handler.WatchErrorEvent, "role", "", true)
+	if err := h.Run(context.TODO(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if !evt.RunNext || evt.OnlyStateful {
+		t.Error("watch events should keep running")
+	}
+}
+
+func TestEscalationHandlerOnlyAlertsBeforeDiff(t *testing.T) {
+	notified := handler.NewMockHandler()
+	ch := handler.NewChainOfHandlers(
+		NewEscalationHandler(config.Handler{OnlyAlerts: true}),
+		diff.NewDiffHandler(config.Handler{}),
+		notified,
+	)
+	run := func(evt *handler.Event) {
+		notified.Called = false
+		if err := ch.Run(context.TODO(), evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	view := `{"kind": "Role", "rules": [{"apiGroups": ["apps"], "resources": ["deployments"], "verbs": ["get"]}]}`
+	readSecrets := `{"kind": "Role", "rules": [{"apiGroups": [""], "resources": ["secrets"], "verbs": ["get"]}]}`
+
+	// The initial sync isn't notified, but diff stores its manifests
+	run(newEvent("Add", "role", view, false))
+	if notified.Called {
+		t.Error("initially synced objects should not be notified")
+	}
+
+	run(newEvent("Update", "role", view+" ", true))
+	if notified.Called {
+		t.Error("events without alerts should not be notified")
+	}
+
+	evt := newEvent("Update", "role", readSecrets, true)
+	run(evt)
+	if !notified.Called || len(evt.Alerts) != 1 {
+		t.Fatalf("events with alerts should be notified, got %v", evt.Alerts)
+	}
+	if !strings.Contains(string(notified.PassedPayload), `"secrets"`) {
+		t.Errorf("the diff with the synced manifest should be notified, got %s", notified.PassedPayload)
+	}
+}
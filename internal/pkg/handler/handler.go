@@ -7,37 +7,116 @@ import (
 	"github.com/pkg/errors"
 	"github.com/snebel29/kooper/operator/common"
 	"github.com/snebel29/kwatchman/internal/pkg/config"
+	"github.com/snebel29/kwatchman/internal/pkg/metrics"
 	"github.com/snebel29/kwatchman/internal/pkg/registry"
+	"time"
 )
 
+// DefaultTimeout is the time every handler is given to run an event when not configured
+const DefaultTimeout = 30 * time.Second
+
 // Handler interface
 type Handler interface {
 	Run(context.Context, *Event) error
 }
 
+// StatefulHandler is implemented by handlers that keep state between events, such as the
+// diff handler storage, they run on standby replicas so that their state is warm on failover
+type StatefulHandler interface {
+	Handler
+	Stateful() bool
+}
+
+// Flusher is implemented by handlers buffering events, which are flushed on shutdown
+type Flusher interface {
+	Flush(context.Context) error
+}
+
+// Syncer is implemented by handlers keeping state across restarts, once the initial list of
+// a resource is synced they return the events missed meanwhile, such as objects deleted
+type Syncer interface {
+	Synced(context.Context, *Listing) ([]*Event, error)
+}
+
+// Listing holds the keys of the objects initially listed for a resource kind from a cluster
+type Listing struct {
+	Cluster      string
+	ResourceKind string
+	Keys         []string
+	Contains     func(key string) bool // Whether the key is within the listed scope, such as its namespaces
+}
+
+// Elector tells whether this kwatchman replica is the leader
+type Elector interface {
+	IsLeader() bool
+}
+
+// Payload formats set by handlers on Event.PayloadFormat, so that the next ones know how to
+// render it, an empty format means plain text
+const (
+	PayloadFormatUnified    = "unified"    // Unified diff of the changed fields with JSON values
+	PayloadFormatYAML       = "yaml"       // Unified diff of the changed fields with YAML values
+	PayloadFormatJSONPatch  = "jsonpatch"  // RFC 6902 JSON Patch
+	PayloadFormatMergePatch = "mergepatch" // RFC 7386 JSON Merge Patch
+)
+
+// Kinds of the synthetic events sent when a resource watch fails and recovers, they report the
+// watch rather than an object, with no manifest and the error as payload
+const (
+	WatchErrorEvent     = "WatchError"     // Changes of the resource are missed until it recovers
+	WatchRecoveredEvent = "WatchRecovered" // The resource is watched again after a WatchError
+)
+
+// IsWatchEvent return whether the event reports the state of a resource watch
+func IsWatchEvent(evt *Event) bool {
+	return evt.K8sEvt != nil &&
+		(evt.K8sEvt.Kind == WatchErrorEvent || evt.K8sEvt.Kind == WatchRecoveredEvent)
+}
+
 // Event holds the input data for any handler
 type Event struct {
-	K8sEvt       *common.K8sEvent
-	RunNext      bool
-	ResourceKind string
-	K8sManifest  []byte
-	Payload      []byte //This is a free field that can hold, anything such as text, images, etc
+	K8sEvt        *common.K8sEvent
+	RunNext       bool
+	Cluster       string // Name of the cluster where the event comes from, empty when not configured
+	ResourceKind  string
+	K8sManifest   []byte
+	Payload       []byte   //This is a free field that can hold, anything such as text, images, etc
+	PayloadFormat string   // Format of the payload, see PayloadFormat constants
+	Alerts        []string // Findings calling for a high priority notification, such as privilege escalations
+	OnlyStateful  bool     // Only the next stateful handlers run, such as when the event isn't to be notified
 }
 
 // ChainOfHandlers Interface
 type ChainOfHandlers interface {
 	Run(context.Context, *Event) error
+	Flush(context.Context) error
+	Synced(context.Context, *Listing) error
 }
 
 // chainOfHandlers holds a list of ResourcesHandlerFunc that can be executed sequencially
 type chainOfHandlers struct {
 	handlers []Handler
+	elector  Elector
 }
 
 // Run will execute each handler one after the other, the handler itself is responsible to decide
-// whether the next handler should be executed or not
+// whether the next handler should be executed or not, on standby replicas and for events marked as
+// OnlyStateful only stateful handlers run, the chain stops once the context is cancelled
 func (c *chainOfHandlers) Run(ctx context.Context, evt *Event) error {
-	for i, h := range c.handlers {
+	return c.runFrom(ctx, evt, 0)
+}
+
+// runFrom runs the handlers starting at the given position
+func (c *chainOfHandlers) runFrom(ctx context.Context, evt *Event, start int) error {
+	standby := c.isStandby()
+	for i := start; i < len(c.handlers); i++ {
+		h := c.handlers[i]
+		if (standby || evt.OnlyStateful) && !isStateful(h) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return errors.Wrapf(err, "chainOfHandlers run() stopped before the %d function", i)
+		}
 		err := h.Run(ctx, evt)
 		if err != nil {
 			return errors.Wrapf(err, "The %d function failed within chainOfHandlers run()", i)
@@ -49,6 +128,48 @@ func (c *chainOfHandlers) Run(ctx context.Context, evt *Event) error {
 	return nil
 }
 
+// Flush every handler buffering events, all of them are flushed even if any fails
+func (c *chainOfHandlers) Flush(ctx context.Context) error {
+	var flushErr error
+	for i, h := range c.handlers {
+		f, ok := h.(Flusher)
+		if !ok {
+			continue
+		}
+		if err := f.Flush(ctx); err != nil && flushErr == nil {
+			flushErr = errors.Wrapf(err, "The %d function failed within chainOfHandlers flush()", i)
+		}
+	}
+	return flushErr
+}
+
+// Synced hands the listing to every Syncer handler, the events they return are run by the handlers
+// following them, all of them are synced even if any fails
+func (c *chainOfHandlers) Synced(ctx context.Context, listing *Listing) error {
+	var syncErr error
+	standby := c.isStandby()
+	for i, h := range c.handlers {
+		s, ok := h.(Syncer)
+		if !ok || (standby && !isStateful(h)) {
+			continue
+		}
+		evts, err := s.Synced(ctx, listing)
+		if err != nil && syncErr == nil {
+			syncErr = errors.Wrapf(err, "The %d function failed within chainOfHandlers synced()", i)
+		}
+		for _, evt := range evts {
+			if err := c.runFrom(ctx, evt, i+1); err != nil && syncErr == nil {
+				syncErr = err
+			}
+		}
+	}
+	return syncErr
+}
+
+func (c *chainOfHandlers) isStandby() bool {
+	return c.elector != nil && !c.elector.IsLeader()
+}
+
 // NewChainOfHandlers return a ChainOfHandlers
 func NewChainOfHandlers(handlers ...Handler) ChainOfHandlers {
 	return &chainOfHandlers{
@@ -56,6 +177,68 @@ func NewChainOfHandlers(handlers ...Handler) ChainOfHandlers {
 	}
 }
 
+// NewLeaderChainOfHandlers return a ChainOfHandlers that runs every handler only while
+// the elector is leading, and only the stateful ones otherwise, so that a change the leader
+// didn't notify before losing the lead is already stored, and not notified, by the standby
+func NewLeaderChainOfHandlers(elector Elector, handlers ...Handler) ChainOfHandlers {
+	return &chainOfHandlers{
+		handlers: handlers,
+		elector:  elector,
+	}
+}
+
+func isStateful(h Handler) bool {
+	s, ok := h.(StatefulHandler)
+	return ok && s.Stateful()
+}
+
+// instrumentedHandler records the latency and errors of the handler it wraps,
+// which is given up to timeout to run every event
+type instrumentedHandler struct {
+	name    string
+	timeout time.Duration
+	handler Handler
+}
+
+func newInstrumentedHandler(name string, timeout time.Duration, h Handler) Handler {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &instrumentedHandler{name: name, timeout: timeout, handler: h}
+}
+
+// Run the wrapped handler recording its metrics, its context is cancelled once the timeout expires
+func (h *instrumentedHandler) Run(ctx context.Context, evt *Event) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := h.handler.Run(ctx, evt)
+	metrics.ObserveHandler(h.name, start, err)
+	return err
+}
+
+// Stateful return whether the wrapped handler is stateful
+func (h *instrumentedHandler) Stateful() bool {
+	return isStateful(h.handler)
+}
+
+// Flush the wrapped handler when it buffers events
+func (h *instrumentedHandler) Flush(ctx context.Context) error {
+	if f, ok := h.handler.(Flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// Synced the wrapped handler when it keeps state across restarts
+func (h *instrumentedHandler) Synced(ctx context.Context, listing *Listing) ([]*Event, error) {
+	if s, ok := h.handler.(Syncer); ok {
+		return s.Synced(ctx, listing)
+	}
+	return nil, nil
+}
+
 // GetHandlerListFromConfig return list of handler objects from configuration
 // their position in the list matches the defined user execution sequence
 func GetHandlerListFromConfig(c *config.Config) ([]Handler, error) {
@@ -72,7 +255,8 @@ func GetHandlerListFromConfig(c *config.Config) ([]Handler, error) {
 				return nil, errors.Errorf(
 					"handler %s is not of type func() Handler but %T instead", configHandler.Name, rh)
 			}
-			handlerList = append(handlerList, regHandler(configHandler))
+			handlerList = append(handlerList, newInstrumentedHandler(
+				configHandler.Name, configHandler.Timeout, regHandler(configHandler)))
 		}
 	}
 	return handlerList, nil
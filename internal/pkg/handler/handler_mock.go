@@ -9,6 +9,7 @@ import (
 // MockHandler call registry
 type MockHandler struct {
 	Called             bool
+	PassedCluster      string
 	PassedPayload      []byte
 	PassedK8sManifest  []byte
 	PassedResourceKind string
@@ -19,6 +20,7 @@ type MockHandler struct {
 // Run the mock
 func (h *MockHandler) Run(ctx context.Context, evt *Event) error {
 	h.Called = true
+	h.PassedCluster = evt.Cluster
 	h.PassedPayload = evt.Payload
 	h.PassedResourceKind = evt.ResourceKind
 	h.PassedK8sManifest = evt.K8sManifest
@@ -54,3 +56,65 @@ func NewMockHandler() *MockHandler {
 func NewMockHandlerError() *MockHandlerError {
 	return &MockHandlerError{Called: false}
 }
+
+// MockStatefulHandler is a MockHandler which keeps state
+type MockStatefulHandler struct {
+	MockHandler
+}
+
+// Stateful return true
+func (h *MockStatefulHandler) Stateful() bool {
+	return true
+}
+
+// NewMockStatefulHandler return a stateful mock
+func NewMockStatefulHandler() *MockStatefulHandler {
+	return &MockStatefulHandler{}
+}
+
+// MockFlusherHandler is a MockHandler which buffers events
+type MockFlusherHandler struct {
+	MockHandler
+	Flushed  bool
+	FlushErr error
+}
+
+// Flush the mock
+func (h *MockFlusherHandler) Flush(ctx context.Context) error {
+	h.Flushed = true
+	return h.FlushErr
+}
+
+// NewMockFlusherHandler return a flusher mock
+func NewMockFlusherHandler() *MockFlusherHandler {
+	return &MockFlusherHandler{}
+}
+
+// MockSyncerHandler is a MockHandler which returns the given events once synced
+type MockSyncerHandler struct {
+	MockHandler
+	PassedListing *Listing
+	SyncedEvents  []*Event
+	SyncedErr     error
+}
+
+// Synced the mock
+func (h *MockSyncerHandler) Synced(ctx context.Context, listing *Listing) ([]*Event, error) {
+	h.PassedListing = listing
+	return h.SyncedEvents, h.SyncedErr
+}
+
+// NewMockSyncerHandler return a syncer mock
+func NewMockSyncerHandler(evts ...*Event) *MockSyncerHandler {
+	return &MockSyncerHandler{SyncedEvents: evts}
+}
+
+// MockElector is an Elector with fixed leadership
+type MockElector struct {
+	Leader bool
+}
+
+// IsLeader return the mock leadership
+func (e *MockElector) IsLeader() bool {
+	return e.Leader
+}
@@ -6,11 +6,13 @@ import (
 	"github.com/snebel29/kooper/operator/common"
 	"github.com/snebel29/kwatchman/internal/pkg/config"
 	"github.com/snebel29/kwatchman/internal/pkg/handler"
+	"github.com/snebel29/kwatchman/internal/pkg/registry"
 	"os"
 	"path"
 	"reflect"
 	"runtime"
 	"testing"
+	"time"
 
 	// For the handlers to be registered
 	_ "github.com/snebel29/kwatchman/internal/pkg/handler/diff"
@@ -111,6 +113,162 @@ func TestGetHandlerListFromConfig(t *testing.T) {
 		t.Error("The handler list should have been returned without errors")
 	}
 	if len(handlerList) != 3 {
-		t.Errorf("handlerList should have 3 handlers, have %d instead", len(handlerList))
+		t.Fatalf("handlerList should have 3 handlers, have %d instead", len(handlerList))
+	}
+	if h, ok := handlerList[0].(handler.StatefulHandler); !ok || !h.Stateful() {
+		t.Error("instrumented diff handler should still be stateful")
+	}
+	if h, ok := handlerList[1].(handler.StatefulHandler); ok && h.Stateful() {
+		t.Error("instrumented log handler should not be stateful")
+	}
+}
+
+func TestLeaderChainOfHandlers_Run(t *testing.T) {
+	elector := &handler.MockElector{Leader: false}
+	h1 := handler.NewMockStatefulHandler()
+	h2 := handler.NewMockHandler()
+	ch := handler.NewLeaderChainOfHandlers(elector, h1, h2)
+
+	if err := ch.Run(context.TODO(), &handler.Event{K8sEvt: &common.K8sEvent{}}); err != nil {
+		t.Error(err)
+	}
+	if !h1.Called {
+		t.Error("stateful handlers should run on standby")
+	}
+	if h2.Called {
+		t.Error("stateless handlers should not run on standby")
+	}
+
+	elector.Leader = true
+	if err := ch.Run(context.TODO(), &handler.Event{K8sEvt: &common.K8sEvent{}}); err != nil {
+		t.Error(err)
+	}
+	if !h2.Called {
+		t.Error("every handler should run on the leader")
+	}
+}
+
+func TestChainOfHandlers_RunOnlyStateful(t *testing.T) {
+	h1 := handler.NewMockHandler()
+	h2 := handler.NewMockStatefulHandler()
+	h3 := handler.NewMockHandler()
+	ch := handler.NewChainOfHandlers(h1, h2, h3)
+
+	evt := &handler.Event{K8sEvt: &common.K8sEvent{}, RunNext: true, OnlyStateful: true}
+	if err := ch.Run(context.TODO(), evt); err != nil {
+		t.Error(err)
+	}
+	if h1.Called || h3.Called {
+		t.Error("stateless handlers should not run events marked as only stateful")
+	}
+	if !h2.Called {
+		t.Error("stateful handlers should run events marked as only stateful")
+	}
+}
+
+func TestChainOfHandlers_Flush(t *testing.T) {
+	h1 := handler.NewMockFlusherHandler()
+	h1.FlushErr = fmt.Errorf("dummy error")
+	h2 := handler.NewMockHandler()
+	h3 := handler.NewMockFlusherHandler()
+	ch := handler.NewChainOfHandlers(h1, h2, h3)
+
+	if err := ch.Flush(context.TODO()); err == nil {
+		t.Error("h1 flush error should have been returned")
+	}
+	if !h1.Flushed || !h3.Flushed {
+		t.Errorf("every flusher should have been flushed h1: %t h3: %t", h1.Flushed, h3.Flushed)
+	}
+}
+
+func TestChainOfHandlers_RunCancelled(t *testing.T) {
+	h1 := handler.NewMockHandler()
+	ch := handler.NewChainOfHandlers(h1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := ch.Run(ctx, &handler.Event{K8sEvt: &common.K8sEvent{}}); err == nil {
+		t.Error("a cancelled context should stop the chain")
+	}
+	if h1.Called {
+		t.Error("handlers should not run once the context is cancelled")
+	}
+}
+
+func TestGetHandlerListFromConfigTimeout(t *testing.T) {
+	mock := handler.NewMockHandler()
+	registry.Register(registry.HANDLER, "mock", func(config.Handler) handler.Handler {
+		return mock
+	})
+
+	for _, test := range []struct {
+		timeout  time.Duration
+		expected time.Duration
+	}{
+		{timeout: time.Second, expected: time.Second},
+		{timeout: 0, expected: handler.DefaultTimeout},
+	} {
+		handlerList, err := handler.GetHandlerListFromConfig(&config.Config{
+			Handlers: config.Handlers{{Name: "mock", Timeout: test.timeout}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := handlerList[0].Run(context.Background(), &handler.Event{K8sEvt: &common.K8sEvent{}}); err != nil {
+			t.Error(err)
+		}
+		deadline, ok := mock.PassedContext.Deadline()
+		if !ok {
+			t.Fatal("the handler context should have a deadline")
+		}
+		if remaining := time.Until(deadline); remaining > test.expected || remaining < test.expected-time.Second {
+			t.Errorf("the handler deadline should be within %s, got %s instead", test.expected, remaining)
+		}
+		if mock.PassedContext.Err() == nil {
+			t.Error("the handler context should be cancelled once it returns")
+		}
+	}
+}
+
+func TestChainOfHandlers_Synced(t *testing.T) {
+	h1 := handler.NewMockHandler()
+	deleted := &handler.Event{K8sEvt: &common.K8sEvent{Kind: "Delete", Key: "default/gone"}, RunNext: true}
+	h2 := handler.NewMockSyncerHandler(deleted)
+	h3 := handler.NewMockHandler()
+	ch := handler.NewChainOfHandlers(h1, h2, h3)
+
+	listing := &handler.Listing{ResourceKind: "deployment", Keys: []string{"default/web"}}
+	if err := ch.Synced(context.TODO(), listing); err != nil {
+		t.Error(err)
+	}
+	if h2.PassedListing != listing {
+		t.Error("the listing should have been passed to the syncer")
+	}
+	if h1.Called {
+		t.Error("handlers before the syncer should not run its events")
+	}
+	if !h3.Called || h3.PassedEvent != deleted.K8sEvt {
+		t.Error("handlers after the syncer should run its events")
+	}
+
+	h2.SyncedErr = fmt.Errorf("dummy error")
+	if err := ch.Synced(context.TODO(), listing); err == nil {
+		t.Error("the syncer error should have been returned")
+	}
+}
+
+func TestIsWatchEvent(t *testing.T) {
+	for kind, expected := range map[string]bool{
+		handler.WatchErrorEvent:     true,
+		handler.WatchRecoveredEvent: true,
+		"Update":                    false,
+	} {
+		if handler.IsWatchEvent(&handler.Event{K8sEvt: &common.K8sEvent{Kind: kind}}) != expected {
+			t.Errorf("IsWatchEvent should be %t for %s", expected, kind)
+		}
+	}
+	if handler.IsWatchEvent(&handler.Event{}) {
+		t.Error("events without k8s event aren't watch events")
 	}
 }
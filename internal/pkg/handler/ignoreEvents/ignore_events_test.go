@@ -1,6 +1,7 @@
 package ignoreEvents
 
 import (
+	"context"
 	"github.com/snebel29/kooper/operator/common"
 	"github.com/snebel29/kwatchman/internal/pkg/config"
 	"github.com/snebel29/kwatchman/internal/pkg/handler"
@@ -27,7 +28,7 @@ func TestIgnoreEventsHandler_Run(t *testing.T) {
 		Payload:      payload,
 	}
 
-	err := h.Run(nil, evt)
+	err := h.Run(context.Background(), evt)
 
 	if err != nil {
 		t.Error(err)
@@ -56,7 +57,7 @@ func TestIgnoreEventsHandler_Run(t *testing.T) {
 		Payload:      payload,
 	}
 
-	err = h.Run(nil, evt)
+	err = h.Run(context.Background(), evt)
 	if err != nil {
 		t.Error(err)
 	}
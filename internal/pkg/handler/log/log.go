@@ -33,8 +33,22 @@ func (h *logHandler) Run(ctx context.Context, evt *handler.Event) error {
 		manifestToPrint = _json
 	}
 
-	log.Infof("%#v\n%s", evt.K8sEvt, string(evt.Payload))
-	log.Debugf("%s", string(manifestToPrint))
+	logger := log.NewEntry(log.StandardLogger())
+	if evt.Cluster != "" {
+		logger = logger.WithField("cluster", evt.Cluster)
+	}
+	if evt.PayloadFormat != "" {
+		logger = logger.WithField("payloadFormat", evt.PayloadFormat)
+	}
+
+	if len(evt.Alerts) > 0 {
+		logger.WithField("alerts", evt.Alerts).Warnf("%#v\n%s", evt.K8sEvt, string(evt.Payload))
+	} else if evt.K8sEvt.Kind == handler.WatchErrorEvent {
+		logger.Warnf("%#v\n%s", evt.K8sEvt, string(evt.Payload))
+	} else {
+		logger.Infof("%#v\n%s", evt.K8sEvt, string(evt.Payload))
+	}
+	logger.Debugf("%s", string(manifestToPrint))
 
 	return nil
 }
@@ -1,6 +1,8 @@
 package log
 
 import (
+	"context"
+	log "github.com/sirupsen/logrus"
 	log_test "github.com/sirupsen/logrus/hooks/test"
 	"github.com/snebel29/kooper/operator/common"
 	"github.com/snebel29/kwatchman/internal/pkg/config"
@@ -19,18 +21,22 @@ func TestLogHandlerFunc(t *testing.T) {
 	resourceKind := "Deployment"
 
 	evt := &handler.Event{
-		K8sEvt:       &common.K8sEvent{},
-		RunNext:      true,
-		ResourceKind: resourceKind,
-		K8sManifest:  manifest,
-		Payload:      payload,
+		K8sEvt:        &common.K8sEvent{},
+		RunNext:       true,
+		ResourceKind:  resourceKind,
+		K8sManifest:   manifest,
+		Payload:       payload,
+		PayloadFormat: handler.PayloadFormatJSONPatch,
 	}
 
-	err := h.Run(nil, evt)
+	err := h.Run(context.Background(), evt)
 	m := hook.Entries
 
 	if len(m) != 1 {
-		t.Errorf("There should be one entry, there is %d instead", len(m))
+		t.Fatalf("There should be one entry, there is %d instead", len(m))
+	}
+	if m[0].Data["payloadFormat"] != handler.PayloadFormatJSONPatch {
+		t.Errorf("payloadFormat field should be logged, got %v instead", m[0].Data)
 	}
 	if err != nil {
 		t.Error(err)
@@ -47,3 +53,23 @@ func TestLogHandlerFunc(t *testing.T) {
 		t.Errorf("K8sManifest %s should match %s", string(evt.K8sManifest), string(manifest))
 	}
 }
+
+func TestLogHandlerAlerts(t *testing.T) {
+	hook := log_test.NewGlobal()
+	h := NewLogHandler(config.Handler{})
+
+	evt := &handler.Event{
+		K8sEvt:      &common.K8sEvent{},
+		RunNext:     true,
+		K8sManifest: []byte{},
+		Alerts:      []string{"binds cluster-admin to User jane"},
+	}
+	if err := h.Run(context.Background(), evt); err != nil {
+		t.Error(err)
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil || entry.Level != log.WarnLevel || !reflect.DeepEqual(entry.Data["alerts"], evt.Alerts) {
+		t.Errorf("alerts should be logged as a warning, got %#v instead", entry)
+	}
+}
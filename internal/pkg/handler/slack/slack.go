@@ -1,6 +1,7 @@
 package slack
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -8,7 +9,11 @@ import (
 	"github.com/pkg/errors"
 	"github.com/snebel29/kwatchman/internal/pkg/config"
 	"github.com/snebel29/kwatchman/internal/pkg/handler"
+	"github.com/snebel29/kwatchman/internal/pkg/metrics"
 	"github.com/snebel29/kwatchman/internal/pkg/registry"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
@@ -44,6 +49,9 @@ func NewSlackHandler(c config.Handler) handler.Handler {
 			"Add":    "#1ADA00",
 			"Update": "#F39C12",
 			"Delete": "#FF0000",
+
+			handler.WatchErrorEvent:     "#8B0000",
+			handler.WatchRecoveredEvent: "#1ADA00",
 		},
 	}
 }
@@ -57,6 +65,54 @@ func buildTextField(payload []byte) string {
 	return fmt.Sprintf("```%s```", truncateString(string(payload), 3994))
 }
 
+// alertColour highlights the events with alerts, regardless of their kind
+const alertColour = "#8B0000"
+
+func buildAlertsField(alerts []string) string {
+	lines := make([]string, 0, len(alerts))
+	for _, alert := range alerts {
+		lines = append(lines, fmt.Sprintf(":rotating_light: *%s*", alert))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// clusterName return the cluster the event comes from, falling back to
+// the handler configured clusterName when clusters are not configured
+func (h *slackHandler) clusterName(evt *handler.Event) string {
+	if evt.Cluster != "" {
+		return evt.Cluster
+	}
+	return h.config.ClusterName
+}
+
+// postWebhook posts the message as slack.PostWebhook does, but bound to the context
+// so that the request is cancelled along with it
+func postWebhook(ctx context.Context, url string, msg *slack.WebhookMessage) error {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "marshal failed")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(raw))
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to post webhook")
+	}
+	defer resp.Body.Close()
+	// Drain the body so that the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("slack server error: %s", resp.Status)
+	}
+	return nil
+}
+
 func (h *slackHandler) Run(ctx context.Context, evt *handler.Event) error {
 	title := fmt.Sprintf("%s %s\n%s", strings.ToUpper(evt.K8sEvt.Kind), evt.ResourceKind, evt.K8sEvt.Key)
 	// https://api.slack.com/docs/message-attachments
@@ -67,17 +123,23 @@ func (h *slackHandler) Run(ctx context.Context, evt *handler.Event) error {
 		AuthorName: "snebel29/kwatchman",
 		AuthorLink: "https://github.com/snebel29/kwatchman",
 		Text:       buildTextField(evt.Payload),
-		Footer:     h.config.ClusterName,
+		Footer:     h.clusterName(evt),
 		Ts:         json.Number(strconv.FormatInt(time.Now().Unix(), 10)),
 	}
+	// Alerts call for attention before anything else
+	if len(evt.Alerts) > 0 {
+		attachment.Color = alertColour
+		attachment.Pretext = buildAlertsField(evt.Alerts)
+	}
 	msg := &slack.WebhookMessage{
 		Attachments: []slack.Attachment{attachment},
 	}
 
-	err := slack.PostWebhook(h.config.WebhookURL, msg)
+	err := postWebhook(ctx, h.config.WebhookURL, msg)
 	if err != nil {
 		evt.RunNext = false
-		return errors.Wrap(err, "PostWebhook: ")
+		metrics.IncSlackPostFailure()
+		return errors.Wrap(err, "postWebhook: ")
 	}
 	return nil
 }
@@ -1,6 +1,9 @@
 package slack
 
 import (
+	"context"
+	"encoding/json"
+	"github.com/nlopes/slack"
 	"github.com/snebel29/kooper/operator/common"
 	"github.com/snebel29/kwatchman/internal/pkg/config"
 	"github.com/snebel29/kwatchman/internal/pkg/handler"
@@ -70,7 +73,7 @@ func TestSucessfullMsgToSlack(t *testing.T) {
 		Payload:      payload,
 	}
 
-	err := h.Run(nil, evt)
+	err := h.Run(context.Background(), evt)
 	if err != nil {
 		t.Error(err)
 	}
@@ -113,7 +116,7 @@ func TestFailedMsgToSlack(t *testing.T) {
 		Payload:      payload,
 	}
 
-	err := h.Run(nil, evt)
+	err := h.Run(context.Background(), evt)
 	if err == nil {
 		t.Error(err)
 	}
@@ -136,3 +139,72 @@ func TestSlackHandler_buildTextField(t *testing.T) {
 		t.Errorf("text length should match got %d and %d instead", len(text), expected)
 	}
 }
+
+func TestSlackHandler_clusterName(t *testing.T) {
+	h := NewSlackHandler(config.Handler{ClusterName: "myClusterName"}).(*slackHandler)
+
+	if name := h.clusterName(&handler.Event{}); name != "myClusterName" {
+		t.Errorf("configured clusterName should be used, got %s instead", name)
+	}
+	if name := h.clusterName(&handler.Event{Cluster: "production"}); name != "production" {
+		t.Errorf("event cluster should take precedence, got %s instead", name)
+	}
+}
+
+func TestCancelledMsgToSlack(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	h := NewSlackHandler(config.Handler{WebhookURL: testServer.URL})
+	evt := &handler.Event{
+		K8sEvt:  &common.K8sEvent{Kind: "Update"},
+		RunNext: true,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := h.Run(ctx, evt); err == nil {
+		t.Error("a cancelled context should fail the post")
+	}
+	if evt.RunNext != false {
+		t.Error("RunNext should be false")
+	}
+}
+
+func TestAlertsMsgToSlack(t *testing.T) {
+	var msg slack.WebhookMessage
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	h := NewSlackHandler(config.Handler{WebhookURL: testServer.URL})
+	evt := &handler.Event{
+		K8sEvt:       &common.K8sEvent{Kind: "Update"},
+		RunNext:      true,
+		ResourceKind: "clusterrolebinding",
+		Payload:      []byte("payload"),
+		Alerts:       []string{"binds cluster-admin to User jane", "grants get on secrets"},
+	}
+	if err := h.Run(context.Background(), evt); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msg.Attachments) != 1 {
+		t.Fatalf("one attachment should have been posted, got %#v", msg)
+	}
+	attachment := msg.Attachments[0]
+	if attachment.Color != alertColour {
+		t.Errorf("alerts should be highlighted, got colour %s", attachment.Color)
+	}
+	expected := ":rotating_light: *binds cluster-admin to User jane*\n:rotating_light: *grants get on secrets*"
+	if attachment.Pretext != expected {
+		t.Errorf("alerts should be posted as %q, got %q instead", expected, attachment.Pretext)
+	}
+}
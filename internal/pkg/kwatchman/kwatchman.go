@@ -1,27 +1,55 @@
 package kwatchman
 
 import (
+	"context"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/snebel29/kwatchman/internal/pkg/watcher"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 var shutdown chan os.Signal
 
-// Start runs the watcher while listening for termination signals
-// to do a graceful shutdown
-func Start(w watcher.Watcher) error {
+// Start runs the watcher while listening for termination signals to do a graceful
+// shutdown, which cancels the root context and gives the watcher the grace period
+// to finish handling its events, an error is returned when it fails or is exceeded
+func Start(w watcher.Watcher, gracePeriod time.Duration) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	shutdown = make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(shutdown)
+
+	go func() {
+		select {
+		case sig := <-shutdown:
+			log.Infof("Shutdown upon signal %s", sig.String())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
+	errC := make(chan error, 1)
 	go func() {
-		sig := <-shutdown
-		log.Infof("Shutdown upon signal %s", sig.String())
-		w.Shutdown()
-		os.Exit(0)
+		errC <- w.Run()
 	}()
 
-	return w.Run()
+	select {
+	case err := <-errC:
+		return err
+	case <-ctx.Done():
+	}
+
+	w.Shutdown()
+
+	select {
+	case err := <-errC:
+		return err
+	case <-time.After(gracePeriod):
+		return errors.Errorf("watcher didn't stop within the grace period of %s", gracePeriod)
+	}
 }
@@ -1,8 +1,7 @@
 package kwatchman
 
 import (
-	"github.com/bouk/monkey"
-	"os"
+	"errors"
 	"sync"
 	"syscall"
 	"testing"
@@ -13,7 +12,14 @@ type WatcherMock struct {
 	sync.Mutex
 	RunCalled      bool
 	ShutdownCalled bool
-	ExitCalled     bool
+	RunErr         error
+	StopDelay      time.Duration
+	stopC          chan struct{}
+	stopOnce       sync.Once
+}
+
+func NewWatcherMock() *WatcherMock {
+	return &WatcherMock{stopC: make(chan struct{})}
 }
 
 func (w *WatcherMock) SetRunCalled(flag bool) {
@@ -22,8 +28,20 @@ func (w *WatcherMock) SetRunCalled(flag bool) {
 	w.RunCalled = flag
 }
 
+func (w *WatcherMock) GetRunCalled() bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.RunCalled
+}
+
+// Run blocks until Shutdown, then takes StopDelay to finish handling its events
 func (w *WatcherMock) Run() error {
 	w.SetRunCalled(true)
+	if w.RunErr != nil {
+		return w.RunErr
+	}
+	<-w.stopC
+	time.Sleep(w.StopDelay)
 	return nil
 }
 
@@ -33,49 +51,61 @@ func (w *WatcherMock) GetShutdownCalled() bool {
 	return w.ShutdownCalled
 }
 
-func (w *WatcherMock) SetShutdownCalled(flag bool) {
-	w.Lock()
-	defer w.Unlock()
-	w.ShutdownCalled = flag
-}
-
 func (w *WatcherMock) Shutdown() {
 	w.Lock()
 	defer w.Unlock()
 	w.ShutdownCalled = true
+	w.stopOnce.Do(func() {
+		close(w.stopC)
+	})
 }
 
-func (w *WatcherMock) SetExitCalled(flag bool) {
-	w.Lock()
-	defer w.Unlock()
-	w.ExitCalled = flag
+// sendSignal waits for the watcher to run and sends the signal to Start
+func sendSignal(t *testing.T, w *WatcherMock, sig syscall.Signal) {
+	for i := 0; !w.GetRunCalled(); i++ {
+		if i > 100 {
+			t.Error("watcher.Run() wasn't called")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	shutdown <- sig
 }
 
 func TestStart(t *testing.T) {
-	watcherMock := new(WatcherMock)
-	fakeExit := func(int) {
-		watcherMock.SetExitCalled(true)
-	}
-	patch := monkey.Patch(os.Exit, fakeExit)
-	defer patch.Unpatch()
+	watcherMock := NewWatcherMock()
+	go sendSignal(t, watcherMock, syscall.SIGTERM)
 
-	// Run the Start function
-	if err := Start(watcherMock); err != nil {
+	if err := Start(watcherMock, time.Second); err != nil {
 		t.Error(err)
 	}
 
-	if !watcherMock.RunCalled {
+	if !watcherMock.GetRunCalled() {
 		t.Error("watcher.Run() wasn't called")
 	}
-
-	shutdown <- syscall.SIGTERM
-	time.Sleep(time.Millisecond * 500)
-
 	if !watcherMock.GetShutdownCalled() {
 		t.Error("watcher.Shutdown() wasn't called")
 	}
+}
+
+func TestStartExceedingGracePeriod(t *testing.T) {
+	watcherMock := NewWatcherMock()
+	watcherMock.StopDelay = time.Second
+	go sendSignal(t, watcherMock, syscall.SIGINT)
+
+	if err := Start(watcherMock, 10*time.Millisecond); err == nil {
+		t.Error("An error should have been returned when exceeding the grace period")
+	}
+}
+
+func TestStartWithWatcherError(t *testing.T) {
+	watcherMock := NewWatcherMock()
+	watcherMock.RunErr = errors.New("simulated error")
 
-	if !watcherMock.ExitCalled {
-		t.Error("os.Exit() wasn't called during watcher.shutdown()")
+	if err := Start(watcherMock, time.Second); err == nil {
+		t.Error("watcher.Run() error should have been returned")
+	}
+	if watcherMock.GetShutdownCalled() {
+		t.Error("watcher.Shutdown() shouldn't be called when Run() fails")
 	}
 }
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	kooper_metrics "github.com/snebel29/kooper/monitoring/metrics"
+)
+
+const namespace = "kwatchman"
+
+var (
+	// Controller records kooper controllers queue and processing metrics
+	Controller kooper_metrics.Recorder = kooper_metrics.NewPrometheus(prometheus.DefaultRegisterer)
+
+	eventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_received_total",
+		Help:      "Number of k8s events received by resource kind and event type",
+	}, []string{"cluster", "resource_kind", "event_type"})
+
+	eventsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_suppressed_total",
+		Help:      "Number of k8s events suppressed by a handler, such as diff when nothing changed",
+	}, []string{"handler", "resource_kind"})
+
+	handlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time taken by every handler to run",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler"})
+
+	handlerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handler_errors_total",
+		Help:      "Number of errors returned by every handler",
+	}, []string{"handler"})
+
+	slackPostFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slack_post_failures_total",
+		Help:      "Number of messages that failed to be posted to slack",
+	})
+
+	diffStorageObjects = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "diff_storage_objects",
+		Help:      "Number of manifests kept in memory by the diff handlers",
+	})
+
+	diffStorageBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "diff_storage_bytes",
+		Help:      "Compressed size of the manifests kept in memory by the diff handlers",
+	})
+
+	diffStorageEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "diff_storage_evictions_total",
+		Help:      "Number of manifests evicted from memory by the diff handlers to stay within their limit",
+	})
+
+	diffNotCompared = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "diff_not_compared_total",
+		Help:      "Number of updates reported by the diff handlers without their changes since the previous manifest was not stored",
+	}, []string{"resource_kind"})
+)
+
+func init() {
+	prometheus.MustRegister(eventsReceived, eventsSuppressed, handlerDuration, handlerErrors, slackPostFailures,
+		diffStorageObjects, diffStorageBytes, diffStorageEvictions, diffNotCompared)
+}
+
+// IncEventReceived increments the events received from the cluster for the resource kind
+func IncEventReceived(cluster, resourceKind, eventType string) {
+	eventsReceived.WithLabelValues(cluster, resourceKind, eventType).Inc()
+}
+
+// IncEventSuppressed increments the events the handler stopped from reaching the next handlers
+func IncEventSuppressed(handler, resourceKind string) {
+	eventsSuppressed.WithLabelValues(handler, resourceKind).Inc()
+}
+
+// ObserveHandler records the duration of a handler run, and its error if any
+func ObserveHandler(handler string, start time.Time, err error) {
+	handlerDuration.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+	if err != nil {
+		handlerErrors.WithLabelValues(handler).Inc()
+	}
+}
+
+// IncSlackPostFailure increments the messages that failed to be posted to slack
+func IncSlackPostFailure() {
+	slackPostFailures.Inc()
+}
+
+// AddDiffStorage adds to the size and number of manifests kept in memory by the diff handlers,
+// which are negative when they are removed
+func AddDiffStorage(bytes int64, objects int) {
+	diffStorageBytes.Add(float64(bytes))
+	diffStorageObjects.Add(float64(objects))
+}
+
+// IncDiffStorageEviction increments the manifests evicted from memory by the diff handlers
+func IncDiffStorageEviction() {
+	diffStorageEvictions.Inc()
+}
+
+// IncDiffNotCompared increments the updates reported by the diff handlers without their changes
+func IncDiffNotCompared(resourceKind string) {
+	diffNotCompared.WithLabelValues(resourceKind).Inc()
+}
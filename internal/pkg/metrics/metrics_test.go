@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestIncEventReceived(t *testing.T) {
+	IncEventReceived("production", "deployment", "Add")
+	IncEventReceived("production", "deployment", "Add")
+	if v := testutil.ToFloat64(eventsReceived.WithLabelValues("production", "deployment", "Add")); v != 2 {
+		t.Errorf("2 events should have been received, got %v instead", v)
+	}
+}
+
+func TestIncEventSuppressed(t *testing.T) {
+	IncEventSuppressed("diff", "service")
+	if v := testutil.ToFloat64(eventsSuppressed.WithLabelValues("diff", "service")); v != 1 {
+		t.Errorf("1 event should have been suppressed, got %v instead", v)
+	}
+}
+
+func TestObserveHandler(t *testing.T) {
+	ObserveHandler("log", time.Now(), nil)
+	if v := testutil.ToFloat64(handlerErrors.WithLabelValues("log")); v != 0 {
+		t.Errorf("no error should have been recorded, got %v instead", v)
+	}
+	ObserveHandler("log", time.Now(), errors.New("failed"))
+	if v := testutil.ToFloat64(handlerErrors.WithLabelValues("log")); v != 1 {
+		t.Errorf("1 error should have been recorded, got %v instead", v)
+	}
+}
+
+func TestIncSlackPostFailure(t *testing.T) {
+	IncSlackPostFailure()
+	if v := testutil.ToFloat64(slackPostFailures); v != 1 {
+		t.Errorf("1 slack post failure should have been recorded, got %v instead", v)
+	}
+}
+
+func TestDiffStorage(t *testing.T) {
+	AddDiffStorage(100, 2)
+	AddDiffStorage(-40, -1)
+	if v := testutil.ToFloat64(diffStorageBytes); v != 60 {
+		t.Errorf("60 bytes should be stored, got %v instead", v)
+	}
+	if v := testutil.ToFloat64(diffStorageObjects); v != 1 {
+		t.Errorf("1 object should be stored, got %v instead", v)
+	}
+	IncDiffStorageEviction()
+	if v := testutil.ToFloat64(diffStorageEvictions); v != 1 {
+		t.Errorf("1 eviction should have been recorded, got %v instead", v)
+	}
+	IncDiffNotCompared("deployment")
+	if v := testutil.ToFloat64(diffNotCompared.WithLabelValues("deployment")); v != 1 {
+		t.Errorf("1 update not compared should have been recorded, got %v instead", v)
+	}
+}
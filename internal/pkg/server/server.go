@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+// Server exposes kwatchman own endpoints over HTTP, prometheus /metrics along with
+// /healthz and /readyz for k8s liveness and readiness probes
+type Server struct {
+	server *http.Server
+}
+
+// NewServer return a Server listening on address, reporting the health of the watcher
+func NewServer(address string, health watcher.HealthChecker) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", probeHandler(health.Live))
+	mux.HandleFunc("/readyz", probeHandler(health.Ready))
+
+	return &Server{
+		server: &http.Server{Addr: address, Handler: mux},
+	}
+}
+
+// probeHandler responds 200 when the check succeeds and 503 with the failure otherwise
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// Run serves the endpoints until Shutdown
+func (s *Server) Run() error {
+	log.Infof("Serving HTTP endpoints on %s", s.server.Addr)
+	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, "Server Run()")
+	}
+	return nil
+}
+
+// Shutdown the server waiting for the in flight requests
+func (s *Server) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Errorf("Server Shutdown(): %s", err)
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type healthCheckerMock struct {
+	ready error
+	live  error
+}
+
+func (h *healthCheckerMock) Ready() error {
+	return h.ready
+}
+
+func (h *healthCheckerMock) Live() error {
+	return h.live
+}
+
+func get(s *Server, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder
+}
+
+func TestProbeEndpoints(t *testing.T) {
+	health := &healthCheckerMock{ready: errors.New("deployment: initial sync not completed")}
+	s := NewServer(":0", health)
+
+	if code := get(s, "/readyz").Code; code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz should fail until synced, got %d instead", code)
+	}
+	if code := get(s, "/healthz").Code; code != http.StatusOK {
+		t.Errorf("/healthz should succeed, got %d instead", code)
+	}
+
+	health.ready = nil
+	health.live = errors.New("deployment: watch disconnected for 10m0s")
+	if code := get(s, "/readyz").Code; code != http.StatusOK {
+		t.Errorf("/readyz should succeed once synced, got %d instead", code)
+	}
+	recorder := get(s, "/healthz")
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz should fail when disconnected, got %d instead", recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), "watch disconnected") {
+		t.Errorf("the failure should have been reported, got %s instead", recorder.Body.String())
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "kwatchman_server_test_total", Help: "test"})
+	prometheus.MustRegister(counter)
+	defer prometheus.Unregister(counter)
+	counter.Inc()
+
+	recorder := get(NewServer(":0", &healthCheckerMock{}), "/metrics")
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("%d != %d", recorder.Code, http.StatusOK)
+	}
+	body, _ := ioutil.ReadAll(recorder.Body)
+	if !strings.Contains(string(body), "kwatchman_server_test_total 1") {
+		t.Errorf("registered metrics should have been exposed, got %s instead", string(body))
+	}
+}
+
+func TestRunAndShutdown(t *testing.T) {
+	s := NewServer("127.0.0.1:0", &healthCheckerMock{})
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.Run()
+	}()
+
+	s.Shutdown()
+	if err := <-errC; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,123 @@
+package election
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+	"k8s.io/client-go/tools/leaderelection"
+)
+
+// Config holds the leader election configuration
+type Config struct {
+	Namespace     string        // Namespace where the Lease lives
+	Name          string        // Name of the Lease, shared by every replica
+	LeaseDuration time.Duration // Time standby replicas wait before taking over a non renewed Lease
+}
+
+// Elector campaigns for a Lease so that only one kwatchman replica, the leader, notifies
+// events, standby replicas keep watching resources and take over as soon as the
+// Lease is released or expires
+type Elector struct {
+	lock    *leaseLock
+	elector *leaderelection.LeaderElector
+	leader  int32
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewElector return an Elector for the given Lease, the renew deadline and retry
+// period are derived from the lease duration
+func NewElector(client coordinationclient.LeasesGetter, c Config) (*Elector, error) {
+	if c.Namespace == "" || c.Name == "" {
+		return nil, errors.New("leader election requires both lease namespace and name")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, errors.Wrap(err, "NewElector")
+	}
+
+	e := &Elector{
+		lock: newLeaseLock(c.Namespace, c.Name, hostname+"_"+string(uuid.NewUUID()), client),
+	}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+
+	e.elector, err = leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          e.lock,
+		LeaseDuration: c.LeaseDuration,
+		RenewDeadline: c.LeaseDuration * 2 / 3,
+		RetryPeriod:   c.LeaseDuration / 5,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				log.Infof("Leading %s as %s", e.lock.Describe(), e.lock.Identity())
+				atomic.StoreInt32(&e.leader, 1)
+			},
+			OnStoppedLeading: func() {
+				if atomic.SwapInt32(&e.leader, 0) == 1 {
+					log.Infof("Stopped leading %s", e.lock.Describe())
+				}
+			},
+			OnNewLeader: func(identity string) {
+				log.Infof("Leader of %s is %s", e.lock.Describe(), identity)
+			},
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "NewElector")
+	}
+	return e, nil
+}
+
+// IsLeader return whether this replica currently holds the Lease
+func (e *Elector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leader) == 1
+}
+
+// Run campaigns for the Lease until Shutdown, campaigning again whenever the lead is lost
+func (e *Elector) Run() {
+	e.mu.Lock()
+	if e.ctx.Err() != nil {
+		e.mu.Unlock()
+		return
+	}
+	e.done = make(chan struct{})
+	defer close(e.done)
+	e.mu.Unlock()
+
+	for {
+		e.elector.Run(e.ctx)
+		select {
+		case <-e.ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// Shutdown stops campaigning and releases the Lease when held, so that a
+// standby replica takes over without waiting for the lease to expire
+func (e *Elector) Shutdown() {
+	e.once.Do(func() {
+		e.cancel()
+		e.mu.Lock()
+		done := e.done
+		e.mu.Unlock()
+		if done != nil {
+			<-done
+		}
+		atomic.StoreInt32(&e.leader, 0)
+		if err := e.lock.Release(); err != nil {
+			log.Errorf("Releasing lease %s: %s", e.lock.Describe(), err)
+		}
+	})
+}
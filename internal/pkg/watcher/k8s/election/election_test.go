@@ -0,0 +1,233 @@
+package election
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/watch"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+)
+
+var leasesResource = coordinationv1beta1.Resource("leases")
+
+// fakeLeases is an in memory LeaseInterface honouring resource versions like the API server
+type fakeLeases struct {
+	sync.Mutex
+	leases  map[string]*coordinationv1beta1.Lease
+	version int
+}
+
+func newFakeLeases() *fakeLeases {
+	return &fakeLeases{leases: map[string]*coordinationv1beta1.Lease{}}
+}
+
+func (f *fakeLeases) Leases(namespace string) coordinationclient.LeaseInterface {
+	return f
+}
+
+func (f *fakeLeases) store(lease *coordinationv1beta1.Lease) *coordinationv1beta1.Lease {
+	f.version++
+	lease = lease.DeepCopy()
+	lease.ResourceVersion = strconv.Itoa(f.version)
+	f.leases[lease.Name] = lease
+	return lease.DeepCopy()
+}
+
+func (f *fakeLeases) Create(lease *coordinationv1beta1.Lease) (*coordinationv1beta1.Lease, error) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.leases[lease.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(leasesResource, lease.Name)
+	}
+	lease = lease.DeepCopy()
+	lease.UID = uuid.NewUUID()
+	return f.store(lease), nil
+}
+
+func (f *fakeLeases) Update(lease *coordinationv1beta1.Lease) (*coordinationv1beta1.Lease, error) {
+	f.Lock()
+	defer f.Unlock()
+	stored, ok := f.leases[lease.Name]
+	if !ok {
+		return nil, apierrors.NewNotFound(leasesResource, lease.Name)
+	}
+	if stored.ResourceVersion != lease.ResourceVersion {
+		return nil, apierrors.NewConflict(leasesResource, lease.Name, nil)
+	}
+	return f.store(lease), nil
+}
+
+func (f *fakeLeases) Delete(name string, options *metav1.DeleteOptions) error {
+	f.Lock()
+	defer f.Unlock()
+	stored, ok := f.leases[name]
+	if !ok {
+		return apierrors.NewNotFound(leasesResource, name)
+	}
+	if options != nil && options.Preconditions != nil && *options.Preconditions.UID != stored.UID {
+		return apierrors.NewConflict(leasesResource, name, nil)
+	}
+	delete(f.leases, name)
+	return nil
+}
+
+func (f *fakeLeases) DeleteCollection(*metav1.DeleteOptions, metav1.ListOptions) error {
+	return nil
+}
+
+func (f *fakeLeases) Get(name string, options metav1.GetOptions) (*coordinationv1beta1.Lease, error) {
+	f.Lock()
+	defer f.Unlock()
+	stored, ok := f.leases[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(leasesResource, name)
+	}
+	return stored.DeepCopy(), nil
+}
+
+func (f *fakeLeases) List(metav1.ListOptions) (*coordinationv1beta1.LeaseList, error) {
+	return &coordinationv1beta1.LeaseList{}, nil
+}
+
+func (f *fakeLeases) Watch(metav1.ListOptions) (watch.Interface, error) {
+	return watch.NewFake(), nil
+}
+
+func (f *fakeLeases) Patch(string, types.PatchType, []byte, ...string) (*coordinationv1beta1.Lease, error) {
+	return nil, nil
+}
+
+func waitForLeader(e *Elector, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if e.IsLeader() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestNewElectorRequiresLease(t *testing.T) {
+	if _, err := NewElector(newFakeLeases(), Config{Name: "kwatchman", LeaseDuration: time.Second}); err == nil {
+		t.Error("An error should have been returned without lease namespace")
+	}
+	if _, err := NewElector(newFakeLeases(), Config{Namespace: "default", Name: "kwatchman"}); err == nil {
+		t.Error("An error should have been returned without lease duration")
+	}
+}
+
+func TestElectorFailover(t *testing.T) {
+	leases := newFakeLeases()
+	c := Config{Namespace: "default", Name: "kwatchman", LeaseDuration: 5 * time.Second}
+
+	leader, err := NewElector(leases, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	standby, err := NewElector(leases, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go leader.Run()
+	if !waitForLeader(leader, 2*time.Second) {
+		t.Fatal("The first elector should have taken the lead")
+	}
+
+	go standby.Run()
+	defer standby.Shutdown()
+	if waitForLeader(standby, 1500*time.Millisecond) {
+		t.Fatal("The standby elector shouldn't take the lead while the lease is being renewed")
+	}
+
+	// The lease is released on shutdown, so that the standby doesn't wait for it to expire
+	leader.Shutdown()
+	if leader.IsLeader() {
+		t.Error("The elector shouldn't be leading after shutdown")
+	}
+	if !waitForLeader(standby, 3*time.Second) {
+		t.Error("The standby elector should have taken the lead before the lease duration")
+	}
+}
+
+func TestLeaseLockRecord(t *testing.T) {
+	leases := newFakeLeases()
+	lock := newLeaseLock("default", "kwatchman", "me", leases)
+
+	if _, err := lock.Get(); !apierrors.IsNotFound(err) {
+		t.Errorf("Get should have returned not found, got %v instead", err)
+	}
+
+	now := metav1.Now()
+	record := leaseSpecToRecord(&coordinationv1beta1.LeaseSpec{})
+	record.HolderIdentity = "me"
+	record.LeaseDurationSeconds = 15
+	record.RenewTime = now
+	if err := lock.Create(*record); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := lock.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.HolderIdentity != "me" || got.LeaseDurationSeconds != 15 || !got.RenewTime.Equal(&now) {
+		t.Errorf("Unexpected record %#v", got)
+	}
+
+	record.LeaderTransitions = 1
+	if err := lock.Update(*record); err != nil {
+		t.Error(err)
+	}
+	if got, _ := lock.Get(); got.LeaderTransitions != 1 {
+		t.Errorf("Record should have been updated, got %#v instead", got)
+	}
+
+	if err := newLeaseLock("default", "kwatchman", "other", leases).Release(); err != nil {
+		t.Error(err)
+	}
+	if _, err := lock.Get(); err != nil {
+		t.Error("The lease shouldn't be released by others than its holder")
+	}
+	if err := lock.Release(); err != nil {
+		t.Error(err)
+	}
+	lease, err := leases.Get("kwatchman", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("The lease should have been kept, got %v instead", err)
+	}
+	if !isReleased(lease) || *lease.Spec.LeaseDurationSeconds != 1 {
+		t.Errorf("The lease holder should have been cleared, got %#v instead", lease.Spec)
+	}
+	if _, err := lock.Get(); !apierrors.IsNotFound(err) {
+		t.Errorf("A released lease should be reported as not found, got %v instead", err)
+	}
+	// A late renew never takes the released lease again
+	if err := lock.Update(*record); err == nil {
+		t.Error("Updating a released lease should have been refused")
+	}
+	if lease, _ := leases.Get("kwatchman", metav1.GetOptions{}); !isReleased(lease) {
+		t.Errorf("The lease should have been kept released, got %#v instead", lease.Spec)
+	}
+
+	// A released lease is acquired by updating it
+	other := newLeaseLock("default", "kwatchman", "other", leases)
+	if _, err := other.Get(); !apierrors.IsNotFound(err) {
+		t.Fatal(err)
+	}
+	record.HolderIdentity = "other"
+	if err := other.Create(*record); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := other.Get(); err != nil || got.HolderIdentity != "other" || got.LeaderTransitions != 2 {
+		t.Errorf("The released lease should have been acquired, got %#v and %v instead", got, err)
+	}
+}
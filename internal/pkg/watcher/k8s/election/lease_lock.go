@@ -0,0 +1,183 @@
+package election
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaseLock implements resourcelock.Interface on top of a coordination Lease, which
+// is lighter than the ConfigMap and Endpoints locks shipped with client-go since
+// renewals do not trigger every ConfigMap and Endpoints watcher in the cluster. The lease is
+// guarded since client-go's renew loop may still be updating it while it's released
+type leaseLock struct {
+	sync.Mutex
+	namespace string
+	name      string
+	identity  string
+	client    coordinationclient.LeasesGetter
+	lease     *coordinationv1beta1.Lease
+	released  bool // Refuses any later create or update, so that a late renew never takes it again
+}
+
+func newLeaseLock(namespace, name, identity string, client coordinationclient.LeasesGetter) *leaseLock {
+	return &leaseLock{
+		namespace: namespace,
+		name:      name,
+		identity:  identity,
+		client:    client,
+	}
+}
+
+// Get returns the election record from the Lease spec, a released Lease is reported as not
+// found, since client-go's leader elector waits for a whole lease duration before taking over
+// any existing record, while a missing one is acquired within the next retry period
+func (l *leaseLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.get()
+}
+
+func (l *leaseLock) get() (*resourcelock.LeaderElectionRecord, error) {
+	lease, err := l.client.Leases(l.namespace).Get(l.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	l.lease = lease
+	if isReleased(lease) {
+		return nil, apierrors.NewNotFound(coordinationv1beta1.Resource("leases"), l.name)
+	}
+	return leaseSpecToRecord(&lease.Spec), nil
+}
+
+// Create attempts to create the Lease holding the election record, or to acquire it when
+// released, which fails with a conflict when another replica acquired it meanwhile
+func (l *leaseLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.released {
+		return errors.New("lease released")
+	}
+	if l.lease != nil && isReleased(l.lease) {
+		if l.lease.Spec.LeaseTransitions != nil {
+			ler.LeaderTransitions = int(*l.lease.Spec.LeaseTransitions) + 1
+		}
+		return l.update(ler)
+	}
+	lease, err := l.client.Leases(l.namespace).Create(&coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      l.name,
+			Namespace: l.namespace,
+		},
+		Spec: recordToLeaseSpec(&ler),
+	})
+	if err != nil {
+		return err
+	}
+	l.lease = lease
+	return nil
+}
+
+// Update the election record of an existing Lease, unless released
+func (l *leaseLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.released {
+		return errors.New("lease released")
+	}
+	return l.update(ler)
+}
+
+func (l *leaseLock) update(ler resourcelock.LeaderElectionRecord) error {
+	if l.lease == nil {
+		return errors.New("lease not initialized, call get or create first")
+	}
+	lease := l.lease.DeepCopy()
+	lease.Spec = recordToLeaseSpec(&ler)
+	lease, err := l.client.Leases(l.namespace).Update(lease)
+	if err != nil {
+		return err
+	}
+	l.lease = lease
+	return nil
+}
+
+// Release clears the holder of the Lease when still held by this identity, as client-go's
+// locks do when releasing on cancel, standby replicas then acquire it right away, the lock
+// refuses any later update from then on
+func (l *leaseLock) Release() error {
+	l.Lock()
+	defer l.Unlock()
+	l.released = true
+	record, err := l.get()
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if record.HolderIdentity != l.identity {
+		return nil
+	}
+	record.HolderIdentity = ""
+	record.LeaseDurationSeconds = 1
+	record.RenewTime = metav1.Now()
+	return l.update(*record)
+}
+
+// isReleased return whether the Lease has no holder
+func isReleased(lease *coordinationv1beta1.Lease) bool {
+	return lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == ""
+}
+
+// RecordEvent is a noop since leadership transitions are logged by the elector
+func (l *leaseLock) RecordEvent(string) {}
+
+// Identity return the identity of the lock
+func (l *leaseLock) Identity() string {
+	return l.identity
+}
+
+// Describe return the lock namespace and name
+func (l *leaseLock) Describe() string {
+	return fmt.Sprintf("%s/%s", l.namespace, l.name)
+}
+
+func leaseSpecToRecord(spec *coordinationv1beta1.LeaseSpec) *resourcelock.LeaderElectionRecord {
+	var record resourcelock.LeaderElectionRecord
+	if spec.HolderIdentity != nil {
+		record.HolderIdentity = *spec.HolderIdentity
+	}
+	if spec.LeaseDurationSeconds != nil {
+		record.LeaseDurationSeconds = int(*spec.LeaseDurationSeconds)
+	}
+	if spec.LeaseTransitions != nil {
+		record.LeaderTransitions = int(*spec.LeaseTransitions)
+	}
+	if spec.AcquireTime != nil {
+		record.AcquireTime = metav1.Time{Time: spec.AcquireTime.Time}
+	}
+	if spec.RenewTime != nil {
+		record.RenewTime = metav1.Time{Time: spec.RenewTime.Time}
+	}
+	return &record
+}
+
+func recordToLeaseSpec(ler *resourcelock.LeaderElectionRecord) coordinationv1beta1.LeaseSpec {
+	holderIdentity := ler.HolderIdentity
+	leaseDurationSeconds := int32(ler.LeaseDurationSeconds)
+	leaseTransitions := int32(ler.LeaderTransitions)
+	return coordinationv1beta1.LeaseSpec{
+		HolderIdentity:       &holderIdentity,
+		LeaseDurationSeconds: &leaseDurationSeconds,
+		LeaseTransitions:     &leaseTransitions,
+		AcquireTime:          &metav1.MicroTime{Time: ler.AcquireTime.Time},
+		RenewTime:            &metav1.MicroTime{Time: ler.RenewTime.Time},
+	}
+}
@@ -1,23 +1,32 @@
 package k8s
 
 import (
+	"context"
+	"crypto/rand"
 	"fmt"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/snebel29/kwatchman/internal/pkg/cli"
 	"github.com/snebel29/kwatchman/internal/pkg/config"
 	"github.com/snebel29/kwatchman/internal/pkg/handler"
 	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher/k8s/election"
 	"github.com/snebel29/kwatchman/internal/pkg/watcher/k8s/resources"
+	"path/filepath"
 	"sync"
+	"time"
 
 	// We need to register cloud auth providers
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	//Register the following handlers to be available for configuration
 	_ "github.com/snebel29/kwatchman/internal/pkg/handler/diff"
+	_ "github.com/snebel29/kwatchman/internal/pkg/handler/escalation"
 	_ "github.com/snebel29/kwatchman/internal/pkg/handler/log"
 	_ "github.com/snebel29/kwatchman/internal/pkg/handler/slack"
 	_ "github.com/snebel29/kwatchman/internal/pkg/handler/ignoreEvents"
@@ -25,18 +34,21 @@ import (
 
 // Watcher object that also hold config and k8s resources to generate resources watchers from
 type Watcher struct {
-	config       *config.Config
-	k8sResources []watcher.ResourceWatcher
+	config          *config.Config
+	k8sResources    []watcher.ResourceWatcher
+	elector         *election.Elector
+	chainOfHandlers handler.ChainOfHandlers
+	gracePeriod     time.Duration
+	cancelHandlers  context.CancelFunc
+	cancelOnce      sync.Once
+	informers       []*resources.SharedInformers
+	stopMu          sync.Mutex
+	stopC           chan struct{} // Closed on shutdown, interrupts the resource watchers restarts
 }
 
 // NewK8sWatcher parses the config and maps handlers and
 // resources from configuration, then return the k8sWatcher
 func NewK8sWatcher(c *config.Config) (*Watcher, error) {
-	clientset, err := getK8sClient(c.CLI.Kubeconfig)
-	if err != nil {
-		return nil, err
-	}
-
 	handlerList, err := handler.GetHandlerListFromConfig(c)
 	if err != nil {
 		return nil, err
@@ -44,26 +56,175 @@ func NewK8sWatcher(c *config.Config) (*Watcher, error) {
 
 	chainOfHandlers := handler.NewChainOfHandlers(handlerList...)
 
+	var elector *election.Elector
+	if c.CLI.LeaderElect {
+		elector, err = newElector(c.CLI)
+		if err != nil {
+			return nil, err
+		}
+		chainOfHandlers = handler.NewLeaderChainOfHandlers(elector, handlerList...)
+	}
+
 	resourcesFuncList, err := resources.GetResourcesFuncListFromConfig(c)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Watcher{
-		config: c,
-		k8sResources: resources.GetResourceWatcherList(
+	salt, err := secretSalt(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without clusters configured we watch the only one from command line or the one we live within
+	clusters := c.Clusters
+	if len(clusters) == 0 {
+		clusters = config.Clusters{{}}
+	}
+
+	// Every handler run is bound to this context, cancelled when the grace period is running out
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var k8sResources []watcher.ResourceWatcher
+	var informers []*resources.SharedInformers
+	for _, cluster := range clusters {
+		restConfig, err := getClusterConfig(cluster, c.CLI.Kubeconfig)
+		if err != nil {
+			cancel()
+			return nil, errors.Wrapf(err, "cluster %s", cluster.Name)
+		}
+
+		clientset, err := kubernetes.NewForConfig(protobufConfig(restConfig))
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("can't create kubernetes client for cluster %s: %s", cluster.Name, err)
+		}
+
+		// Custom resources are only served as JSON so the dynamic client keeps the original config,
+		// which the built-in resources resolved through discovery are requested as too
+		dynamicClient, err := dynamic.NewForConfig(restConfig)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("can't create kubernetes dynamic client for cluster %s: %s", cluster.Name, err)
+		}
+
+		// Every resource is listed and watched once per cluster and server side filters whatever
+		// the number of watchers
+		clusterInformers := resources.NewSharedInformers(clusterStateDir(c.CLI.StateDir, cluster.Name))
+		informers = append(informers, clusterInformers)
+
+		k8sResources = append(k8sResources, resources.GetResourceWatcherList(
 			resourcesFuncList,
 			resources.ResourceWatcherArgs{
-				Clientset:       clientset,
-				Namespace:       c.CLI.Namespace,
-				LabelSelector:   c.CLI.LabelSelector,
-				ChainOfHandlers: chainOfHandlers,
-			}),
+				Cluster:           cluster.Name,
+				Clientset:         clientset,
+				DynamicClient:     dynamicClient,
+				Namespaces:        c.CLI.Namespaces,
+				ExcludeNamespaces: c.CLI.ExcludeNamespaces,
+				LabelSelector:     c.CLI.LabelSelector,
+				ChainOfHandlers:   chainOfHandlers,
+				LivenessThreshold: c.CLI.LivenessThreshold,
+				Context:           ctx,
+				SecretSalt:        salt,
+				Informers:         clusterInformers,
+			})...)
+	}
+
+	return &Watcher{
+		config:          c,
+		k8sResources:    k8sResources,
+		elector:         elector,
+		chainOfHandlers: chainOfHandlers,
+		gracePeriod:     c.CLI.GracePeriod,
+		cancelHandlers:  cancel,
+		informers:       informers,
 	}, nil
 }
 
-// Run start k8s controller for each k8s resource
+// clusterStateDir return the directory where the resources of a cluster are persisted, none
+// when no state directory is given
+func clusterStateDir(stateDir, cluster string) string {
+	if stateDir == "" {
+		return ""
+	}
+	return filepath.Join(stateDir, cluster)
+}
+
+// protobufConfig return a copy of the config negotiating protobuf, which built-in resources are
+// served as, falling back to JSON otherwise
+func protobufConfig(c *rest.Config) *rest.Config {
+	c = rest.CopyConfig(c)
+	c.ContentType = "application/vnd.kubernetes.protobuf"
+	c.AcceptContentTypes = "application/vnd.kubernetes.protobuf,application/json"
+	return c
+}
+
+// secretSalt return the salt of the hashes replacing secret values, a random one when not given,
+// in which case the hashes change on every restart, which is refused when secrets are stored
+// by a persisted diff handler storage since every secret would be reported as changed
+func secretSalt(c *config.Config) ([]byte, error) {
+	if c.CLI.SecretSalt != "" {
+		return []byte(c.CLI.SecretSalt), nil
+	}
+	if watchesSecrets(c.Resources) && persistsDiffStorage(c.Handlers) {
+		return nil, errors.New("--secret-salt is required to watch secrets along with a diff handler storageDir")
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, errors.Wrap(err, "secretSalt")
+	}
+	return random, nil
+}
+
+func watchesSecrets(rs config.Resources) bool {
+	for _, r := range rs {
+		if r.Kind == resources.SECRET {
+			return true
+		}
+	}
+	return false
+}
+
+func persistsDiffStorage(hs config.Handlers) bool {
+	for _, h := range hs {
+		if h.Name == "diff" && h.StorageDir != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// newElector return the leader election elector, whose lease lives within the
+// cluster kwatchman runs within or the one from command line kubeconfig
+func newElector(args *cli.Args) (*election.Elector, error) {
+	clientset, err := getK8sClient(args.Kubeconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "leader election")
+	}
+	return election.NewElector(clientset.CoordinationV1beta1(), election.Config{
+		Namespace:     args.LeaderElectNamespace,
+		Name:          args.LeaderElectName,
+		LeaseDuration: args.LeaderElectLeaseDuration,
+	})
+}
+
+// Run start k8s controller for each k8s resource, resource watchers retry the API failures on their
+// own and are run again when failing otherwise, so that only fatal errors, such as a resource not
+// served, stop every other one
 func (w *Watcher) Run() error {
+	if w.cancelHandlers != nil {
+		defer w.cancelHandlers()
+	}
+
+	// Resources are watched by standby replicas too, only the handlers are gated by leadership,
+	// the lease is released once the events being handled are finished
+	if w.elector != nil {
+		go w.elector.Run()
+		defer w.elector.Shutdown()
+	}
+
+	// The informers feeding the resource watchers are stopped last, once they finished
+	defer w.shutdownInformers()
+
 	// Mo matter what, either an error or a legitime shutdown returning nil,
 	// at the end we shutdown the watcher with all its ResourceWatchers
 	defer w.Shutdown()
@@ -80,8 +241,11 @@ func (w *Watcher) Run() error {
 		// although the wait group can be safely "closurized"
 		go func(r watcher.ResourceWatcher, errC chan<- error) {
 			defer wg.Done()
-			if err := r.Run(); err != nil {
-				errC <- errors.Wrap(err, "K8sWatcher Run()")
+			if err := w.runResourceWatcher(r); err != nil {
+				select {
+				case errC <- errors.Wrap(err, "K8sWatcher Run()"):
+				default:
+				}
 			}
 		}(rw, errC)
 	}
@@ -93,20 +257,111 @@ func (w *Watcher) Run() error {
 	}()
 
 	// Return either an error or nil
-	return <-errC
+	if err := <-errC; err != nil {
+		return err
+	}
+
+	// Every resource watcher finished handling its events, buffering handlers can be flushed
+	if w.chainOfHandlers != nil {
+		if err := w.chainOfHandlers.Flush(context.Background()); err != nil {
+			return errors.Wrap(err, "K8sWatcher Flush()")
+		}
+	}
+	return nil
 }
 
-// Shutdown the k8s watcher and all its resource watchers
+// runResourceWatcher runs the resource watcher until it finishes or fails with a fatal error, any
+// other failure runs it again with an exponential backoff unless shutting down meanwhile, resource
+// watcher groups only fail with fatal errors since their resource watchers can't run again
+func (w *Watcher) runResourceWatcher(r watcher.ResourceWatcher) error {
+	for failures := 1; ; failures++ {
+		err := r.Run()
+		if err == nil || resources.IsFatal(err) {
+			return err
+		}
+		interval := resources.RetryInterval(failures)
+		log.Errorf("Resource watcher failed, running it again in %s: %s", interval, err)
+
+		select {
+		case <-time.After(interval):
+		case <-w.stopped():
+			return nil
+		}
+	}
+}
+
+// stopped return the channel closed once shutting down
+func (w *Watcher) stopped() chan struct{} {
+	w.stopMu.Lock()
+	defer w.stopMu.Unlock()
+	if w.stopC == nil {
+		w.stopC = make(chan struct{})
+	}
+	return w.stopC
+}
+
+// Shutdown the k8s watcher and all its resource watchers, Run returns once
+// they finish handling their events, the handlers still running by then are
+// cancelled before the grace period is exceeded
 func (w *Watcher) Shutdown() {
+	stopC := w.stopped()
+	w.stopMu.Lock()
+	select {
+	case <-stopC:
+	default:
+		close(stopC)
+	}
+	w.stopMu.Unlock()
 	for _, rw := range w.k8sResources {
 		rw.Shutdown()
 	}
+	if w.cancelHandlers != nil {
+		w.cancelOnce.Do(func() {
+			time.AfterFunc(handlersCancelDelay(w.gracePeriod), w.cancelHandlers)
+		})
+	}
 }
 
-// Returns kubernetes API clientset, depending on the context where kwatchman
+func (w *Watcher) shutdownInformers() {
+	for _, i := range w.informers {
+		i.Shutdown()
+	}
+}
+
+// handlersCancelDelay return when the handlers are cancelled within the grace period,
+// leaving them a fraction of it to return before kwatchman gives up on them
+func handlersCancelDelay(gracePeriod time.Duration) time.Duration {
+	return gracePeriod * 4 / 5
+}
+
+// Ready return an error until every resource watcher has completed its initial sync
+func (w *Watcher) Ready() error {
+	for _, rw := range w.k8sResources {
+		if hc, ok := rw.(watcher.HealthChecker); ok {
+			if err := hc.Ready(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Live return an error when any resource watcher has been disconnected beyond the threshold
+func (w *Watcher) Live() error {
+	for _, rw := range w.k8sResources {
+		if hc, ok := rw.(watcher.HealthChecker); ok {
+			if err := hc.Live(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns kubernetes API client config, depending on the context where kwatchman
 // is run, InCluster vs local, kubeconfig will be used only when running out of k8s
 // you can pass an empty string when running InCluster
-func getK8sClient(kubeconfigFile string) (kubernetes.Interface, error) {
+func getK8sConfig(kubeconfigFile string) (*rest.Config, error) {
 	var conf *rest.Config
 	conf, err := rest.InClusterConfig()
 
@@ -124,6 +379,36 @@ func getK8sClient(kubeconfigFile string) (kubernetes.Interface, error) {
 			return nil, err
 		}
 	}
+	return conf, nil
+}
+
+// Returns kubernetes API client config for a configured cluster, either from the cluster where
+// kwatchman lives within, or from the kubeconfig context, an empty cluster config
+// fallbacks to getK8sConfig
+func getClusterConfig(cluster config.Cluster, defaultKubeconfigFile string) (*rest.Config, error) {
+	if cluster.InCluster {
+		return rest.InClusterConfig()
+	}
+	if cluster.Kubeconfig == "" && cluster.Context == "" {
+		return getK8sConfig(defaultKubeconfigFile)
+	}
+
+	kubeconfigFile := cluster.Kubeconfig
+	if kubeconfigFile == "" {
+		kubeconfigFile = defaultKubeconfigFile
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfigFile},
+		&clientcmd.ConfigOverrides{CurrentContext: cluster.Context},
+	).ClientConfig()
+}
+
+// Returns kubernetes API clientset, see getK8sConfig
+func getK8sClient(kubeconfigFile string) (kubernetes.Interface, error) {
+	conf, err := getK8sConfig(kubeconfigFile)
+	if err != nil {
+		return nil, err
+	}
 
 	// Generate new clientset from the config (either produced In or Out cluster)
 	clientset, err := kubernetes.NewForConfig(conf)
@@ -1,9 +1,12 @@
 package k8s
 
 import (
+	"context"
 	"github.com/snebel29/kwatchman/internal/pkg/cli"
 	"github.com/snebel29/kwatchman/internal/pkg/config"
+	"github.com/snebel29/kwatchman/internal/pkg/handler"
 	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher/k8s/resources"
 	// We need handler/log init() registeting the handler for testing
 	"errors"
 	_ "github.com/snebel29/kwatchman/internal/pkg/handler/log"
@@ -11,7 +14,9 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"sync"
 	"testing"
+	"time"
 )
 
 var thisFilename string
@@ -56,7 +61,7 @@ func TestNewK8sWatcher(t *testing.T) {
 		{Kind: "deployment"},
 	}
 	c := &cli.Args{
-		Namespace:  "namespace",
+		Namespaces: []string{"namespace"},
 		Kubeconfig: kubeconfig,
 		ConfigFile: "",
 	}
@@ -79,6 +84,79 @@ func TestNewK8sWatcher(t *testing.T) {
 	}
 }
 
+func TestGetClusterConfig(t *testing.T) {
+	kubeconfig := path.Join(path.Dir(thisFilename), "fixtures", "kubeconfig")
+
+	restConfig, err := getClusterConfig(config.Cluster{Name: "eks", Context: "aws"}, kubeconfig)
+	if err != nil {
+		t.Errorf("Failed to get cluster config from kubeconfig context: %v", err)
+	}
+	expectedHost := "https://3648988C03150EFCA3D30250B12D3B.yl4.us-east-1.eks.amazonaws.com"
+	if restConfig != nil && restConfig.Host != expectedHost {
+		t.Errorf("%s != %s", restConfig.Host, expectedHost)
+	}
+
+	if _, err := getClusterConfig(config.Cluster{Name: "unexistent", Context: "unexistent"}, kubeconfig); err == nil {
+		t.Error("An error should have been returned for unexistent context")
+	}
+
+	if _, err := getClusterConfig(config.Cluster{Name: "in-cluster", InCluster: true}, kubeconfig); err != rest.ErrNotInCluster {
+		t.Errorf("rest.ErrNotInCluster should have been returned, got %v instead", err)
+	}
+}
+
+func TestNewK8sWatcherWithClusters(t *testing.T) {
+	kubeconfig := path.Join(path.Dir(thisFilename), "fixtures", "kubeconfig")
+	conf := &config.Config{
+		Handlers:  config.Handlers{{Name: "log"}},
+		Resources: config.Resources{{Kind: "deployment"}},
+		Clusters: config.Clusters{
+			{Name: "gke", Context: "gke_jfrog-200320_us-west1-a_cluster"},
+			{Name: "eks", Context: "aws"},
+		},
+		CLI: &cli.Args{Kubeconfig: kubeconfig},
+	}
+
+	w, err := NewK8sWatcher(conf)
+	if err != nil {
+		t.Fatalf("%s getting NewK8sWatcher", err)
+	}
+	if len(w.k8sResources) != 2 {
+		t.Errorf("There should be 1 resource per cluster, but there is %d instead", len(w.k8sResources))
+	}
+	if len(w.informers) != 2 {
+		t.Errorf("There should be shared informers per cluster, but there are %d instead", len(w.informers))
+	}
+}
+
+func TestNewK8sWatcherWithLeaderElection(t *testing.T) {
+	kubeconfig := path.Join(path.Dir(thisFilename), "fixtures", "kubeconfig")
+	conf := &config.Config{
+		Handlers:  config.Handlers{{Name: "log"}},
+		Resources: config.Resources{{Kind: "deployment"}},
+		CLI: &cli.Args{
+			Kubeconfig:               kubeconfig,
+			LeaderElect:              true,
+			LeaderElectNamespace:     "kwatchman",
+			LeaderElectName:          "kwatchman",
+			LeaderElectLeaseDuration: 15 * time.Second,
+		},
+	}
+
+	w, err := NewK8sWatcher(conf)
+	if err != nil {
+		t.Fatalf("%s getting NewK8sWatcher", err)
+	}
+	if w.elector == nil {
+		t.Error("K8sWatcher.elector should have been set")
+	}
+
+	conf.CLI.LeaderElectLeaseDuration = 0
+	if _, err := NewK8sWatcher(conf); err == nil {
+		t.Error("An error should have been returned for a wrong lease duration")
+	}
+}
+
 type ResourceWatcherMock struct {
 	RunCalled      bool
 	ShutdownCalled bool
@@ -94,13 +172,20 @@ func (w *ResourceWatcherMock) Shutdown() {
 }
 
 type ResourceWatcherWithErrorMock struct {
-	RunCalled      bool
+	sync.Mutex
+	RunCalls       int
 	ShutdownCalled bool
 }
 
+// Run fails the first time only
 func (w *ResourceWatcherWithErrorMock) Run() error {
-	w.RunCalled = true
-	return errors.New("simulated error")
+	w.Lock()
+	defer w.Unlock()
+	w.RunCalls++
+	if w.RunCalls == 1 {
+		return errors.New("simulated error")
+	}
+	return nil
 }
 
 func (w *ResourceWatcherWithErrorMock) Shutdown() {
@@ -141,17 +226,148 @@ func TestK8sWatcherRunAndShutdownNormally(t *testing.T) {
 }
 
 func TestK8sWatcherRunAndFailWithErrors(t *testing.T) {
+	failing := &ResourceWatcherWithErrorMock{}
 	w := &Watcher{
 		config: nil,
 		k8sResources: []watcher.ResourceWatcher{
 			&ResourceWatcherMock{},
-			&ResourceWatcherWithErrorMock{},
+			failing,
 			&ResourceWatcherMock{},
 		},
 	}
 
-	err := w.Run()
-	if err == nil {
-		t.Errorf("An error should have being returned %s", err)
+	if err := w.Run(); err != nil {
+		t.Errorf("A failing resource watcher should have been run again, got %s", err)
+	}
+	if failing.RunCalls != 2 {
+		t.Errorf("The failing resource watcher should have been run twice, got %d runs", failing.RunCalls)
+	}
+
+	// A resource watcher which can't recover stops every other one
+	w = &Watcher{
+		config: nil,
+		k8sResources: []watcher.ResourceWatcher{
+			&ResourceWatcherMock{},
+			resources.NewDynamicWatcherFunc(config.Resource{Kind: "Rollout"})(resources.ResourceWatcherArgs{}),
+		},
+	}
+	if err := w.Run(); err == nil || !resources.IsFatal(err) {
+		t.Errorf("A fatal error should have being returned, got %v", err)
+	}
+}
+
+type ResourceWatcherHealthMock struct {
+	ResourceWatcherMock
+	ready error
+	live  error
+}
+
+func (w *ResourceWatcherHealthMock) Ready() error {
+	return w.ready
+}
+
+func (w *ResourceWatcherHealthMock) Live() error {
+	return w.live
+}
+
+func TestK8sWatcherHealth(t *testing.T) {
+	unhealthy := &ResourceWatcherHealthMock{
+		ready: errors.New("initial sync not completed"),
+		live:  errors.New("watch disconnected"),
+	}
+	w := &Watcher{
+		k8sResources: []watcher.ResourceWatcher{
+			&ResourceWatcherMock{},
+			&ResourceWatcherHealthMock{},
+			unhealthy,
+		},
+	}
+
+	if w.Ready() == nil || w.Live() == nil {
+		t.Error("the watcher should report its unhealthy resource watchers")
+	}
+
+	unhealthy.ready, unhealthy.live = nil, nil
+	if w.Ready() != nil || w.Live() != nil {
+		t.Error("the watcher should be healthy when all its resource watchers are")
+	}
+}
+
+func TestK8sWatcherFlushesHandlersOnceFinished(t *testing.T) {
+	flusher := handler.NewMockFlusherHandler()
+	w := &Watcher{
+		k8sResources:    []watcher.ResourceWatcher{&ResourceWatcherMock{}},
+		chainOfHandlers: handler.NewChainOfHandlers(flusher),
+	}
+
+	if err := w.Run(); err != nil {
+		t.Error(err)
+	}
+	if !flusher.Flushed {
+		t.Error("handlers should have been flushed once resource watchers finished")
+	}
+
+	flusher.FlushErr = errors.New("simulated error")
+	if err := w.Run(); err == nil {
+		t.Error("flush error should have been returned")
+	}
+}
+
+func TestK8sWatcherShutdownCancelsHandlers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{
+		k8sResources:   []watcher.ResourceWatcher{&ResourceWatcherMock{}},
+		gracePeriod:    50 * time.Millisecond,
+		cancelHandlers: cancel,
+	}
+
+	w.Shutdown()
+	if ctx.Err() != nil {
+		t.Error("handlers should be given part of the grace period before being cancelled")
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("handlers should have been cancelled within the grace period")
+	}
+}
+
+func TestSecretSalt(t *testing.T) {
+	c := &config.Config{CLI: &cli.Args{SecretSalt: "mySalt"}}
+	salt, err := secretSalt(c)
+	if err != nil || string(salt) != "mySalt" {
+		t.Errorf("the given salt should be used, got %q, err: %v", salt, err)
+	}
+
+	c.CLI.SecretSalt = ""
+	salt, err = secretSalt(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := secretSalt(c)
+	if len(salt) == 0 || string(salt) == string(other) {
+		t.Error("a random salt should be generated when not given")
+	}
+
+	c.Resources = config.Resources{{Kind: "secret"}}
+	c.Handlers = config.Handlers{{Name: "diff", StorageDir: "/var/lib/kwatchman"}}
+	if _, err := secretSalt(c); err == nil {
+		t.Error("a salt should be required to persist the storage of secrets")
+	}
+	c.Resources = config.Resources{{Kind: "deployment"}}
+	if _, err := secretSalt(c); err != nil {
+		t.Errorf("a salt should only be required when watching secrets, got %v", err)
+	}
+}
+
+func TestProtobufConfig(t *testing.T) {
+	original := &rest.Config{Host: "https://cluster"}
+	c := protobufConfig(original)
+	if c.ContentType != "application/vnd.kubernetes.protobuf" ||
+		c.AcceptContentTypes != "application/vnd.kubernetes.protobuf,application/json" {
+		t.Errorf("protobuf should have been negotiated, got %#v instead", c.ContentConfig)
+	}
+	if c.Host != original.Host || original.ContentType != "" {
+		t.Error("the config should have been copied rather than modified")
 	}
 }
@@ -0,0 +1,43 @@
+package resources
+
+import (
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+const (
+	// CLUSTERROLE const used by registration process
+	CLUSTERROLE = "clusterrole"
+)
+
+func init() {
+	registerResource(CLUSTERROLE, clusterScoped, NewClusterRoleWatcher)
+}
+
+// NewClusterRoleWatcher return a watcher for k8s cluster roles, which are cluster scoped
+func NewClusterRoleWatcher(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+
+	resourceKind := CLUSTERROLE
+
+	retr := &retrieve.Resource{
+		Object: &rbacv1.ClusterRole{},
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return arg.Clientset.RbacV1().ClusterRoles().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return arg.Clientset.RbacV1().ClusterRoles().Watch(options)
+			},
+		},
+	}
+
+	return newTypedResourceWatcher(
+		arg, resourceKind, rbacv1.SchemeGroupVersion.WithResource("clusterroles"), retr)
+}
@@ -0,0 +1,43 @@
+package resources
+
+import (
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+const (
+	// CLUSTERROLEBINDING const used by registration process
+	CLUSTERROLEBINDING = "clusterrolebinding"
+)
+
+func init() {
+	registerResource(CLUSTERROLEBINDING, clusterScoped, NewClusterRoleBindingWatcher)
+}
+
+// NewClusterRoleBindingWatcher return a watcher for k8s cluster role bindings, which are cluster scoped
+func NewClusterRoleBindingWatcher(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+
+	resourceKind := CLUSTERROLEBINDING
+
+	retr := &retrieve.Resource{
+		Object: &rbacv1.ClusterRoleBinding{},
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return arg.Clientset.RbacV1().ClusterRoleBindings().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return arg.Clientset.RbacV1().ClusterRoleBindings().Watch(options)
+			},
+		},
+	}
+
+	return newTypedResourceWatcher(
+		arg, resourceKind, rbacv1.SchemeGroupVersion.WithResource("clusterrolebindings"), retr)
+}
@@ -0,0 +1,43 @@
+package resources
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+const (
+	// CONFIGMAP const used by registration process
+	CONFIGMAP = "configmap"
+)
+
+func init() {
+	registerResource(CONFIGMAP, namespaced, NewConfigMapWatcher)
+}
+
+// NewConfigMapWatcher return a watcher for k8s configmaps
+func NewConfigMapWatcher(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+
+	resourceKind := CONFIGMAP
+
+	retr := &retrieve.Resource{
+		Object: &corev1.ConfigMap{},
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return arg.Clientset.CoreV1().ConfigMaps(arg.Namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return arg.Clientset.CoreV1().ConfigMaps(arg.Namespace).Watch(options)
+			},
+		},
+	}
+
+	return newTypedResourceWatcher(
+		arg, resourceKind, corev1.SchemeGroupVersion.WithResource("configmaps"), retr)
+}
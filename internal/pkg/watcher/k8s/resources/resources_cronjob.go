@@ -0,0 +1,27 @@
+package resources
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+const (
+	// CRONJOB const used by registration process
+	CRONJOB = "cronjob"
+)
+
+func init() {
+	registerResource(CRONJOB, namespaced, NewCronJobWatcher)
+}
+
+// NewCronJobWatcher return a watcher for k8s cronjobs, batch/v1 is served from 1.21 while
+// batch/v1beta1 is removed on 1.25, therefore the newest version served by the cluster
+// is selected through discovery and watched dynamically
+func NewCronJobWatcher(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+	return newVersionedResourceWatcher(
+		CRONJOB, arg,
+		schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"},
+		schema.GroupVersionResource{Group: "batch", Version: "v1beta1", Resource: "cronjobs"},
+	)
+}
@@ -9,7 +9,6 @@ import (
 	"k8s.io/client-go/tools/cache"
 
 	"github.com/snebel29/kooper/operator/retrieve"
-	"github.com/snebel29/kwatchman/internal/pkg/registry"
 	"github.com/snebel29/kwatchman/internal/pkg/watcher"
 )
 
@@ -19,7 +18,7 @@ const (
 )
 
 func init() {
-	registry.Register(registry.RESOURCES, DEPLOYMENT, NewDeploymentWatcher)
+	registerResource(DEPLOYMENT, namespaced, NewDeploymentWatcher)
 }
 
 // NewDeploymentWatcher return a watcher for k8s deployments
@@ -31,17 +30,14 @@ func NewDeploymentWatcher(arg ResourceWatcherArgs) watcher.ResourceWatcher {
 		Object: &appsv1.Deployment{},
 		ListerWatcher: &cache.ListWatch{
 			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-				options.LabelSelector = arg.LabelSelector
 				return arg.Clientset.AppsV1().Deployments(arg.Namespace).List(options)
 			},
 			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-				options.LabelSelector = arg.LabelSelector
 				return arg.Clientset.AppsV1().Deployments(arg.Namespace).Watch(options)
 			},
 		},
 	}
 
-	return newK8sResourceWatcher(
-		resourceKind, newResourceHandlerFunc(arg.ChainOfHandlers, resourceKind),
-		retr)
+	return newTypedResourceWatcher(
+		arg, resourceKind, appsv1.SchemeGroupVersion.WithResource("deployments"), retr)
 }
@@ -0,0 +1,154 @@
+package resources
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+
+	"github.com/snebel29/kwatchman/internal/pkg/config"
+)
+
+// listResources return the api resource lists where to look for the configured resource,
+// when the version is given only that group version is queried, otherwise the server
+// preferred version of every group is used. A group version not served is retried as any
+// other discovery failure, since its CRD may be installed later on
+func listResources(d discovery.ServerResourcesInterface, r config.Resource) ([]*metav1.APIResourceList, error) {
+	if r.Version != "" {
+		gv := schema.GroupVersion{Group: r.Group, Version: r.Version}
+		list, err := d.ServerResourcesForGroupVersion(gv.String())
+		if apierrors.IsNotFound(err) {
+			return nil, errors.Wrapf(err, "group version %s is not served by the API server yet", gv.String())
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "discovering resources for %s", gv.String())
+		}
+		return []*metav1.APIResourceList{list}, nil
+	}
+
+	lists, err := d.ServerPreferredResources()
+	if err != nil {
+		// Some aggregated apis may be unavailable, we can still look into the rest of groups
+		if !discovery.IsGroupDiscoveryFailedError(err) || lists == nil {
+			return nil, errors.Wrap(err, "discovering server preferred resources")
+		}
+		log.Warnf("Partial discovery result: %s", err)
+	}
+	return lists, nil
+}
+
+// matchResource compares the discovered api resource against the configured one, resource
+// names match exactly while kind is compared case insensitively against kind and names
+func matchResource(apiResource metav1.APIResource, r config.Resource) bool {
+	if r.Resource != "" {
+		return apiResource.Name == r.Resource
+	}
+	return strings.EqualFold(apiResource.Kind, r.Kind) ||
+		strings.EqualFold(apiResource.Name, r.Kind) ||
+		strings.EqualFold(apiResource.SingularName, r.Kind)
+}
+
+func hasVerbs(apiResource metav1.APIResource, verbs ...string) bool {
+	for _, verb := range verbs {
+		found := false
+		for _, v := range apiResource.Verbs {
+			if v == verb {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// discoverResource resolves the configured resource into the group version resource served
+// by the API, along with its api resource description which tells whether is namespaced or not,
+// a resource not served is retried until its CRD is installed, while one that can't be listed
+// and watched is fatal
+func discoverResource(d discovery.ServerResourcesInterface, r config.Resource) (
+	schema.GroupVersionResource, metav1.APIResource, error) {
+
+	lists, err := listResources(d, r)
+	if err != nil {
+		return schema.GroupVersionResource{}, metav1.APIResource{}, err
+	}
+
+	for _, list := range lists {
+		if list == nil {
+			continue
+		}
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		if r.Group != "" && gv.Group != r.Group {
+			continue
+		}
+		for _, apiResource := range list.APIResources {
+			// Subresources such as deployments/scale can't be watched on their own
+			if strings.Contains(apiResource.Name, "/") || !matchResource(apiResource, r) {
+				continue
+			}
+			if !hasVerbs(apiResource, "list", "watch") {
+				return schema.GroupVersionResource{}, metav1.APIResource{}, fatal(errors.Errorf(
+					"resource %s/%s does not support list and watch", gv.String(), apiResource.Name))
+			}
+			return gv.WithResource(apiResource.Name), apiResource, nil
+		}
+	}
+
+	return schema.GroupVersionResource{}, metav1.APIResource{}, errors.Errorf(
+		"resource %s is not served by the API server yet", describeResource(r))
+}
+
+// describeResource return a human readable representation of the configured resource
+// such as rollouts.argoproj.io/v1alpha1
+func describeResource(r config.Resource) string {
+	name := r.Resource
+	if name == "" {
+		name = r.Kind
+	}
+	if r.Group != "" {
+		name = name + "." + r.Group
+	}
+	if r.Version != "" {
+		name = name + "/" + r.Version
+	}
+	return name
+}
+
+// selectServedResource return the first candidate served by the API server, candidates
+// must be sorted by preference typically from the newest to the oldest version, so that
+// kinds moving across api groups (e.g. extensions/v1beta1 to networking.k8s.io/v1) are
+// transparently watched using the newest version available in the cluster, none served is fatal
+func selectServedResource(d discovery.ServerResourcesInterface, kind string, candidates ...schema.GroupVersionResource) (
+	schema.GroupVersionResource, metav1.APIResource, error) {
+
+	var tried []string
+	for _, gvr := range candidates {
+		tried = append(tried, gvr.GroupVersion().String())
+		list, err := d.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return schema.GroupVersionResource{}, metav1.APIResource{}, errors.Wrapf(
+				err, "discovering resources for %s", gvr.GroupVersion().String())
+		}
+		for _, apiResource := range list.APIResources {
+			if apiResource.Name == gvr.Resource {
+				return gvr, apiResource, nil
+			}
+		}
+	}
+
+	return schema.GroupVersionResource{}, metav1.APIResource{}, fatal(errors.Errorf(
+		"resource %s is not served by the API server in any of %s", kind, strings.Join(tried, ", ")))
+}
@@ -0,0 +1,184 @@
+package resources
+
+import (
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/snebel29/kwatchman/internal/pkg/config"
+)
+
+type fakeDiscovery struct {
+	resources []*metav1.APIResourceList
+	err       error // Returned by group version discovery when given
+}
+
+func (d *fakeDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	for _, list := range d.resources {
+		if list.GroupVersion == groupVersion {
+			return list, nil
+		}
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{}, groupVersion)
+}
+
+func (d *fakeDiscovery) ServerResources() ([]*metav1.APIResourceList, error) {
+	return d.resources, nil
+}
+
+func (d *fakeDiscovery) ServerPreferredResources() ([]*metav1.APIResourceList, error) {
+	return d.resources, nil
+}
+
+func (d *fakeDiscovery) ServerPreferredNamespacedResources() ([]*metav1.APIResourceList, error) {
+	return d.resources, nil
+}
+
+func newFakeDiscovery() *fakeDiscovery {
+	verbs := metav1.Verbs{"get", "list", "watch"}
+	return &fakeDiscovery{
+		resources: []*metav1.APIResourceList{
+			{
+				GroupVersion: "argoproj.io/v1alpha1",
+				APIResources: []metav1.APIResource{
+					{Name: "rollouts", SingularName: "rollout", Kind: "Rollout", Namespaced: true, Verbs: verbs},
+					{Name: "rollouts/status", Kind: "Rollout", Namespaced: true, Verbs: verbs},
+				},
+			},
+			{
+				GroupVersion: "extensions/v1beta1",
+				APIResources: []metav1.APIResource{
+					{Name: "ingresses", SingularName: "ingress", Kind: "Ingress", Namespaced: true, Verbs: verbs},
+				},
+			},
+			{
+				GroupVersion: "networking.k8s.io/v1beta1",
+				APIResources: []metav1.APIResource{
+					{Name: "ingresses", SingularName: "ingress", Kind: "Ingress", Namespaced: true, Verbs: verbs},
+				},
+			},
+			{
+				GroupVersion: "cert-manager.io/v1",
+				APIResources: []metav1.APIResource{
+					{Name: "certificates", SingularName: "certificate", Kind: "Certificate", Namespaced: true, Verbs: verbs},
+					{Name: "clusterissuers", SingularName: "clusterissuer", Kind: "ClusterIssuer", Verbs: verbs},
+					{Name: "challenges", SingularName: "challenge", Kind: "Challenge", Verbs: metav1.Verbs{"get"}},
+				},
+			},
+		},
+	}
+}
+
+func TestDiscoverResource(t *testing.T) {
+	d := newFakeDiscovery()
+
+	type testCase struct {
+		resource   config.Resource
+		gvr        schema.GroupVersionResource
+		namespaced bool
+	}
+
+	tests := []testCase{
+		{
+			config.Resource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"},
+			schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"},
+			true,
+		},
+		{
+			config.Resource{Kind: "Certificate"},
+			schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"},
+			true,
+		},
+		{
+			config.Resource{Kind: "clusterissuer", Group: "cert-manager.io"},
+			schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "clusterissuers"},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		gvr, apiResource, err := discoverResource(d, test.resource)
+		if err != nil {
+			t.Errorf("%s should have been discovered: %s", describeResource(test.resource), err)
+		}
+		if gvr != test.gvr {
+			t.Errorf("%s != %s", gvr.String(), test.gvr.String())
+		}
+		if apiResource.Namespaced != test.namespaced {
+			t.Errorf("%s namespaced should be %t", gvr.String(), test.namespaced)
+		}
+	}
+
+	failing := []config.Resource{
+		{Kind: "Rollout", Group: "cert-manager.io"},
+		{Group: "argoproj.io", Version: "v1", Resource: "rollouts"},
+		{Kind: "Challenge"},
+		{Kind: "Unexistent"},
+	}
+	for _, r := range failing {
+		if _, _, err := discoverResource(d, r); err == nil {
+			t.Errorf("%s should have returned an error", describeResource(r))
+		}
+	}
+
+	// CRDs may be installed later on, resources not served yet are retried
+	for _, r := range []config.Resource{
+		{Group: "argoproj.io", Version: "v1", Resource: "rollouts"},
+		{Kind: "Unexistent"},
+	} {
+		if _, _, err := discoverResource(d, r); isFatal(err) {
+			t.Errorf("%s not served yet should be retried, got %v instead", describeResource(r), err)
+		}
+	}
+}
+
+func TestDescribeResource(t *testing.T) {
+	r := config.Resource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+	expected := "rollouts.argoproj.io/v1alpha1"
+	if describeResource(r) != expected {
+		t.Errorf("%s != %s", describeResource(r), expected)
+	}
+}
+
+func TestSelectServedResource(t *testing.T) {
+	d := newFakeDiscovery()
+	networkingV1 := schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}
+	networkingV1beta1 := schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1beta1", Resource: "ingresses"}
+	extensionsV1beta1 := schema.GroupVersionResource{Group: "extensions", Version: "v1beta1", Resource: "ingresses"}
+
+	gvr, _, err := selectServedResource(d, "ingress", networkingV1, networkingV1beta1, extensionsV1beta1)
+	if err != nil {
+		t.Error(err)
+	}
+	if gvr != networkingV1beta1 {
+		t.Errorf("the newest served version %s should have been selected, got %s instead",
+			networkingV1beta1.String(), gvr.String())
+	}
+
+	gvr, _, err = selectServedResource(d, "ingress", extensionsV1beta1)
+	if err != nil {
+		t.Error(err)
+	}
+	if gvr != extensionsV1beta1 {
+		t.Errorf("%s should have been selected, got %s instead", extensionsV1beta1.String(), gvr.String())
+	}
+
+	if _, _, err := selectServedResource(d, "ingress", networkingV1); !isFatal(err) {
+		t.Errorf("a fatal error should have been returned when no candidate is served, got %v instead", err)
+	}
+
+	notServedResource := schema.GroupVersionResource{Group: "extensions", Version: "v1beta1", Resource: "deployments"}
+	if _, _, err := selectServedResource(d, "deployment", notServedResource); !isFatal(err) {
+		t.Errorf("a fatal error should have been returned when the resource is not served within the group version, got %v instead", err)
+	}
+
+	d.err = apierrors.NewForbidden(schema.GroupResource{}, "", nil)
+	if _, _, err := selectServedResource(d, "ingress", networkingV1beta1); err == nil || isFatal(err) {
+		t.Errorf("discovery failures should be retried, got %v instead", err)
+	}
+}
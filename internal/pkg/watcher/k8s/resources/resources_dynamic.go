@@ -0,0 +1,202 @@
+package resources
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/config"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+// DynamicResourceWatcher watches any resource served by the API, such as CRDs, using the
+// dynamic client, the configured resource (or the served candidate version) is resolved
+// through discovery once Run() is called, retrying until resolved
+type DynamicResourceWatcher struct {
+	sync.Mutex
+	kind       string
+	resource   config.Resource
+	candidates []schema.GroupVersionResource
+	arg        ResourceWatcherArgs
+	rw         watcher.ResourceWatcher
+	events     *watchEvents
+	stopC      chan struct{}
+	shutdown   bool
+}
+
+// NewDynamicWatcherFunc return a resource watcher factory for a resource which
+// is not registered, such as CRDs
+func NewDynamicWatcherFunc(r config.Resource) func(ResourceWatcherArgs) watcher.ResourceWatcher {
+	return func(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+		return newDynamicResourceWatcher(r, arg)
+	}
+}
+
+func newDynamicResourceWatcher(r config.Resource, arg ResourceWatcherArgs) *DynamicResourceWatcher {
+	kind := r.Kind
+	if kind == "" {
+		kind = r.Resource
+	}
+	return &DynamicResourceWatcher{
+		kind:     kind,
+		resource: r,
+		arg:      arg,
+		events:   newWatchEvents(arg, kind, nil),
+		stopC:    make(chan struct{}),
+	}
+}
+
+// newVersionedResourceWatcher return a dynamic resource watcher for registered kinds served under
+// several group versions along k8s releases, candidates are sorted from newest to oldest
+func newVersionedResourceWatcher(
+	kind string, arg ResourceWatcherArgs, candidates ...schema.GroupVersionResource) *DynamicResourceWatcher {
+
+	return &DynamicResourceWatcher{
+		kind:       kind,
+		candidates: candidates,
+		arg:        arg,
+		events:     newWatchEvents(arg, kind, nil),
+		stopC:      make(chan struct{}),
+	}
+}
+
+func (d *DynamicResourceWatcher) resolve() (schema.GroupVersionResource, metav1.APIResource, error) {
+	if len(d.candidates) > 0 {
+		return selectServedResource(d.arg.Clientset.Discovery(), d.kind, d.candidates...)
+	}
+	return discoverResource(d.arg.Clientset.Discovery(), d.resource)
+}
+
+// Run resolves the resource through discovery and runs its resource watcher, which is resolved
+// and run again when it fails unless fatal
+func (d *DynamicResourceWatcher) Run() error {
+	if d.arg.Clientset == nil || d.arg.DynamicClient == nil {
+		return fatal(errors.Errorf("dynamic resource %s requires both clientset and dynamic client", d.kind))
+	}
+
+	for failures := 1; ; failures++ {
+		err := d.run()
+		if err == nil || isFatal(err) {
+			return err
+		}
+		d.events.failed(err)
+
+		select {
+		case <-time.After(retryInterval(failures)):
+		case <-d.stopC:
+			return nil
+		}
+	}
+}
+
+// run resolves the resource and runs its resource watcher until it finishes
+func (d *DynamicResourceWatcher) run() error {
+	var gvr schema.GroupVersionResource
+	var apiResource metav1.APIResource
+	err := retry(d.stopC, d.events, func() error {
+		var err error
+		gvr, apiResource, err = d.resolve()
+		return errors.Wrapf(err, "DynamicResourceWatcher %s", d.kind)
+	})
+	if err == errStopped {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// The resource watchers report their own list and watch failures
+	d.events.recovered()
+	log.Infof("Resource %s served as %s", d.kind, gvr.String())
+
+	d.Lock()
+	if d.shutdown {
+		d.Unlock()
+		return nil
+	}
+	// Cluster scoped objects are watched once with no namespace to be filtered by, while
+	// namespaced ones are watched from every configured namespace
+	argsList := []ResourceWatcherArgs{d.arg.clusterScoped()}
+	if apiResource.Namespaced {
+		if argsList, err = d.arg.perNamespace(); err != nil {
+			d.Unlock()
+			return fatal(errors.Wrapf(err, "DynamicResourceWatcher %s", d.kind))
+		}
+	}
+	var group ResourceWatcherGroup
+	for _, arg := range argsList {
+		group = append(group, newK8sResourceWatcher(
+			d.kind, arg, newResourceHandlerFunc(arg, d.kind), newSyncedFunction(arg, d.kind),
+			newDynamicRetriever(arg, gvr, apiResource.Namespaced)))
+	}
+	d.rw = group
+	if len(group) == 1 {
+		d.rw = group[0]
+	}
+	d.Unlock()
+
+	return d.rw.Run()
+}
+
+// Shutdown stops resolving the resource, and its resource watcher if it was already started
+func (d *DynamicResourceWatcher) Shutdown() {
+	d.Lock()
+	defer d.Unlock()
+	if !d.shutdown {
+		d.shutdown = true
+		close(d.stopC)
+	}
+	if d.rw != nil {
+		d.rw.Shutdown()
+	}
+}
+
+// Ready return an error until the resource has been resolved and synced
+func (d *DynamicResourceWatcher) Ready() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.rw == nil {
+		return errors.Errorf("%s not resolved yet", d.kind)
+	}
+	return checkResourceWatchers([]watcher.ResourceWatcher{d.rw}, watcher.HealthChecker.Ready)
+}
+
+// Live return an error when the resolved resource watch has been disconnected for too long
+func (d *DynamicResourceWatcher) Live() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.rw == nil {
+		return nil
+	}
+	return checkResourceWatchers([]watcher.ResourceWatcher{d.rw}, watcher.HealthChecker.Live)
+}
+
+func newDynamicRetriever(arg ResourceWatcherArgs, gvr schema.GroupVersionResource, namespaced bool) *retrieve.Resource {
+	var resourceInterface dynamic.ResourceInterface = arg.DynamicClient.Resource(gvr)
+	if namespaced {
+		resourceInterface = arg.DynamicClient.Resource(gvr).Namespace(arg.Namespace)
+	}
+
+	retr := &retrieve.Resource{
+		Object: &unstructured.Unstructured{},
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return resourceInterface.List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return resourceInterface.Watch(options)
+			},
+		},
+	}
+	retr.ListerWatcher = arg.listerWatcher(gvr, retr)
+	return retr
+}
@@ -0,0 +1,88 @@
+package resources
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/snebel29/kwatchman/internal/pkg/config"
+)
+
+func TestNewDynamicWatcherFunc(t *testing.T) {
+	fn := NewDynamicWatcherFunc(config.Resource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"})
+	rw, ok := fn(ResourceWatcherArgs{}).(*DynamicResourceWatcher)
+	if !ok {
+		t.Fatal("a *DynamicResourceWatcher should have been returned")
+	}
+	if rw.kind != "rollouts" {
+		t.Errorf("kind should default to the resource name, got %s instead", rw.kind)
+	}
+
+	// Without clients the resource can't be resolved
+	if err := rw.Run(); err == nil {
+		t.Error("Run() should have returned an error")
+	}
+	rw.Shutdown()
+}
+
+func TestGetManifestWithUnstructured(t *testing.T) {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("argoproj.io/v1alpha1")
+	obj.SetKind("Rollout")
+	obj.SetName("app")
+
+	r, err := getManifest(obj)
+	if err != nil {
+		t.Error(err)
+	}
+	expected := `{"apiVersion":"argoproj.io/v1alpha1","kind":"Rollout","metadata":{"name":"app"}}`
+	if string(r) != expected {
+		t.Errorf("%s Should match with %s", string(r), expected)
+	}
+}
+
+func TestGetResourceFuncListFromConfigWithDynamicResources(t *testing.T) {
+	configFile := path.Join(path.Dir(thisFilename), "fixtures", "dynamic-config.toml")
+	os.Args = []string{
+		"kwatchman",
+		fmt.Sprintf("--config=%s", configFile),
+	}
+
+	conf, err := config.NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resourceList, err := GetResourcesFuncListFromConfig(conf)
+	if err != nil {
+		t.Error(err)
+	}
+	expected := 3
+	if len(resourceList) != expected {
+		t.Fatalf("resourceList should have %d resource, have %d instead", expected, len(resourceList))
+	}
+	for _, fn := range resourceList[1:] {
+		if _, ok := fn(ResourceWatcherArgs{}).(*DynamicResourceWatcher); !ok {
+			t.Error("CRDs should be watched by a *DynamicResourceWatcher")
+		}
+	}
+
+	// The dynamic resource watcher is split per namespace once its scope is resolved
+	conf.Resources = config.Resources{{Kind: "Certificate", Namespaces: []string{"a", "b"}}}
+	resourceList, err = GetResourcesFuncListFromConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw, ok := resourceList[0](ResourceWatcherArgs{}).(*DynamicResourceWatcher)
+	if !ok || !reflect.DeepEqual(rw.arg.Namespaces, []string{"a", "b"}) {
+		t.Errorf("a single *DynamicResourceWatcher with the namespaces should be returned, got %#v", rw)
+	}
+
+	conf.Resources = config.Resources{{Group: "argoproj.io"}}
+	if _, err := GetResourcesFuncListFromConfig(conf); err == nil {
+		t.Error("a resource without kind nor resource should have returned an error")
+	}
+}
@@ -0,0 +1,254 @@
+package resources
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/snebel29/kooper/operator/common"
+)
+
+// watchHealth tracks the list and watch connection of a resource watcher, see initialSync
+// for its readiness
+type watchHealth struct {
+	sync.Mutex
+	threshold      time.Duration
+	connected      bool
+	disconnectedAt time.Time
+	failures       int   // Consecutive list and watch failures, reset once watching
+	lastErr        error // Last failure while failures are counted
+	events         map[*watchEvents]bool
+}
+
+func newWatchHealth(threshold time.Duration) *watchHealth {
+	return &watchHealth{threshold: threshold, events: make(map[*watchEvents]bool)}
+}
+
+// listed records the result of a list, which happens on start and whenever the watch
+// can't be resumed, the watch will follow when successful
+func (h *watchHealth) listed(err error) {
+	if err != nil {
+		h.failed(err)
+	}
+}
+
+// watching records the result of a watch request
+func (h *watchHealth) watching(err error) {
+	// An expired resource version is relisted right away, the API server isn't failing
+	if apierrors.IsGone(err) || apierrors.IsResourceExpired(err) {
+		h.disconnected()
+		return
+	}
+	if err != nil {
+		h.failed(err)
+		return
+	}
+	h.Lock()
+	h.connected = true
+	h.failures = 0
+	h.lastErr = nil
+	events := h.subscribed()
+	h.Unlock()
+
+	for _, e := range events {
+		e.recovered()
+	}
+}
+
+// failed records a list or watch failure, unlike a watch closed by the API server, which is
+// resumed right away
+func (h *watchHealth) failed(err error) {
+	h.disconnected()
+	h.Lock()
+	h.failures++
+	h.lastErr = err
+	events := h.subscribed()
+	h.Unlock()
+
+	for _, e := range events {
+		e.failed(err)
+	}
+}
+
+// retryInterval return the time to wait before listing again after consecutive failures
+func (h *watchHealth) retryInterval() time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	return retryInterval(h.failures)
+}
+
+// subscribe the watch events to the failures and recoveries that follow, a failing watch
+// is reported right away
+func (h *watchHealth) subscribe(e *watchEvents) {
+	h.Lock()
+	h.events[e] = true
+	err := h.lastErr
+	h.Unlock()
+
+	if err != nil {
+		e.failed(err)
+	}
+}
+
+func (h *watchHealth) unsubscribe(e *watchEvents) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.events, e)
+}
+
+// subscribed return the watch events subscribed, must be called with the lock held
+func (h *watchHealth) subscribed() []*watchEvents {
+	events := make([]*watchEvents, 0, len(h.events))
+	for e := range h.events {
+		events = append(events, e)
+	}
+	return events
+}
+
+// disconnected records the time since the resource is no longer watched
+func (h *watchHealth) disconnected() {
+	h.Lock()
+	defer h.Unlock()
+	if h.connected || h.disconnectedAt.IsZero() {
+		h.disconnectedAt = time.Now()
+	}
+	h.connected = false
+}
+
+// Live return an error when the watch has been disconnected beyond the threshold, a zero
+// threshold never fails
+func (h *watchHealth) Live() error {
+	h.Lock()
+	defer h.Unlock()
+	if h.threshold == 0 || h.connected || h.disconnectedAt.IsZero() {
+		return nil
+	}
+	if since := time.Since(h.disconnectedAt); since > h.threshold {
+		return errors.Errorf("watch disconnected for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// initialSync tracks the handling of the first list of a resource watcher, which is synced once
+// every listed key has been handled. kooper doesn't expose the HasSynced of its controller, but
+// its workers only start once its informer HasSynced, which happens once the first list has been
+// stored and queued, so no listed key is handled before. The informer watches right after
+// storing the list, which is what an empty list waits for
+type initialSync struct {
+	sync.Mutex
+	listed   bool
+	watched  bool
+	keys     []string
+	pending  map[string]bool
+	synced   bool
+	onSynced func(keys []string) // Called on its own goroutine with the keys of the first list once synced
+}
+
+// list records the keys of the first list
+func (s *initialSync) list(keys []string) {
+	s.Lock()
+	defer s.Unlock()
+	s.listed = true
+	s.keys = keys
+	s.pending = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		s.pending[key] = true
+	}
+	s.check()
+}
+
+// watch records that the first list has been stored, once listed
+func (s *initialSync) watch() {
+	s.Lock()
+	defer s.Unlock()
+	s.watched = s.listed
+	s.check()
+}
+
+// handled records an event of the key handled by the controller
+func (s *initialSync) handled(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.pending, key)
+	s.check()
+}
+
+// check whether synced, must be called with the lock held
+func (s *initialSync) check() {
+	if s.synced || !s.listed || !s.watched || len(s.pending) > 0 {
+		return
+	}
+	s.synced = true
+	if s.onSynced != nil {
+		go s.onSynced(s.keys)
+	}
+}
+
+// track wraps the kooper handler function so that its events are recorded once handled,
+// a nil function is kept nil
+func (s *initialSync) track(fn func(context.Context, *common.K8sEvent) error) func(context.Context, *common.K8sEvent) error {
+	if fn == nil {
+		return nil
+	}
+	return func(ctx context.Context, evt *common.K8sEvent) error {
+		defer s.handled(evt.Key)
+		return fn(ctx, evt)
+	}
+}
+
+// Ready return an error until the initial sync has been completed
+func (s *initialSync) Ready() error {
+	s.Lock()
+	defer s.Unlock()
+	if !s.synced {
+		return errors.New("initial sync not completed")
+	}
+	return nil
+}
+
+// healthWatch proxies a watch recording its disconnection once its result channel is closed
+type healthWatch struct {
+	incoming watch.Interface
+	result   chan watch.Event
+	stopC    chan struct{}
+	stopOnce sync.Once
+}
+
+func newHealthWatch(w watch.Interface, health *watchHealth) watch.Interface {
+	hw := &healthWatch{
+		incoming: w,
+		result:   make(chan watch.Event),
+		stopC:    make(chan struct{}),
+	}
+	go hw.loop(health)
+	return hw
+}
+
+func (hw *healthWatch) loop(health *watchHealth) {
+	defer close(hw.result)
+	defer health.disconnected()
+	for evt := range hw.incoming.ResultChan() {
+		select {
+		case hw.result <- evt:
+		case <-hw.stopC:
+			return
+		}
+	}
+}
+
+// Stop the incoming watch
+func (hw *healthWatch) Stop() {
+	hw.stopOnce.Do(func() {
+		close(hw.stopC)
+		hw.incoming.Stop()
+	})
+}
+
+// ResultChan return the proxied events
+func (hw *healthWatch) ResultChan() <-chan watch.Event {
+	return hw.result
+}
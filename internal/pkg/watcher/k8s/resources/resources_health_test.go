@@ -0,0 +1,169 @@
+package resources
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/config"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+func TestWatchHealth(t *testing.T) {
+	h := newWatchHealth(time.Minute)
+	if h.Live() != nil {
+		t.Error("should be live before being run")
+	}
+
+	h.listed(nil)
+	h.watching(nil)
+	if h.Live() != nil {
+		t.Error("should be live once watching")
+	}
+
+	h.listed(errors.New("connection refused"))
+	if h.Live() != nil {
+		t.Error("should be live while disconnected within the threshold")
+	}
+	h.disconnectedAt = time.Now().Add(-2 * time.Minute)
+	if h.Live() == nil {
+		t.Error("should not be live when disconnected beyond the threshold")
+	}
+	h.disconnected()
+	if h.Live() == nil {
+		t.Error("disconnection time should be kept while still disconnected")
+	}
+
+	h.watching(nil)
+	if h.Live() != nil {
+		t.Error("should be live once watching again")
+	}
+
+	h = newWatchHealth(0)
+	h.disconnectedAt = time.Now().Add(-time.Hour)
+	if h.Live() != nil {
+		t.Error("a zero threshold should never fail")
+	}
+}
+
+func TestInitialSync(t *testing.T) {
+	syncedC := make(chan []string, 2)
+	s := &initialSync{}
+	s.watch()
+	s.handled("default/svc")
+	if s.Ready() == nil {
+		t.Error("should not be ready before the first list")
+	}
+
+	s.list([]string{"default/svc", "default/other"})
+	s.watch()
+	s.handled("default/svc")
+	if s.Ready() == nil {
+		t.Error("should not be ready until every listed key has been handled")
+	}
+	s.onSynced = func(keys []string) {
+		syncedC <- keys
+	}
+	s.handled("default/other")
+	if err := s.Ready(); err != nil {
+		t.Errorf("should be ready once the first list has been handled: %s", err)
+	}
+	select {
+	case keys := <-syncedC:
+		if len(keys) != 2 {
+			t.Errorf("the keys of the first list should have been synced, got %v instead", keys)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the first list should have been synced once handled")
+	}
+	s.handled("default/svc")
+	s.watch()
+	select {
+	case keys := <-syncedC:
+		t.Errorf("the first list should be synced only once, got %v", keys)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s = &initialSync{}
+	s.list(nil)
+	if s.Ready() == nil {
+		t.Error("an empty list should not be ready until stored")
+	}
+	s.watch()
+	if err := s.Ready(); err != nil {
+		t.Errorf("an empty list should be ready once stored: %s", err)
+	}
+}
+
+func TestHealthWatchDisconnection(t *testing.T) {
+	h := newWatchHealth(time.Nanosecond)
+	h.watching(nil)
+
+	fakeWatcher := watch.NewFake()
+	w := newHealthWatch(fakeWatcher, h)
+
+	svc := newFakeService("default")
+	go fakeWatcher.Add(&svc)
+	if evt := <-w.ResultChan(); evt.Type != watch.Added {
+		t.Errorf("events should have been proxied, got %#v instead", evt)
+	}
+
+	fakeWatcher.Stop()
+	if _, ok := <-w.ResultChan(); ok {
+		t.Error("result channel should have been closed")
+	}
+	time.Sleep(time.Millisecond)
+	if h.Live() == nil {
+		t.Error("closed watch should have been recorded as a disconnection")
+	}
+	w.Stop()
+}
+
+func TestK8sResourceWatcherHealth(t *testing.T) {
+	fakeWatcher := watch.NewFake()
+	svc := newFakeService("default")
+	retr := &retrieve.Resource{
+		Object: &corev1.Service{},
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return &corev1.ServiceList{Items: []corev1.Service{svc}}, nil
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return fakeWatcher, nil
+			},
+		},
+	}
+	rw := newTypedResourceWatcher(ResourceWatcherArgs{}, SERVICE, corev1.SchemeGroupVersion.WithResource("services"), retr)
+
+	var hc watcher.HealthChecker = ResourceWatcherGroup{rw}
+	if hc.Ready() == nil {
+		t.Error("resource watcher should not be ready before the initial sync")
+	}
+
+	if _, err := retr.ListerWatcher.List(metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := retr.ListerWatcher.Watch(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if hc.Ready() == nil {
+		t.Error("resource watcher should not be ready until the listed objects have been handled")
+	}
+	rw.(*K8sResourceWatcher).initial.handled("default/svc")
+	if err := hc.Ready(); err != nil {
+		t.Errorf("resource watcher should be ready once the first list has been handled: %s", err)
+	}
+
+	if newDynamicResourceWatcher(config.Resource{Kind: "rollout"}, ResourceWatcherArgs{}).Ready() == nil {
+		t.Error("dynamic resource watcher should not be ready before being resolved")
+	}
+}
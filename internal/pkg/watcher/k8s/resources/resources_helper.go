@@ -5,27 +5,187 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"time"
 
-	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	extensions_v1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	kooper "github.com/snebel29/kooper/operator/common"
 	kooper_handler "github.com/snebel29/kooper/operator/handler"
+	"github.com/snebel29/kooper/operator/retrieve"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/snebel29/kwatchman/internal/pkg/config"
 	"github.com/snebel29/kwatchman/internal/pkg/handler"
+	"github.com/snebel29/kwatchman/internal/pkg/metrics"
 	"github.com/snebel29/kwatchman/internal/pkg/registry"
 	"github.com/snebel29/kwatchman/internal/pkg/watcher"
 )
 
 // ResourceWatcherArgs hold the arguments passed to instantiate resources watchers
 type ResourceWatcherArgs struct {
-	Clientset       kubernetes.Interface
-	Namespace       string
-	LabelSelector   string
-	ChainOfHandlers handler.ChainOfHandlers
+	Cluster           string // Name of the cluster the resources are watched from
+	Clientset         kubernetes.Interface
+	DynamicClient     dynamic.Interface
+	Namespace         string   // Namespace to list and watch from, empty means all namespaces
+	Namespaces        []string // Namespaces or patterns such as prod-* to keep, empty means all
+	ExcludeNamespaces []string // Namespaces or patterns to drop
+	LabelSelector     string
+	FieldSelector     string
+	ChainOfHandlers   handler.ChainOfHandlers
+	LivenessThreshold time.Duration    // Time a watch can be disconnected before failing liveness, zero never fails
+	Context           context.Context  // Cancels the handlers being run, such as on shutdown, nil never cancels
+	SecretSalt        []byte           // Salt of the hashes replacing secret values
+	ResyncInterval    time.Duration    // Time between replays of every object, zero defaults to 30s
+	Workers           int              // Objects handled concurrently, zero defaults to one
+	Informers         *SharedInformers // Lists and watches every resource once, nil makes every watcher list and watch on its own
+}
+
+// forResource return the arguments for an individual configured resource, resource
+// configuration takes precedence over global one
+func (a ResourceWatcherArgs) forResource(r config.Resource) ResourceWatcherArgs {
+	if len(r.Namespaces) > 0 {
+		a.Namespaces = r.Namespaces
+	}
+	if len(r.ExcludeNamespaces) > 0 {
+		a.ExcludeNamespaces = r.ExcludeNamespaces
+	}
+	if r.LabelSelector != "" {
+		a.LabelSelector = r.LabelSelector
+	}
+	if r.FieldSelector != "" {
+		a.FieldSelector = r.FieldSelector
+	}
+	a.ResyncInterval = r.ResyncInterval
+	a.Workers = r.Workers
+	return a
+}
+
+// listerWatcher return the list-watch of the resource applying the configured filters, fed by
+// the shared informer of the resource when given
+func (a ResourceWatcherArgs) listerWatcher(gvr schema.GroupVersionResource, retr *retrieve.Resource) cache.ListerWatcher {
+	if a.Informers == nil {
+		return newResourceListerWatcher(a, retr.ListerWatcher)
+	}
+	return newResourceListerWatcher(a, a.Informers.listerWatcher(a, gvr, retr))
+}
+
+// perNamespace return the arguments for every list-watch needed to watch the namespaces, literal
+// namespaces are listed and watched individually, while patterns and exclusions require to
+// watch cluster wide filtering namespaces client side, an error is returned when every literal
+// namespace is excluded, which would leave nothing to watch
+func (a ResourceWatcherArgs) perNamespace() ([]ResourceWatcherArgs, error) {
+	if len(a.Namespaces) == 0 {
+		return []ResourceWatcherArgs{a}, nil
+	}
+	for _, namespace := range a.Namespaces {
+		if isNamespacePattern(namespace) {
+			a.Namespace = ""
+			return []ResourceWatcherArgs{a}, nil
+		}
+	}
+
+	var argsList []ResourceWatcherArgs
+	for _, namespace := range a.Namespaces {
+		arg := a
+		arg.Namespace = namespace
+		arg.Namespaces = nil
+		arg.ExcludeNamespaces = nil
+		if a.watchesNamespace(namespace) {
+			argsList = append(argsList, arg)
+		}
+	}
+	if len(argsList) == 0 {
+		return nil, errors.Errorf("every namespace of %v is excluded by %v", a.Namespaces, a.ExcludeNamespaces)
+	}
+	return argsList, nil
+}
+
+// clusterScoped return the arguments for cluster scoped resources, which are listed and
+// watched once regardless of the configured namespaces
+func (a ResourceWatcherArgs) clusterScoped() ResourceWatcherArgs {
+	a.Namespace = ""
+	a.Namespaces = nil
+	a.ExcludeNamespaces = nil
+	return a
+}
+
+func (a ResourceWatcherArgs) filtersNamespaces() bool {
+	return len(a.Namespaces) > 0 || len(a.ExcludeNamespaces) > 0
+}
+
+// watchesNamespace return whether objects from the namespace should be watched
+func (a ResourceWatcherArgs) watchesNamespace(namespace string) bool {
+	// Cluster scoped objects have no namespace to filter by
+	if namespace == "" {
+		return true
+	}
+	if len(a.Namespaces) > 0 && !matchNamespace(namespace, a.Namespaces) {
+		return false
+	}
+	return !matchNamespace(namespace, a.ExcludeNamespaces)
+}
+
+// listsKey return whether the object key is within the namespaces listed
+func (a ResourceWatcherArgs) listsKey(key string) bool {
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return false
+	}
+	if a.Namespace != "" && namespace != a.Namespace {
+		return false
+	}
+	return a.watchesNamespace(namespace)
+}
+
+// resourceScope tells whether the objects of a resource live within namespaces or cluster wide
+type resourceScope int
+
+const (
+	namespaced    resourceScope = iota // Listed and watched from the configured namespaces
+	clusterScoped                      // Listed and watched once, regardless of the configured namespaces
+)
+
+// resourceScopes holds the scope of every registered resource
+var resourceScopes = map[string]resourceScope{}
+
+// registerResource registers the resource watcher factory of a resource kind along with its scope
+func registerResource(kind string, scope resourceScope, fn func(ResourceWatcherArgs) watcher.ResourceWatcher) {
+	resourceScopes[kind] = scope
+	registry.Register(registry.RESOURCES, kind, fn)
+}
+
+// withResourceConfig return a resource watcher factory which applies the resource configuration,
+// and groups together the resource watchers of every watched namespace when needed
+func withResourceConfig(
+	fn func(ResourceWatcherArgs) watcher.ResourceWatcher, r config.Resource) func(ResourceWatcherArgs) watcher.ResourceWatcher {
+
+	return func(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+		if resourceScopes[r.Kind] == clusterScoped {
+			if len(r.Namespaces) > 0 || len(r.ExcludeNamespaces) > 0 {
+				log.Warnf("Resource %s is cluster scoped, its namespaces are ignored", r.Kind)
+			}
+			return fn(arg.forResource(r).clusterScoped())
+		}
+		argsList, err := arg.forResource(r).perNamespace()
+		if err != nil {
+			return invalidResourceWatcher{err: errors.Wrapf(err, "resource %s", r.Kind)}
+		}
+		if len(argsList) == 1 {
+			return fn(argsList[0])
+		}
+		var group ResourceWatcherGroup
+		for _, a := range argsList {
+			group = append(group, fn(a))
+		}
+		return group
+	}
 }
 
 func marshal(v interface{}) ([]byte, error) {
@@ -36,22 +196,39 @@ func marshal(v interface{}) ([]byte, error) {
 	return manifest, nil
 }
 
+// withTypeMeta return the object along with its kind and api version, which typed objects lack
+// when decoded from protobuf or listed, the object is copied since it's shared with the informers
+func withTypeMeta(obj runtime.Object) runtime.Object {
+	if !obj.GetObjectKind().GroupVersionKind().Empty() {
+		return obj
+	}
+	gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil || len(gvks) == 0 {
+		return obj
+	}
+	obj = obj.DeepCopyObject()
+	obj.GetObjectKind().SetGroupVersionKind(gvks[0])
+	return obj
+}
+
+// getManifest return the JSON manifest of any k8s object, secrets are only marshaled
+// once redacted so that their values never leak
 func getManifest(obj interface{}) ([]byte, error) {
 	switch v := obj.(type) {
-	case *appsv1.Deployment:
+	case *redactedSecret:
 		return marshal(v)
 
-	case *appsv1.StatefulSet:
-		return marshal(v)
+	case *corev1.Secret:
+		return nil, errors.Errorf("secret %s/%s has not been redacted", v.Namespace, v.Name)
 
-	case *appsv1.DaemonSet:
-		return marshal(v)
-
-	case *corev1.Service:
+	case *unstructured.Unstructured:
+		if v.GetAPIVersion() == "v1" && v.GetKind() == "Secret" {
+			return nil, errors.Errorf("secret %s/%s has not been redacted", v.GetNamespace(), v.GetName())
+		}
 		return marshal(v)
 
-	case *extensions_v1beta1.Ingress:
-		return marshal(v)
+	case runtime.Object:
+		return marshal(withTypeMeta(v))
 
 	default:
 		return nil, fmt.Errorf("unknown type %T for %#v object", obj, obj)
@@ -63,16 +240,21 @@ func getManifest(obj interface{}) ([]byte, error) {
 //the type assertion to fail, downstream Handler functions should apply different
 // logic based on its evt.Kind value
 func newKooperHandlerFunction(
-	chainOfHandlers handler.ChainOfHandlers,
+	arg ResourceWatcherArgs,
 	resourceKind string) func(context.Context, *kooper.K8sEvent) error {
 
-	fn := func(_ context.Context, evt *kooper.K8sEvent) error {
+	fn := func(ctx context.Context, evt *kooper.K8sEvent) error {
 		var err error
 		var manifest []byte
 
 		switch evt.Kind {
 		case "Add", "Update":
-			manifest, err = getManifest(evt.Object)
+			// Secrets are redacted first, their values never reach the handlers
+			obj, err := redactSecrets(evt.Object, arg.SecretSalt)
+			if err != nil {
+				return errors.Wrap(err, "Redact within newKooperHandlerFunction")
+			}
+			manifest, err = getManifest(obj)
 			if err != nil {
 				return errors.Wrap(err, "Marshal within newKooperHandlerFunction")
 			}
@@ -84,9 +266,15 @@ func newKooperHandlerFunction(
 			return fmt.Errorf("unknown evt.Kind %s", evt.Kind)
 		}
 
-		err = chainOfHandlers.Run(nil, &handler.Event{
+		metrics.IncEventReceived(arg.Cluster, resourceKind, evt.Kind)
+
+		ctx, cancel := handlerContext(ctx, arg.Context)
+		defer cancel()
+
+		err = arg.ChainOfHandlers.Run(ctx, &handler.Event{
 			K8sEvt:       evt,
 			RunNext:      true, // Zero value of bool is false, therefore we explicitly set RunNext to true
+			Cluster:      arg.Cluster,
 			ResourceKind: resourceKind,
 			K8sManifest:  manifest,
 			Payload:      []byte{},
@@ -101,15 +289,78 @@ func newKooperHandlerFunction(
 	return fn
 }
 
-func newResourceHandlerFunc(ch handler.ChainOfHandlers, resourceKind string) *kooper_handler.HandlerFunc {
-	fn := newKooperHandlerFunction(ch, resourceKind)
+// handlerContext return the context the handlers run with, derived from the controller
+// one and cancelled as well along with parent, when given
+func handlerContext(ctx, parent context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if parent != nil {
+		if parent.Err() != nil {
+			cancel()
+			return ctx, cancel
+		}
+		go func() {
+			select {
+			case <-parent.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+func newResourceHandlerFunc(arg ResourceWatcherArgs, resourceKind string) *kooper_handler.HandlerFunc {
+	fn := newKooperHandlerFunction(arg, resourceKind)
 	return &kooper_handler.HandlerFunc{
 		AddFunc:    fn,
 		DeleteFunc: fn,
 	}
 }
 
-// GetResourcesFuncListFromConfig return list of resource objects from configuration
+// newSyncedFunction return the function handing the keys of the first list to the chain of
+// handlers, so that they can report the events missed meanwhile, nil without chain of handlers
+func newSyncedFunction(arg ResourceWatcherArgs, resourceKind string) func(context.Context, []string) error {
+	if arg.ChainOfHandlers == nil {
+		return nil
+	}
+	return func(ctx context.Context, keys []string) error {
+		ctx, cancel := handlerContext(ctx, arg.Context)
+		defer cancel()
+
+		return arg.ChainOfHandlers.Synced(ctx, &handler.Listing{
+			Cluster:      arg.Cluster,
+			ResourceKind: resourceKind,
+			Keys:         keys,
+			Contains:     arg.listsKey,
+		})
+	}
+}
+
+// withDynamicResourceConfig return a dynamic resource watcher factory which applies the resource
+// configuration, the scope of the resource is only known once resolved through discovery, so the
+// resource watchers of every watched namespace are created by the dynamic resource watcher itself
+func withDynamicResourceConfig(r config.Resource) func(ResourceWatcherArgs) watcher.ResourceWatcher {
+	fn := NewDynamicWatcherFunc(r)
+	return func(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+		return fn(arg.forResource(r))
+	}
+}
+
+// isRegisteredResource return whether the configured resource refers to a registered resource,
+// any group, version or resource given means the resource has to be watched dynamically instead
+func isRegisteredResource(r config.Resource, registeredResources registry.ItemsRegistry) bool {
+	if r.Group != "" || r.Version != "" || r.Resource != "" {
+		return false
+	}
+	_, ok := registeredResources[r.Kind]
+	return ok
+}
+
+// GetResourcesFuncListFromConfig return list of resource objects from configuration, resources
+// not found in the registry are watched through the dynamic client
 func GetResourcesFuncListFromConfig(c *config.Config) ([]func(ResourceWatcherArgs) watcher.ResourceWatcher, error) {
 	var resourceList []func(ResourceWatcherArgs) watcher.ResourceWatcher
 	registeredResources, ok := registry.GetRegistry(registry.RESOURCES)
@@ -118,18 +369,39 @@ func GetResourcesFuncListFromConfig(c *config.Config) ([]func(ResourceWatcherArg
 	}
 
 	for _, configResource := range c.Resources {
-		if rr, ok := registeredResources[configResource.Kind]; ok {
-			regResource, ok := rr.(func(ResourceWatcherArgs) watcher.ResourceWatcher)
-			if !ok {
-				return nil, errors.Errorf(
-					"resource %s is not of type func() watcher.ResourceWatcher but %T instead", configResource, rr)
+		if !isRegisteredResource(configResource, registeredResources) {
+			if configResource.Kind == "" && configResource.Resource == "" {
+				return nil, errors.Errorf("resource %#v requires either kind or resource", configResource)
 			}
-			resourceList = append(resourceList, regResource)
+			resourceList = append(resourceList, withDynamicResourceConfig(configResource))
+			continue
+		}
+
+		rr := registeredResources[configResource.Kind]
+		regResource, ok := rr.(func(ResourceWatcherArgs) watcher.ResourceWatcher)
+		if !ok {
+			return nil, errors.Errorf(
+				"resource %s is not of type func() watcher.ResourceWatcher but %T instead", configResource.Kind, rr)
 		}
+		if err := validateNamespaces(c, configResource); err != nil {
+			return nil, err
+		}
+		resourceList = append(resourceList, withResourceConfig(regResource, configResource))
 	}
 	return resourceList, nil
 }
 
+// validateNamespaces return an error when a namespaced resource has no namespace left to watch
+// once excluded ones are removed, the scope of dynamic resources is only known once resolved
+func validateNamespaces(c *config.Config, r config.Resource) error {
+	if resourceScopes[r.Kind] == clusterScoped || c.CLI == nil {
+		return nil
+	}
+	arg := ResourceWatcherArgs{Namespaces: c.CLI.Namespaces, ExcludeNamespaces: c.CLI.ExcludeNamespaces}
+	_, err := arg.forResource(r).perNamespace()
+	return errors.Wrapf(err, "resource %s", r.Kind)
+}
+
 // GetResourceWatcherList return the list of configured resources
 func GetResourceWatcherList(
 	resourcesFuncList []func(ResourceWatcherArgs) watcher.ResourceWatcher,
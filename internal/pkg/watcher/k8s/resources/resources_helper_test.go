@@ -1,6 +1,7 @@
 package resources
 
 import (
+	"context"
 	"fmt"
 	"github.com/snebel29/kooper/operator/common"
 	"github.com/snebel29/kwatchman/internal/pkg/config"
@@ -12,7 +13,9 @@ import (
 	"path"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 var thisFilename string
@@ -66,18 +69,41 @@ func TestGetManifest(t *testing.T) {
 		t.Errorf("%s Should match with %s", string(r), expected)
 	}
 
+	// Any k8s object is marshaled, while anything else is not
 	r, err = getManifest(&appsv1.ReplicaSet{})
+	if err != nil {
+		t.Error(err)
+	}
+	r, err = getManifest(&fakeDeployment{})
 	if err == nil {
 		t.Error("err should be error")
 	}
 }
 
+func TestGetManifestWithoutTypeMeta(t *testing.T) {
+	// Objects decoded from protobuf or listed have no kind nor api version
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app"}}
+
+	r, err := getManifest(deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"kind":"Deployment","apiVersion":"apps/v1","metadata":{"name":"app"`
+	if !strings.HasPrefix(string(r), expected) {
+		t.Errorf("%s should start with %s", string(r), expected)
+	}
+	if deployment.Kind != "" {
+		t.Error("the object should have been copied rather than modified")
+	}
+}
+
 func TestNewKooperHandlerFunctionWithAdd(t *testing.T) {
 	h1 := handler.NewMockHandler()
 	chainOfHandlers := handler.NewChainOfHandlers(h1)
-	fn := newKooperHandlerFunction(chainOfHandlers, "Deployment")
+	fn := newKooperHandlerFunction(
+		ResourceWatcherArgs{Cluster: "myCluster", ChainOfHandlers: chainOfHandlers}, "Deployment")
 
-	err := fn(nil, &common.K8sEvent{
+	err := fn(context.Background(), &common.K8sEvent{
 		Kind:      "Add",
 		HasSynced: true,
 		Key:       "default/den-from-neverwhere",
@@ -90,6 +116,9 @@ func TestNewKooperHandlerFunctionWithAdd(t *testing.T) {
 	if h1.Called != true {
 		t.Error("Handler should have been called")
 	}
+	if h1.PassedCluster != "myCluster" {
+		t.Errorf("Cluster should have been passed, got %s instead", h1.PassedCluster)
+	}
 	if reflect.DeepEqual(h1.PassedK8sManifest, []byte{}) {
 		t.Error("No K8sManifest have been set")
 	}
@@ -101,9 +130,10 @@ func TestNewKooperHandlerFunctionWithAdd(t *testing.T) {
 func TestNewKooperHandlerFunctionWithDelete(t *testing.T) {
 	h1 := handler.NewMockHandler()
 	chainOfHandlers := handler.NewChainOfHandlers(h1)
-	fn := newKooperHandlerFunction(chainOfHandlers, "Deployment")
+	fn := newKooperHandlerFunction(
+		ResourceWatcherArgs{Cluster: "myCluster", ChainOfHandlers: chainOfHandlers}, "Deployment")
 
-	err := fn(nil, &common.K8sEvent{
+	err := fn(context.Background(), &common.K8sEvent{
 		Kind:      "Delete",
 		HasSynced: true,
 		Key:       "default/den-from-neverwhere",
@@ -124,6 +154,79 @@ func TestNewKooperHandlerFunctionWithDelete(t *testing.T) {
 	}
 }
 
+func TestNewKooperHandlerFunctionCancelled(t *testing.T) {
+	h1 := handler.NewMockHandler()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fn := newKooperHandlerFunction(
+		ResourceWatcherArgs{ChainOfHandlers: handler.NewChainOfHandlers(h1), Context: ctx}, "Deployment")
+
+	err := fn(context.Background(), &common.K8sEvent{
+		Kind:   "Add",
+		Key:    "default/den-from-neverwhere",
+		Object: NewFakeDeployment(),
+	})
+	if err == nil {
+		t.Error("a cancelled watcher context should stop the handlers")
+	}
+	if h1.Called {
+		t.Error("Handler should not have been called")
+	}
+}
+
+func TestHandlerContext(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := handlerContext(context.Background(), parent)
+	defer cancel()
+
+	cancelParent()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("the handler context should be cancelled along with its parent")
+	}
+
+	ctx, cancel = handlerContext(nil, nil)
+	if ctx.Err() != nil {
+		t.Error("the handler context should not be cancelled before cancel")
+	}
+	cancel()
+	if ctx.Err() == nil {
+		t.Error("the handler context should be cancelled on cancel")
+	}
+}
+
+func TestNewSyncedFunction(t *testing.T) {
+	if newSyncedFunction(ResourceWatcherArgs{}, "Deployment") != nil {
+		t.Error("there should be no synced function without chain of handlers")
+	}
+
+	deleted := &handler.Event{K8sEvt: &common.K8sEvent{Kind: "Delete", Key: "team-a/gone"}, RunNext: true}
+	syncer := handler.NewMockSyncerHandler(deleted)
+	h1 := handler.NewMockHandler()
+	fn := newSyncedFunction(ResourceWatcherArgs{
+		Cluster:         "myCluster",
+		Namespace:       "team-a",
+		ChainOfHandlers: handler.NewChainOfHandlers(syncer, h1),
+	}, "Deployment")
+
+	if err := fn(context.Background(), []string{"team-a/web"}); err != nil {
+		t.Error(err)
+	}
+	listing := syncer.PassedListing
+	if listing == nil || listing.Cluster != "myCluster" || listing.ResourceKind != "Deployment" ||
+		!reflect.DeepEqual(listing.Keys, []string{"team-a/web"}) {
+		t.Fatalf("the listing should have been passed, got %#v instead", listing)
+	}
+	if !listing.Contains("team-a/other") || listing.Contains("team-b/other") {
+		t.Error("the listing should contain only its namespace keys")
+	}
+	if !h1.Called {
+		t.Error("the synced events should have been run")
+	}
+}
+
 func TestGetResourceFuncListFromConfig(t *testing.T) {
 	configFile := path.Join(path.Dir(thisFilename), "fixtures", "config.toml")
 	os.Args = []string{
@@ -0,0 +1,28 @@
+package resources
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+const (
+	// HORIZONTALPODAUTOSCALER const used by registration process
+	HORIZONTALPODAUTOSCALER = "horizontalpodautoscaler"
+)
+
+func init() {
+	registerResource(HORIZONTALPODAUTOSCALER, namespaced, NewHorizontalPodAutoscalerWatcher)
+}
+
+// NewHorizontalPodAutoscalerWatcher return a watcher for k8s horizontal pod autoscalers, autoscaling/v2
+// is served from 1.23 while autoscaling/v2beta2 is removed on 1.26, therefore the newest version served
+// by the cluster is selected through discovery and watched dynamically, autoscaling/v1 lacks most metrics
+func NewHorizontalPodAutoscalerWatcher(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+	return newVersionedResourceWatcher(
+		HORIZONTALPODAUTOSCALER, arg,
+		schema.GroupVersionResource{Group: "autoscaling", Version: "v2", Resource: "horizontalpodautoscalers"},
+		schema.GroupVersionResource{Group: "autoscaling", Version: "v2beta2", Resource: "horizontalpodautoscalers"},
+		schema.GroupVersionResource{Group: "autoscaling", Version: "v1", Resource: "horizontalpodautoscalers"},
+	)
+}
@@ -0,0 +1,607 @@
+package resources
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+)
+
+// SharedInformers lists and watches every resource once per cluster and server side filters,
+// whatever the number of resource watchers consuming it, through client-go shared informers:
+// a SharedInformerFactory per namespace and selectors for typed resources and a
+// dynamicInformerFactory for the ones watched through the dynamic client. Every resource
+// watcher is fed through a list-watch of its own, backed by an event handler of the informer
+type SharedInformers struct {
+	sync.Mutex
+	informers          map[informerKey]*sharedInformer
+	typed              map[factoryKey]informers.SharedInformerFactory
+	dynamic            map[factoryKey]*dynamicInformerFactory
+	stateDir           string        // Where informers persist their state to resume from, empty never persists
+	checkpointInterval time.Duration // Between the states persisted while running
+	checkpointing      bool
+	stopC              chan struct{}
+	stopped            bool
+}
+
+// defaultCheckpointInterval is the time between the states persisted while running, so that a
+// crash resumes from a recent state
+const defaultCheckpointInterval = time.Minute
+
+// informerKey identifies what is listed and watched from the API server, namespaces filtered
+// client side are applied by every resource watcher instead
+type informerKey struct {
+	gvr           schema.GroupVersionResource
+	namespace     string
+	labelSelector string
+	fieldSelector string
+	objectType    reflect.Type
+}
+
+// factoryKey identifies the server side filters shared by the informers of a factory
+type factoryKey struct {
+	namespace     string
+	labelSelector string
+	fieldSelector string
+}
+
+// NewSharedInformers return the shared informers of a cluster, every informer is started
+// along the first resource watcher listing it and runs until Shutdown, when a state directory
+// is given informers persist their objects periodically and on shutdown to resume watching from them
+func NewSharedInformers(stateDir string) *SharedInformers {
+	return &SharedInformers{
+		informers:          make(map[informerKey]*sharedInformer),
+		typed:              make(map[factoryKey]informers.SharedInformerFactory),
+		dynamic:            make(map[factoryKey]*dynamicInformerFactory),
+		stateDir:           stateDir,
+		checkpointInterval: defaultCheckpointInterval,
+		stopC:              make(chan struct{}),
+	}
+}
+
+// Shutdown stops every informer and return once their state is persisted, the resource watchers
+// still consuming them see their watch closed
+func (s *SharedInformers) Shutdown() {
+	s.Lock()
+	defer s.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	close(s.stopC)
+	for _, informer := range s.informers {
+		informer.saveState(false)
+	}
+}
+
+// checkpoint persists the state of every synced informer periodically until shut down, to be
+// relisted since the objects handled by then may lag behind the resource version reached, or be
+// ahead of it
+func (s *SharedInformers) checkpoint() {
+	ticker := time.NewTicker(s.checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stopC:
+			return
+		}
+
+		s.Lock()
+		if !s.stopped {
+			for _, informer := range s.informers {
+				if informer.informer.HasSynced() {
+					informer.saveState(true)
+				}
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// listerWatcher return a list-watch fed by the informer of the resource, created on first use
+// from the resource retriever, which lists and watches with the arguments selectors
+func (s *SharedInformers) listerWatcher(
+	arg ResourceWatcherArgs, gvr schema.GroupVersionResource, retr *retrieve.Resource) cache.ListerWatcher {
+
+	key := informerKey{
+		gvr:           gvr,
+		namespace:     arg.Namespace,
+		labelSelector: arg.LabelSelector,
+		fieldSelector: arg.FieldSelector,
+		objectType:    reflect.TypeOf(retr.Object),
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	informer, ok := s.informers[key]
+	if ok {
+		log.Debugf("Sharing the informer of %s within namespace %q", gvr.String(), arg.Namespace)
+	} else {
+		informer = newSharedInformer(ResourceWatcherArgs{
+			Namespace:         arg.Namespace,
+			LabelSelector:     arg.LabelSelector,
+			FieldSelector:     arg.FieldSelector,
+			LivenessThreshold: arg.LivenessThreshold,
+		}, gvr, retr, newInformerStateFile(s.stateDir, key), s)
+		informer.informer = s.informerFor(arg, key, retr.Object, informer.newInformer)
+		s.informers[key] = informer
+	}
+	view := newConsumerView(arg.listsKey)
+	informer.consumers = append(informer.consumers, view)
+	return &sharedListerWatcher{informer: informer, view: view, handler: newConsumerHandler(view)}
+}
+
+// informerFor return the informer of the factory sharing its filters, typed informers are told
+// apart by their object type while unstructured ones are by their group version resource
+func (s *SharedInformers) informerFor(
+	arg ResourceWatcherArgs, key informerKey, obj runtime.Object, newFunc func() cache.SharedIndexInformer) cache.SharedIndexInformer {
+
+	fk := factoryKey{namespace: key.namespace, labelSelector: key.labelSelector, fieldSelector: key.fieldSelector}
+	if _, ok := obj.(*unstructured.Unstructured); ok {
+		factory, ok := s.dynamic[fk]
+		if !ok {
+			factory = newDynamicInformerFactory()
+			s.dynamic[fk] = factory
+		}
+		return factory.ForResource(key.gvr, newFunc).Informer()
+	}
+
+	factory, ok := s.typed[fk]
+	if !ok {
+		// Its client is unused, every informer lists and watches through its resource retriever
+		factory = informers.NewSharedInformerFactory(arg.Clientset, 0)
+		s.typed[fk] = factory
+	}
+	return factory.InformerFor(obj, func(kubernetes.Interface, time.Duration) cache.SharedIndexInformer {
+		return newFunc()
+	})
+}
+
+// start every informer not started yet, unless already shut down, along with the checkpoints
+// when their state is persisted
+func (s *SharedInformers) start() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.stopped {
+		return false
+	}
+	if s.stateDir != "" && !s.checkpointing {
+		s.checkpointing = true
+		go s.checkpoint()
+	}
+	for _, factory := range s.typed {
+		factory.Start(s.stopC)
+	}
+	for _, factory := range s.dynamic {
+		factory.Start(s.stopC)
+	}
+	return true
+}
+
+// sharedInformer holds a shared informer along with the health of its list-watch, where
+// its state is persisted and what its consumers handled
+type sharedInformer struct {
+	informer  cache.SharedIndexInformer
+	lw        cache.ListerWatcher
+	object    runtime.Object
+	health    *watchHealth
+	state     *informerStateFile
+	informers *SharedInformers
+	consumers []*consumerView // Guarded by the lock of the shared informers
+}
+
+func newSharedInformer(
+	arg ResourceWatcherArgs,
+	gvr schema.GroupVersionResource,
+	retr *retrieve.Resource,
+	state *informerStateFile,
+	informers *SharedInformers) *sharedInformer {
+
+	lw := newResourceListerWatcher(arg, retr.ListerWatcher).(*resourceListerWatcher)
+	lw.stopC = informers.stopC
+	s := &sharedInformer{
+		lw:        lw,
+		object:    retr.Object,
+		health:    lw.health,
+		state:     state,
+		informers: informers,
+	}
+	if state != nil {
+		resumed, relist, err := state.load()
+		if err != nil {
+			log.Warnf("Listing %s since its state can't be resumed: %s", gvr.String(), err)
+		}
+		s.lw = &resumableListerWatcher{lw: lw, gvr: gvr, resumed: resumed, relist: resumed != nil && relist}
+	}
+	return s
+}
+
+// newInformer return the informer listing and watching through the resource list-watch, with
+// no resync since every consumer resyncs on its own
+func (s *sharedInformer) newInformer() cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(s.lw, s.object, 0, cache.Indexers{})
+}
+
+// saveState persists the objects handled by the consumers at the resource version the informer
+// had reached, when they lag behind the stored objects the state is relisted on startup so that
+// the events they didn't handle are compared again, consumers handling a same object differently
+// persist any of them. A checkpoint is always relisted. Must be called with the lock of the shared
+// informers held
+func (s *sharedInformer) saveState(checkpoint bool) {
+	if s.state == nil {
+		return
+	}
+	resourceVersion := s.informer.LastSyncResourceVersion()
+	if resourceVersion == "" {
+		log.Warnf("State of %s not persisted since it was never synced", s.state.key.gvr.String())
+		return
+	}
+
+	stored := make(map[string]runtime.Object)
+	objects := make(map[string]runtime.Object)
+	for _, obj := range s.informer.GetStore().List() {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			continue
+		}
+		stored[key] = obj.(runtime.Object)
+		objects[key] = obj.(runtime.Object)
+	}
+	unhandled := false
+	for _, view := range s.consumers {
+		if view.merge(objects, stored) {
+			unhandled = true
+		}
+	}
+	if unhandled && !checkpoint {
+		log.Infof("State of %s persisted with events not handled, it will be relisted", s.state.key.gvr.String())
+	}
+
+	handled := make([]interface{}, 0, len(objects))
+	for _, obj := range objects {
+		handled = append(handled, obj)
+	}
+	if err := s.state.save(handled, resourceVersion, checkpoint || unhandled); err != nil {
+		log.Errorf("State of %s not persisted: %s", s.state.key.gvr.String(), err)
+	}
+}
+
+// subscribe return the objects of the store along with a watch receiving every change that
+// follows for the consumer, once the informer has been synced.
+//
+// The watch is fed by the event handler of the consumer, buffering its events on its own so that
+// a slow consumer never blocks the others. Client-go v9 can't remove event handlers, every consumer
+// registers a single one on its first list which hands its notifications to the watch of its last
+// list, a stopped watch drops the notifications it's still handed
+func (s *sharedInformer) subscribe(h *consumerHandler) ([]interface{}, string, *sharedWatch, error) {
+	if !s.informers.start() || !cache.WaitForCacheSync(s.informers.stopC, s.informer.HasSynced) {
+		return nil, "", nil, errors.New("shared informer stopped")
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if !h.registered {
+		// A handler joining a running informer is sent the stored objects as added
+		s.informer.AddEventHandler(h)
+		h.registered = true
+	}
+	// The watch catches up with the list until the handler reaches the listed resource version
+	// of every object, the notifications it's still to be handed
+	w := newSharedWatch(h.view)
+	objects := s.informer.GetStore().List()
+	w.listed(objects, h.notified)
+	h.current = w
+	go func() {
+		select {
+		case <-s.informers.stopC:
+			w.Stop()
+		case <-w.done:
+		}
+	}()
+	return objects, s.informer.LastSyncResourceVersion(), w, nil
+}
+
+// consumerHandler is the event handler a consumer registers once with the shared informer, it
+// hands the notifications of the informer to the watch subscribed by the last list of the consumer
+type consumerHandler struct {
+	sync.Mutex
+	view       *consumerView
+	registered bool
+	current    *sharedWatch      // Subscribed by the last list
+	notified   map[string]string // Resource version of every watched object notified and not deleted
+}
+
+func newConsumerHandler(view *consumerView) *consumerHandler {
+	return &consumerHandler{view: view, notified: make(map[string]string)}
+}
+
+// OnAdd hands the object as added
+func (h *consumerHandler) OnAdd(obj interface{}) {
+	h.notify(obj, false)
+}
+
+// OnUpdate hands the object as modified, relisting and resyncing update every object
+func (h *consumerHandler) OnUpdate(old, obj interface{}) {
+	h.notify(obj, false)
+}
+
+// OnDelete hands the object as deleted
+func (h *consumerHandler) OnDelete(obj interface{}) {
+	if deleted, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = deleted.Obj
+	}
+	h.notify(obj, true)
+}
+
+// notify records the object notified and hands it to the current watch, notifications are handed
+// one after the other by the informer
+func (h *consumerHandler) notify(obj interface{}, deleted bool) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Errorf("consumerHandler MetaNamespaceKeyFunc: %s", err)
+		return
+	}
+
+	h.Lock()
+	if deleted {
+		delete(h.notified, key)
+	} else if h.view.watchesKey(key) {
+		h.notified[key] = resourceVersion(obj)
+	}
+	w := h.current
+	h.Unlock()
+
+	if w != nil {
+		w.notify(key, obj, deleted)
+	}
+}
+
+// sharedWatch is the watch of a consumer of the shared informer, it converts the notifications
+// of the informer into the watch events following the list the consumer got
+type sharedWatch struct {
+	sync.Mutex
+	result   chan watch.Event
+	done     chan struct{}
+	ready    chan struct{}     // Closed once listed, notifications wait for it
+	view     *consumerView     // Objects sent to the consumer
+	catchUp  map[string]string // Listed resource version of every object not caught up yet, empty when deleted
+	closed   bool
+	stopOnce sync.Once
+}
+
+func newSharedWatch(view *consumerView) *sharedWatch {
+	return &sharedWatch{
+		result: make(chan watch.Event),
+		done:   make(chan struct{}),
+		ready:  make(chan struct{}),
+		view:   view,
+	}
+}
+
+// listed records the listed objects, given the resource version of the objects already notified,
+// the ones notified at another version are caught up with, notifications are handled from then on
+func (w *sharedWatch) listed(objects []interface{}, notified map[string]string) {
+	w.view.list(objects)
+	w.catchUp = make(map[string]string, len(objects))
+	listed := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil || !w.view.watchesKey(key) {
+			continue
+		}
+		listed[key] = true
+		if version := resourceVersion(obj); version != "" && version != notified[key] {
+			w.catchUp[key] = version
+		}
+	}
+	// Objects notified but no longer listed are still to be notified as deleted
+	for key := range notified {
+		if !listed[key] {
+			w.catchUp[key] = ""
+		}
+	}
+	close(w.ready)
+}
+
+// notify the consumer of the object, notifications are handed one after the other by the
+// informer so catching up needs no lock
+func (w *sharedWatch) notify(key string, obj interface{}, deleted bool) {
+	select {
+	case <-w.ready:
+	case <-w.done:
+		return
+	}
+	object, ok := obj.(runtime.Object)
+	if !ok {
+		log.Errorf("sharedWatch can't send event of unknown type %T", obj)
+		return
+	}
+	version := resourceVersion(obj)
+
+	// Notifications up to the listed version of an object are already known by the consumer
+	if listed, ok := w.catchUp[key]; ok {
+		if !deleted && version != listed {
+			return
+		}
+		delete(w.catchUp, key)
+		if !deleted {
+			return
+		}
+	}
+
+	if !w.view.watchesKey(key) {
+		return
+	}
+	sent := object
+	if deleted {
+		sent = nil
+	}
+	if eventType, ok := w.view.send(key, sent); ok {
+		w.send(watch.Event{Type: eventType, Object: object})
+	}
+}
+
+// send the event blocking until received unless the watch is stopped
+func (w *sharedWatch) send(evt watch.Event) {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.result <- evt:
+	case <-w.done:
+	}
+}
+
+// Stop the watch, unblocking the notification being sent first
+func (w *sharedWatch) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+		w.Lock()
+		defer w.Unlock()
+		w.closed = true
+		close(w.result)
+	})
+}
+
+// ResultChan return the events following the list the watch was subscribed with
+func (w *sharedWatch) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+// sharedListerWatcher lists the store of the shared informer and watches its changes, since
+// changes are only sent to the watches subscribed while listing, a watch can't be resumed
+// without listing again
+type sharedListerWatcher struct {
+	sync.Mutex
+	informer        *sharedInformer
+	view            *consumerView
+	handler         *consumerHandler
+	pending         *sharedWatch // Subscribed by the last list, to be returned by the following watch
+	resourceVersion string       // Of the last list, the following watch resumes from
+}
+
+// List the objects of the shared informer. Selectors were already applied by the shared informer
+// and the store is served whatever the resource version requested, which is what the "0" requested
+// by reflectors means
+func (l *sharedListerWatcher) List(options metav1.ListOptions) (runtime.Object, error) {
+	objects, resourceVersion, w, err := l.informer.subscribe(l.handler)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Lock()
+	if l.pending != nil {
+		l.pending.Stop()
+	}
+	l.pending = w
+	l.resourceVersion = resourceVersion
+	l.Unlock()
+
+	list := &metav1.List{ListMeta: metav1.ListMeta{ResourceVersion: resourceVersion}}
+	items := make([]runtime.Object, 0, len(objects))
+	for _, obj := range objects {
+		items = append(items, obj.(runtime.Object))
+	}
+	if err := meta.SetList(list, items); err != nil {
+		w.Stop()
+		return nil, errors.Wrap(err, "sharedListerWatcher SetList")
+	}
+	return list, nil
+}
+
+// Watch return the watch subscribed by the last list, when resuming from its resource version
+func (l *sharedListerWatcher) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	l.Lock()
+	defer l.Unlock()
+	w := l.pending
+	l.pending = nil
+	if w == nil {
+		return nil, errors.New("shared watch can't be resumed without listing")
+	}
+	if options.ResourceVersion != "" && options.ResourceVersion != l.resourceVersion {
+		w.Stop()
+		return nil, errors.Errorf("shared watch can't be resumed from resource version %s", options.ResourceVersion)
+	}
+	return w, nil
+}
+
+// dynamicInformerFactory shares the informers of the resources watched through the dynamic client,
+// which the typed factory can't tell apart since they are all unstructured. It follows client-go
+// dynamicinformer, only available from client-go v10, keying informers by group version resource
+type dynamicInformerFactory struct {
+	sync.Mutex
+	informers        map[schema.GroupVersionResource]informers.GenericInformer
+	startedInformers map[schema.GroupVersionResource]bool
+}
+
+func newDynamicInformerFactory() *dynamicInformerFactory {
+	return &dynamicInformerFactory{
+		informers:        make(map[schema.GroupVersionResource]informers.GenericInformer),
+		startedInformers: make(map[schema.GroupVersionResource]bool),
+	}
+}
+
+// ForResource return the informer of the resource, created by newFunc on first use
+func (f *dynamicInformerFactory) ForResource(
+	gvr schema.GroupVersionResource, newFunc func() cache.SharedIndexInformer) informers.GenericInformer {
+
+	f.Lock()
+	defer f.Unlock()
+	informer, ok := f.informers[gvr]
+	if !ok {
+		informer = &dynamicInformer{informer: newFunc(), gvr: gvr}
+		f.informers[gvr] = informer
+	}
+	return informer
+}
+
+// Start every informer not started yet
+func (f *dynamicInformerFactory) Start(stopC <-chan struct{}) {
+	f.Lock()
+	defer f.Unlock()
+	for gvr, informer := range f.informers {
+		if !f.startedInformers[gvr] {
+			go informer.Informer().Run(stopC)
+			f.startedInformers[gvr] = true
+		}
+	}
+}
+
+// dynamicInformer is the generic informer of an unstructured resource
+type dynamicInformer struct {
+	informer cache.SharedIndexInformer
+	gvr      schema.GroupVersionResource
+}
+
+func (d *dynamicInformer) Informer() cache.SharedIndexInformer {
+	return d.informer
+}
+
+func (d *dynamicInformer) Lister() cache.GenericLister {
+	return cache.NewGenericLister(d.informer.GetIndexer(), d.gvr.GroupResource())
+}
+
+// resourceVersion return the resource version of the object, empty when unknown
+func resourceVersion(obj interface{}) string {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
+	}
+	return accessor.GetResourceVersion()
+}
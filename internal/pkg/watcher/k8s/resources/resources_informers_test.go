@@ -0,0 +1,396 @@
+package resources
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+)
+
+// fakeServiceRetriever counts the lists and watches reaching the API server
+type fakeServiceRetriever struct {
+	sync.Mutex
+	lists    int
+	watches  int
+	watcher  *watch.FakeWatcher
+	watchErr error            // Returned by the first watch when given
+	versions []string         // Resource versions watched from
+	items    []corev1.Service // Listed instead of the default service when given
+}
+
+func (f *fakeServiceRetriever) retriever() *retrieve.Resource {
+	return &retrieve.Resource{
+		Object: &corev1.Service{},
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				f.Lock()
+				defer f.Unlock()
+				f.lists++
+				existing := newFakeService("default")
+				existing.ResourceVersion = "1"
+				items := []corev1.Service{existing}
+				if f.items != nil {
+					items = f.items
+				}
+				return &corev1.ServiceList{
+					ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+					Items:    items,
+				}, nil
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				f.Lock()
+				defer f.Unlock()
+				f.watches++
+				f.versions = append(f.versions, options.ResourceVersion)
+				if err := f.watchErr; err != nil {
+					f.watchErr = nil
+					return nil, err
+				}
+				return f.watcher, nil
+			},
+		},
+	}
+}
+
+func (f *fakeServiceRetriever) calls() (int, int) {
+	f.Lock()
+	defer f.Unlock()
+	return f.lists, f.watches
+}
+
+func newFakeServiceVersion(namespace, name, resourceVersion string) *corev1.Service {
+	svc := newFakeService(namespace)
+	svc.Name = name
+	svc.ResourceVersion = resourceVersion
+	return &svc
+}
+
+func receiveEvent(t *testing.T, w watch.Interface) watch.Event {
+	select {
+	case evt := <-w.ResultChan():
+		return evt
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a watch event")
+	}
+	return watch.Event{}
+}
+
+func TestSharedInformersListAndWatchOnce(t *testing.T) {
+	informers := NewSharedInformers("")
+	defer informers.Shutdown()
+
+	fake := &fakeServiceRetriever{watcher: watch.NewFake()}
+	gvr := corev1.SchemeGroupVersion.WithResource("services")
+	arg := ResourceWatcherArgs{LabelSelector: "app=myApp"}
+
+	var watches []watch.Interface
+	for i := 0; i < 2; i++ {
+		lw := informers.listerWatcher(arg, gvr, fake.retriever())
+		list, err := lw.List(metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 || items[0].(*corev1.Service).Name != "svc" {
+			t.Errorf("the informer objects should have been listed, got %#v instead", items)
+		}
+		w, err := lw.Watch(metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+		watches = append(watches, w)
+	}
+
+	if lists, watchCalls := fake.calls(); lists != 1 || watchCalls != 1 {
+		t.Errorf("the resource should have been listed and watched once, got %d lists and %d watches", lists, watchCalls)
+	}
+
+	// A resync of an unchanged object is not sent, any change is sent to every consumer
+	fake.watcher.Modify(newFakeServiceVersion("default", "svc", "1"))
+	fake.watcher.Add(newFakeServiceVersion("default", "other", "2"))
+	fake.watcher.Delete(newFakeServiceVersion("default", "svc", "3"))
+	for _, w := range watches {
+		// Events keep their order per object only
+		events := map[string]watch.EventType{}
+		for i := 0; i < 2; i++ {
+			evt := receiveEvent(t, w)
+			events[evt.Object.(*corev1.Service).Name] = evt.Type
+		}
+		if events["other"] != watch.Added || events["svc"] != watch.Deleted {
+			t.Errorf("the added and deleted services should have been sent, got %v instead", events)
+		}
+	}
+}
+
+func TestSharedInformersKeys(t *testing.T) {
+	informers := NewSharedInformers("")
+	defer informers.Shutdown()
+
+	fake := &fakeServiceRetriever{watcher: watch.NewFake()}
+	gvr := corev1.SchemeGroupVersion.WithResource("services")
+	shared := informers.listerWatcher(ResourceWatcherArgs{}, gvr, fake.retriever()).(*sharedListerWatcher)
+
+	for _, arg := range []ResourceWatcherArgs{
+		{Namespace: "default"},
+		{LabelSelector: "app=myApp"},
+		{FieldSelector: "metadata.name!=myName"},
+	} {
+		lw := informers.listerWatcher(arg, gvr, fake.retriever()).(*sharedListerWatcher)
+		if lw.informer == shared.informer {
+			t.Errorf("%#v should have its own informer", arg)
+		}
+	}
+
+	// Client side filters are applied by every consumer on the same informer
+	lw := informers.listerWatcher(
+		ResourceWatcherArgs{ExcludeNamespaces: []string{"kube-system"}}, gvr, fake.retriever()).(*sharedListerWatcher)
+	if lw.informer != shared.informer {
+		t.Error("namespaces filtered client side should share the informer")
+	}
+}
+
+func TestSharedInformersDynamicKeys(t *testing.T) {
+	informers := NewSharedInformers("")
+	defer informers.Shutdown()
+
+	retr := &retrieve.Resource{Object: &unstructured.Unstructured{}, ListerWatcher: &cache.ListWatch{}}
+	rollouts := schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+	lw := informers.listerWatcher(ResourceWatcherArgs{}, rollouts, retr).(*sharedListerWatcher)
+	other := informers.listerWatcher(
+		ResourceWatcherArgs{}, rollouts.GroupVersion().WithResource("analysisruns"), retr).(*sharedListerWatcher)
+	if lw.informer.informer == other.informer.informer {
+		t.Error("unstructured resources should have an informer of their own")
+	}
+	again := informers.listerWatcher(ResourceWatcherArgs{}, rollouts, retr).(*sharedListerWatcher)
+	if lw.informer.informer != again.informer.informer {
+		t.Error("the informer of a resource should be shared")
+	}
+}
+
+func TestSharedInformersSlowConsumer(t *testing.T) {
+	informers := NewSharedInformers("")
+	defer informers.Shutdown()
+
+	fake := &fakeServiceRetriever{watcher: watch.NewFake()}
+	gvr := corev1.SchemeGroupVersion.WithResource("services")
+	var watches []watch.Interface
+	for i := 0; i < 2; i++ {
+		lw := informers.listerWatcher(ResourceWatcherArgs{}, gvr, fake.retriever())
+		if _, err := lw.List(metav1.ListOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		w, err := lw.Watch(metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+		watches = append(watches, w)
+	}
+
+	// The first consumer never receives, the second one still gets every event in order
+	for i := 2; i < 12; i++ {
+		fake.watcher.Add(newFakeServiceVersion("default", fmt.Sprintf("svc-%d", i), fmt.Sprint(i)))
+	}
+	for i := 2; i < 12; i++ {
+		evt := receiveEvent(t, watches[1])
+		if name := evt.Object.(*corev1.Service).Name; name != fmt.Sprintf("svc-%d", i) {
+			t.Fatalf("svc-%d should have been received, got %s instead", i, name)
+		}
+	}
+	if evt := receiveEvent(t, watches[0]); evt.Object.(*corev1.Service).Name != "svc-2" {
+		t.Errorf("the slow consumer should have its events buffered, got %#v instead", evt.Object)
+	}
+}
+
+func TestSharedWatchCatchUp(t *testing.T) {
+	h := newConsumerHandler(newConsumerView(func(string) bool { return true }))
+	w := newSharedWatch(h.view)
+	defer w.Stop()
+	w.listed([]interface{}{
+		newFakeServiceVersion("default", "svc", "3"),
+		newFakeServiceVersion("default", "unversioned", ""),
+	}, h.notified)
+	h.current = w
+
+	received := make(chan watch.Event, 10)
+	go func() {
+		for evt := range w.ResultChan() {
+			received <- evt
+		}
+	}()
+	// Stale notifications of listed objects are dropped until their listed version
+	h.OnAdd(newFakeServiceVersion("default", "svc", "2"))
+	h.OnUpdate(nil, newFakeServiceVersion("default", "svc", "3"))
+	h.OnUpdate(nil, newFakeServiceVersion("default", "svc", "3"))
+	h.OnAdd(newFakeServiceVersion("default", "other", "4"))
+	h.OnUpdate(nil, newFakeServiceVersion("default", "svc", "5"))
+	h.OnDelete(cache.DeletedFinalStateUnknown{Key: "default/other", Obj: newFakeServiceVersion("default", "other", "4")})
+
+	for _, expected := range []struct {
+		eventType watch.EventType
+		name      string
+	}{{watch.Added, "other"}, {watch.Modified, "svc"}, {watch.Deleted, "other"}} {
+		select {
+		case evt := <-received:
+			if evt.Type != expected.eventType || evt.Object.(*corev1.Service).Name != expected.name {
+				t.Errorf("%s %s should have been sent, got %s %s instead",
+					expected.eventType, expected.name, evt.Type, evt.Object.(*corev1.Service).Name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s %s should have been sent", expected.eventType, expected.name)
+		}
+	}
+	select {
+	case evt := <-received:
+		t.Errorf("no other event should have been sent, got %#v", evt)
+	default:
+	}
+}
+
+// countingInformer counts the event handlers added to the informer
+type countingInformer struct {
+	cache.SharedIndexInformer
+	sync.Mutex
+	handlers int
+}
+
+func (c *countingInformer) AddEventHandler(handler cache.ResourceEventHandler) {
+	c.Lock()
+	c.handlers++
+	c.Unlock()
+	c.SharedIndexInformer.AddEventHandler(handler)
+}
+
+func TestSharedListerWatcherRelist(t *testing.T) {
+	informers := NewSharedInformers("")
+	defer informers.Shutdown()
+
+	fake := &fakeServiceRetriever{watcher: watch.NewFake()}
+	lw := informers.listerWatcher(
+		ResourceWatcherArgs{}, corev1.SchemeGroupVersion.WithResource("services"), fake.retriever()).(*sharedListerWatcher)
+	counting := &countingInformer{SharedIndexInformer: lw.informer.informer}
+	lw.informer.informer = counting
+
+	listAndWatch := func() watch.Interface {
+		if _, err := lw.List(metav1.ListOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		w, err := lw.Watch(metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	// Changes notified before relisting are listed, the ones that follow are sent once
+	w := listAndWatch()
+	fake.watcher.Modify(newFakeServiceVersion("default", "svc", "2"))
+	if evt := receiveEvent(t, w); evt.Type != watch.Modified {
+		t.Errorf("the modified service should have been sent, got %s instead", evt.Type)
+	}
+	for i := 0; i < 3; i++ {
+		w.Stop()
+		w = listAndWatch()
+	}
+	defer w.Stop()
+	fake.watcher.Modify(newFakeServiceVersion("default", "svc", "3"))
+	if evt := receiveEvent(t, w); evt.Type != watch.Modified || resourceVersion(evt.Object) != "3" {
+		t.Errorf("the service modified after relisting should have been sent, got %s %#v instead", evt.Type, evt.Object)
+	}
+
+	counting.Lock()
+	defer counting.Unlock()
+	if counting.handlers != 1 {
+		t.Errorf("the consumer should have registered a single event handler, got %d instead", counting.handlers)
+	}
+}
+
+func TestSharedListerWatcherRequiresList(t *testing.T) {
+	informers := NewSharedInformers("")
+	fake := &fakeServiceRetriever{watcher: watch.NewFake()}
+	lw := informers.listerWatcher(
+		ResourceWatcherArgs{}, corev1.SchemeGroupVersion.WithResource("services"), fake.retriever())
+
+	if _, err := lw.Watch(metav1.ListOptions{}); err == nil {
+		t.Error("watching without listing should return an error")
+	}
+
+	if _, err := lw.List(metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := lw.Watch(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lw.Watch(metav1.ListOptions{}); err == nil {
+		t.Error("a watch can't be resumed without listing again")
+	}
+	list, err := lw.List(metav1.ListOptions{ResourceVersion: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed, _ := meta.ListAccessor(list)
+	if _, err := lw.Watch(metav1.ListOptions{ResourceVersion: "5"}); err == nil || listed.GetResourceVersion() != "1" {
+		t.Errorf("a watch should only be resumed from the listed resource version %s", listed.GetResourceVersion())
+	}
+
+	// Shutting down closes the consumer watches and fails any further list
+	informers.Shutdown()
+	select {
+	case _, ok := <-w.ResultChan():
+		if ok {
+			t.Error("no event should have been sent")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the watch should have been closed on shutdown")
+	}
+	if _, err := lw.List(metav1.ListOptions{}); err == nil {
+		t.Error("listing a stopped informer should return an error")
+	}
+}
+
+func TestSharedResourceListerWatcherHealth(t *testing.T) {
+	informers := NewSharedInformers("")
+	defer informers.Shutdown()
+
+	fake := &fakeServiceRetriever{watcher: watch.NewFake()}
+	arg := ResourceWatcherArgs{Informers: informers, ExcludeNamespaces: []string{"kube-system"}}
+	lw := arg.listerWatcher(corev1.SchemeGroupVersion.WithResource("services"), fake.retriever()).(*resourceListerWatcher)
+	shared := lw.lw.(*sharedListerWatcher)
+	if !lw.shared || lw.health != shared.informer.health {
+		t.Error("the health of the shared informer should have been reported")
+	}
+
+	if _, err := lw.List(metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := lw.Watch(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if err := lw.health.Live(); err != nil {
+		t.Error(err)
+	}
+
+	fake.watcher.Add(newFakeServiceVersion("kube-system", "excluded", "2"))
+	fake.watcher.Add(newFakeServiceVersion("default", "watched", "3"))
+	if evt := receiveEvent(t, w); evt.Object.(*corev1.Service).Name != "watched" {
+		t.Errorf("events from excluded namespaces should have been dropped, got %#v instead", evt.Object)
+	}
+}
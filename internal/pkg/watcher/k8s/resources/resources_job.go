@@ -0,0 +1,43 @@
+package resources
+
+import (
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+const (
+	// JOB const used by registration process
+	JOB = "job"
+)
+
+func init() {
+	registerResource(JOB, namespaced, NewJobWatcher)
+}
+
+// NewJobWatcher return a watcher for k8s jobs
+func NewJobWatcher(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+
+	resourceKind := JOB
+
+	retr := &retrieve.Resource{
+		Object: &batchv1.Job{},
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return arg.Clientset.BatchV1().Jobs(arg.Namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return arg.Clientset.BatchV1().Jobs(arg.Namespace).Watch(options)
+			},
+		},
+	}
+
+	return newTypedResourceWatcher(
+		arg, resourceKind, batchv1.SchemeGroupVersion.WithResource("jobs"), retr)
+}
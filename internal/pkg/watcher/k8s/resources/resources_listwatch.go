@@ -0,0 +1,181 @@
+package resources
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// resourceListerWatcher wraps resources ListerWatcher applying the configured label and field
+// selectors server side, and filtering namespaces client side when they can't be expressed
+// as a single namespace to list from, it also tracks the list and watch health, which is the one
+// of the shared informer when wrapping its list-watch, and backs off listing after failures
+type resourceListerWatcher struct {
+	arg        ResourceWatcherArgs
+	lw         cache.ListerWatcher
+	health     *watchHealth
+	shared     bool
+	stopC      <-chan struct{} // Interrupts the backoff, closed once the informer is stopped
+	listedOnce sync.Once
+	initial    *initialSync // Records the first list and the watch following it, if any
+}
+
+func newResourceListerWatcher(arg ResourceWatcherArgs, lw cache.ListerWatcher) cache.ListerWatcher {
+	if s, ok := lw.(*sharedListerWatcher); ok {
+		return &resourceListerWatcher{arg: arg, lw: lw, health: s.informer.health, shared: true}
+	}
+	return &resourceListerWatcher{arg: arg, lw: lw, health: newWatchHealth(arg.LivenessThreshold)}
+}
+
+func (r *resourceListerWatcher) listOptions(options metav1.ListOptions) metav1.ListOptions {
+	options.LabelSelector = r.arg.LabelSelector
+	options.FieldSelector = r.arg.FieldSelector
+	return options
+}
+
+// List the resources keeping only the ones within the watched namespaces
+func (r *resourceListerWatcher) List(options metav1.ListOptions) (runtime.Object, error) {
+	if err := r.backoff(); err != nil {
+		return nil, err
+	}
+	list, err := r.lw.List(r.listOptions(options))
+	if !r.shared {
+		r.health.listed(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.arg.filtersNamespaces() {
+		if list, err = r.filterList(list); err != nil {
+			return nil, err
+		}
+	}
+
+	r.listedOnce.Do(func() {
+		r.listed(list)
+	})
+	return list, nil
+}
+
+// backoff waits before listing again after list or watch failures, the informer already waits
+// a second in between which doesn't spare an API server failing to serve every watcher at once
+func (r *resourceListerWatcher) backoff() error {
+	if r.shared {
+		return nil
+	}
+	interval := r.health.retryInterval()
+	if interval == 0 {
+		return nil
+	}
+	log.Debugf("Listing again in %s", interval)
+	select {
+	case <-time.After(interval):
+		return nil
+	case <-r.stopC:
+		return errStopped
+	}
+}
+
+// listed hands the keys of the listed objects to the initial sync, if any
+func (r *resourceListerWatcher) listed(list runtime.Object) {
+	if r.initial == nil {
+		return
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		log.Errorf("resourceListerWatcher ExtractList: %s", err)
+		return
+	}
+
+	keys := make([]string, 0, len(items))
+	for _, item := range items {
+		key, err := cache.MetaNamespaceKeyFunc(item)
+		if err != nil {
+			log.Errorf("resourceListerWatcher MetaNamespaceKeyFunc: %s", err)
+			return
+		}
+		keys = append(keys, key)
+	}
+	r.initial.list(keys)
+}
+
+// filterList keeps only the objects within the watched namespaces
+func (r *resourceListerWatcher) filterList(list runtime.Object) (runtime.Object, error) {
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, errors.Wrap(err, "resourceListerWatcher ExtractList")
+	}
+
+	var filtered []runtime.Object
+	for _, item := range items {
+		if r.watchesObject(item) {
+			filtered = append(filtered, item)
+		}
+	}
+
+	if err := meta.SetList(list, filtered); err != nil {
+		return nil, errors.Wrap(err, "resourceListerWatcher SetList")
+	}
+	return list, nil
+}
+
+// Watch the resources dropping events from non watched namespaces
+func (r *resourceListerWatcher) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	if r.initial != nil {
+		r.initial.watch()
+	}
+	w, err := r.lw.Watch(r.listOptions(options))
+	if !r.shared {
+		r.health.watching(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.shared {
+		w = newHealthWatch(w, r.health)
+	}
+	if !r.arg.filtersNamespaces() {
+		return w, nil
+	}
+
+	return watch.Filter(w, func(in watch.Event) (watch.Event, bool) {
+		if in.Type == watch.Error {
+			return in, true
+		}
+		return in, r.watchesObject(in.Object)
+	}), nil
+}
+
+func (r *resourceListerWatcher) watchesObject(obj runtime.Object) bool {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return true
+	}
+	return r.arg.watchesNamespace(accessor.GetNamespace())
+}
+
+// matchNamespace return whether the namespace matches any of the given patterns such as prod-*
+func matchNamespace(namespace string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, namespace); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isNamespacePattern return whether the namespace is a pattern rather than a literal namespace
+func isNamespacePattern(namespace string) bool {
+	return strings.ContainsAny(namespace, "*?[\\")
+}
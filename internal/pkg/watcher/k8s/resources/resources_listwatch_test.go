@@ -0,0 +1,232 @@
+package resources
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kwatchman/internal/pkg/cli"
+	"github.com/snebel29/kwatchman/internal/pkg/config"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+func newFakeService(namespace string) corev1.Service {
+	return corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: namespace}}
+}
+
+func TestResourceWatcherArgsForResource(t *testing.T) {
+	global := ResourceWatcherArgs{Namespaces: []string{"global"}, LabelSelector: "global=true"}
+
+	arg := global.forResource(config.Resource{Kind: "service"})
+	if !reflect.DeepEqual(arg.Namespaces, []string{"global"}) || arg.LabelSelector != "global=true" {
+		t.Errorf("global arguments should have been kept, got %#v instead", arg)
+	}
+
+	arg = global.forResource(config.Resource{
+		Kind:              "service",
+		Namespaces:        []string{"prod-*"},
+		ExcludeNamespaces: []string{"prod-sandbox"},
+		LabelSelector:     "app=myApp",
+		FieldSelector:     "metadata.name!=myName",
+	})
+	if !reflect.DeepEqual(arg.Namespaces, []string{"prod-*"}) || !arg.filtersNamespaces() {
+		t.Errorf("resource namespaces should take precedence, got %#v instead", arg)
+	}
+	if arg.LabelSelector != "app=myApp" || arg.FieldSelector != "metadata.name!=myName" {
+		t.Errorf("resource selectors should take precedence, got %#v instead", arg)
+	}
+
+	type testCase struct {
+		namespace string
+		watched   bool
+	}
+	for _, test := range []testCase{{"prod-eu", true}, {"prod-sandbox", false}, {"dev", false}, {"", true}} {
+		if arg.watchesNamespace(test.namespace) != test.watched {
+			t.Errorf("namespace %q should be watched: %t", test.namespace, test.watched)
+		}
+	}
+}
+
+func TestResourceWatcherArgsPerNamespace(t *testing.T) {
+	argsList, err := ResourceWatcherArgs{}.perNamespace()
+	if err != nil || len(argsList) != 1 || argsList[0].Namespace != "" || argsList[0].filtersNamespaces() {
+		t.Errorf("all namespaces should be watched with a single list-watch, got %#v instead", argsList)
+	}
+
+	argsList, err = ResourceWatcherArgs{
+		Namespaces:        []string{"team-a", "team-b", "kube-system"},
+		ExcludeNamespaces: []string{"kube-*"},
+	}.perNamespace()
+	if err != nil || len(argsList) != 2 {
+		t.Fatalf("there should be one list-watch per non excluded namespace, got %#v instead", argsList)
+	}
+	for i, namespace := range []string{"team-a", "team-b"} {
+		if argsList[i].Namespace != namespace || argsList[i].filtersNamespaces() {
+			t.Errorf("namespace %s should be listed directly, got %#v instead", namespace, argsList[i])
+		}
+	}
+
+	argsList, err = ResourceWatcherArgs{
+		Namespaces:        []string{"team-a", "prod-*"},
+		ExcludeNamespaces: []string{"prod-sandbox"},
+	}.perNamespace()
+	if err != nil || len(argsList) != 1 || argsList[0].Namespace != "" || !argsList[0].filtersNamespaces() {
+		t.Errorf("namespace patterns should be filtered client side, got %#v instead", argsList)
+	}
+
+	argsList, err = ResourceWatcherArgs{ExcludeNamespaces: []string{"kube-system"}}.perNamespace()
+	if err != nil || len(argsList) != 1 || argsList[0].Namespace != "" || !argsList[0].filtersNamespaces() {
+		t.Errorf("excluded namespaces should be filtered client side, got %#v instead", argsList)
+	}
+
+	_, err = ResourceWatcherArgs{
+		Namespaces:        []string{"kube-system", "kube-public"},
+		ExcludeNamespaces: []string{"kube-*"},
+	}.perNamespace()
+	if err == nil {
+		t.Error("excluding every namespace should be a configuration error")
+	}
+}
+
+func TestWithResourceConfig(t *testing.T) {
+	fn := withResourceConfig(NewDeploymentWatcher, config.Resource{Kind: DEPLOYMENT})
+	if _, ok := fn(ResourceWatcherArgs{}).(*K8sResourceWatcher); !ok {
+		t.Error("a single resource watcher should be returned when watching all namespaces")
+	}
+
+	fn = withResourceConfig(NewDeploymentWatcher, config.Resource{Kind: DEPLOYMENT, Namespaces: []string{"a", "b"}})
+	group, ok := fn(ResourceWatcherArgs{}).(ResourceWatcherGroup)
+	if !ok || len(group) != 2 {
+		t.Errorf("a resource watcher per namespace should be returned, got %#v instead", group)
+	}
+
+	// Cluster scoped resources are watched once regardless of the namespaces
+	var passedArgs ResourceWatcherArgs
+	fn = withResourceConfig(func(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+		passedArgs = arg
+		return NewClusterRoleWatcher(arg)
+	}, config.Resource{Kind: CLUSTERROLE, Namespaces: []string{"a", "b"}})
+	if _, ok := fn(ResourceWatcherArgs{ExcludeNamespaces: []string{"c"}}).(*K8sResourceWatcher); !ok {
+		t.Error("a single resource watcher should be returned for cluster scoped resources")
+	}
+	if passedArgs.Namespace != "" || passedArgs.filtersNamespaces() {
+		t.Errorf("cluster scoped resources should not be filtered by namespace, got %#v", passedArgs)
+	}
+
+	fn = withResourceConfig(NewDeploymentWatcher, config.Resource{Kind: DEPLOYMENT, Namespaces: []string{"a"}})
+	if err := fn(ResourceWatcherArgs{ExcludeNamespaces: []string{"a"}}).Run(); !isFatal(err) {
+		t.Errorf("a resource with every namespace excluded should fail to run, got %v instead", err)
+	}
+}
+
+func TestValidateNamespaces(t *testing.T) {
+	c := &config.Config{CLI: &cli.Args{ExcludeNamespaces: []string{"kube-*"}}}
+	if err := validateNamespaces(c, config.Resource{Kind: DEPLOYMENT, Namespaces: []string{"kube-system"}}); err == nil {
+		t.Error("a namespaced resource with every namespace excluded should be invalid")
+	}
+	if err := validateNamespaces(c, config.Resource{Kind: CLUSTERROLE, Namespaces: []string{"kube-system"}}); err != nil {
+		t.Errorf("cluster scoped resources ignore their namespaces, got %v", err)
+	}
+	if err := validateNamespaces(c, config.Resource{Kind: DEPLOYMENT, Namespaces: []string{"default"}}); err != nil {
+		t.Errorf("a namespace left to watch should be valid, got %v", err)
+	}
+}
+
+func TestResourceListerWatcher(t *testing.T) {
+	var passedOptions metav1.ListOptions
+	fakeWatcher := watch.NewFake()
+
+	lw := newResourceListerWatcher(
+		ResourceWatcherArgs{
+			ExcludeNamespaces: []string{"kube-system"},
+			LabelSelector:     "app=myApp",
+			FieldSelector:     "metadata.name!=myName",
+		},
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				passedOptions = options
+				return &corev1.ServiceList{
+					Items: []corev1.Service{newFakeService("default"), newFakeService("kube-system")},
+				}, nil
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return fakeWatcher, nil
+			},
+		})
+
+	list, err := lw.List(metav1.ListOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	if passedOptions.LabelSelector != "app=myApp" || passedOptions.FieldSelector != "metadata.name!=myName" {
+		t.Errorf("selectors should have been passed, got %#v instead", passedOptions)
+	}
+	services := list.(*corev1.ServiceList).Items
+	if len(services) != 1 || services[0].Namespace != "default" {
+		t.Errorf("only default namespace services should have been listed, got %#v instead", services)
+	}
+
+	w, err := lw.Watch(metav1.ListOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	defer w.Stop()
+
+	go func() {
+		excluded := newFakeService("kube-system")
+		fakeWatcher.Add(&excluded)
+		watched := newFakeService("default")
+		fakeWatcher.Add(&watched)
+	}()
+
+	evt := <-w.ResultChan()
+	if evt.Object.(*corev1.Service).Namespace != "default" {
+		t.Errorf("events from excluded namespaces should have been dropped, got %#v instead", evt.Object)
+	}
+}
+
+func TestResourceListerWatcherFirstList(t *testing.T) {
+	lists := 0
+	lw := newResourceListerWatcher(
+		ResourceWatcherArgs{ExcludeNamespaces: []string{"kube-system"}},
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				lists++
+				if lists > 1 {
+					return &corev1.ServiceList{Items: []corev1.Service{newFakeService("team-a")}}, nil
+				}
+				return &corev1.ServiceList{
+					Items: []corev1.Service{newFakeService("default"), newFakeService("kube-system")},
+				}, nil
+			},
+		}).(*resourceListerWatcher)
+	lw.initial = &initialSync{}
+
+	for i := 0; i < 2; i++ {
+		if _, err := lw.List(metav1.ListOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(lw.initial.keys, []string{"default/svc"}) {
+		t.Errorf("only the watched keys of the first list should have been passed, got %v instead", lw.initial.keys)
+	}
+}
+
+func TestResourceWatcherArgsListsKey(t *testing.T) {
+	arg := ResourceWatcherArgs{Namespace: "team-a"}
+	if !arg.listsKey("team-a/svc") || arg.listsKey("team-b/svc") {
+		t.Error("only the keys within the listed namespace should be listed")
+	}
+
+	arg = ResourceWatcherArgs{Namespaces: []string{"prod-*"}, ExcludeNamespaces: []string{"prod-sandbox"}}
+	for key, listed := range map[string]bool{"prod-eu/svc": true, "prod-sandbox/svc": false, "dev/svc": false, "node": true} {
+		if arg.listsKey(key) != listed {
+			t.Errorf("key %s should be listed: %t", key, listed)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package resources
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+const (
+	// NAMESPACE const used by registration process
+	NAMESPACE = "namespace"
+)
+
+func init() {
+	registerResource(NAMESPACE, clusterScoped, NewNamespaceWatcher)
+}
+
+// NewNamespaceWatcher return a watcher for k8s namespaces, which are cluster scoped
+func NewNamespaceWatcher(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+
+	resourceKind := NAMESPACE
+
+	retr := &retrieve.Resource{
+		Object: &corev1.Namespace{},
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return arg.Clientset.CoreV1().Namespaces().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return arg.Clientset.CoreV1().Namespaces().Watch(options)
+			},
+		},
+	}
+
+	return newTypedResourceWatcher(
+		arg, resourceKind, corev1.SchemeGroupVersion.WithResource("namespaces"), retr)
+}
@@ -0,0 +1,43 @@
+package resources
+
+import (
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+const (
+	// NETWORKPOLICY const used by registration process
+	NETWORKPOLICY = "networkpolicy"
+)
+
+func init() {
+	registerResource(NETWORKPOLICY, namespaced, NewNetworkPolicyWatcher)
+}
+
+// NewNetworkPolicyWatcher return a watcher for k8s network policies
+func NewNetworkPolicyWatcher(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+
+	resourceKind := NETWORKPOLICY
+
+	retr := &retrieve.Resource{
+		Object: &networkingv1.NetworkPolicy{},
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return arg.Clientset.NetworkingV1().NetworkPolicies(arg.Namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return arg.Clientset.NetworkingV1().NetworkPolicies(arg.Namespace).Watch(options)
+			},
+		},
+	}
+
+	return newTypedResourceWatcher(
+		arg, resourceKind, networkingv1.SchemeGroupVersion.WithResource("networkpolicies"), retr)
+}
@@ -0,0 +1,27 @@
+package resources
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+const (
+	// PODDISRUPTIONBUDGET const used by registration process
+	PODDISRUPTIONBUDGET = "poddisruptionbudget"
+)
+
+func init() {
+	registerResource(PODDISRUPTIONBUDGET, namespaced, NewPodDisruptionBudgetWatcher)
+}
+
+// NewPodDisruptionBudgetWatcher return a watcher for k8s pod disruption budgets, policy/v1 is served
+// from 1.21 while policy/v1beta1 is removed on 1.25, therefore the newest version served by the
+// cluster is selected through discovery and watched dynamically
+func NewPodDisruptionBudgetWatcher(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+	return newVersionedResourceWatcher(
+		PODDISRUPTIONBUDGET, arg,
+		schema.GroupVersionResource{Group: "policy", Version: "v1", Resource: "poddisruptionbudgets"},
+		schema.GroupVersionResource{Group: "policy", Version: "v1beta1", Resource: "poddisruptionbudgets"},
+	)
+}
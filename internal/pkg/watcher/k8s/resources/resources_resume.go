@@ -0,0 +1,355 @@
+package resources
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/common"
+)
+
+// informerState is what an informer persists periodically and on shutdown to resume on startup,
+// the objects its consumers handled at the resource version it had reached
+type informerState struct {
+	Key             string
+	ResourceVersion string
+	Objects         []json.RawMessage
+	Relist          bool // The objects lag behind the resource version, which can't be resumed from
+}
+
+// informerStateFile persists the state of an informer within the state directory, secrets are
+// never persisted since informers hold their values
+type informerStateFile struct {
+	key  informerKey
+	path string
+}
+
+// newInformerStateFile return the state file of the informer, nil when it isn't persisted
+func newInformerStateFile(dir string, key informerKey) *informerStateFile {
+	if dir == "" || key.gvr == corev1.SchemeGroupVersion.WithResource("secrets") {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(key.String()))
+	return &informerStateFile{key: key, path: filepath.Join(dir, hex.EncodeToString(sum[:])+".json")}
+}
+
+func (k informerKey) String() string {
+	return fmt.Sprintf("%s namespace=%q labelSelector=%q fieldSelector=%q type=%s",
+		k.gvr.String(), k.namespace, k.labelSelector, k.fieldSelector, k.objectType)
+}
+
+// load the persisted objects and resource version, nil when there is nothing to resume from, along
+// with whether the resource has to be relisted. The file is kept until a new state replaces it but
+// flagged to be relisted, so that a crash never resumes twice from the same resource version, which
+// would skip the events handled meanwhile, but compares a list against the last state persisted
+func (f *informerStateFile) load() (*metav1.List, bool, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "informerStateFile load")
+	}
+
+	var state informerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, false, errors.Wrapf(err, "informerStateFile load %s", f.path)
+	}
+	if state.Key != f.key.String() || state.ResourceVersion == "" {
+		return nil, false, nil
+	}
+	if !state.Relist {
+		relisted := state
+		relisted.Relist = true
+		if err := f.write(relisted); err != nil {
+			return nil, false, errors.Wrap(err, "informerStateFile load")
+		}
+	}
+
+	items := make([]runtime.Object, 0, len(state.Objects))
+	for _, raw := range state.Objects {
+		obj := reflect.New(f.key.objectType.Elem()).Interface().(runtime.Object)
+		if err := json.Unmarshal(raw, obj); err != nil {
+			return nil, false, errors.Wrapf(err, "informerStateFile load %s", f.path)
+		}
+		items = append(items, obj)
+	}
+
+	list := &metav1.List{ListMeta: metav1.ListMeta{ResourceVersion: state.ResourceVersion}}
+	if err := meta.SetList(list, items); err != nil {
+		return nil, false, errors.Wrap(err, "informerStateFile SetList")
+	}
+	return list, state.Relist, nil
+}
+
+// save the objects along with the resource version they are at, replacing the file at once
+func (f *informerStateFile) save(objects []interface{}, resourceVersion string, relist bool) error {
+	state := informerState{Key: f.key.String(), ResourceVersion: resourceVersion, Relist: relist}
+	for _, obj := range objects {
+		raw, err := json.Marshal(obj)
+		if err != nil {
+			return errors.Wrap(err, "informerStateFile save")
+		}
+		state.Objects = append(state.Objects, raw)
+	}
+	return errors.Wrap(f.write(state), "informerStateFile save")
+}
+
+// write the state, replacing the file at once so that the last state written is kept on failure
+func (f *informerStateFile) write(state informerState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// resumableListerWatcher serves the first list from the persisted state when there is one, so
+// that the watch resumes from the persisted resource version with no list at all, once the
+// resource version is gone the informer relists from the API server, comparing the listed
+// objects against the persisted ones, as it does right away when the state has to be relisted.
+//
+// Watch bookmarks would keep the resource version of quiet resources from expiring, but the
+// ListOptions of the client-go version in use can't request them
+type resumableListerWatcher struct {
+	sync.Mutex
+	lw      cache.ListerWatcher
+	gvr     schema.GroupVersionResource
+	resumed *metav1.List // Served by the first list only
+	relist  bool         // The watch following the resumed list fails as gone
+}
+
+func (r *resumableListerWatcher) List(options metav1.ListOptions) (runtime.Object, error) {
+	r.Lock()
+	resumed := r.resumed
+	r.resumed = nil
+	r.Unlock()
+
+	if resumed != nil {
+		log.Infof("Resuming %s from resource version %s", r.gvr.String(), resumed.ResourceVersion)
+		return resumed, nil
+	}
+	return r.lw.List(options)
+}
+
+func (r *resumableListerWatcher) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	r.Lock()
+	relist := r.relist
+	r.relist = false
+	r.Unlock()
+
+	if relist {
+		log.Infof("Relisting %s since events of its persisted state weren't handled", r.gvr.String())
+		return nil, apierrors.NewResourceExpired(fmt.Sprintf("events after %s not handled", options.ResourceVersion))
+	}
+	w, err := r.lw.Watch(options)
+	if err != nil {
+		r.gone(options.ResourceVersion, err)
+		return nil, err
+	}
+	return watch.Filter(w, func(in watch.Event) (watch.Event, bool) {
+		if in.Type == watch.Error {
+			r.gone(options.ResourceVersion, apierrors.FromObject(in.Object))
+		}
+		return in, true
+	}), nil
+}
+
+// gone logs when the resource version is no longer available, the informer relists then
+func (r *resumableListerWatcher) gone(resourceVersion string, err error) {
+	if apierrors.IsGone(err) || apierrors.IsResourceExpired(err) {
+		log.Warnf("Resource version %s of %s is gone, relisting: %s", resourceVersion, r.gvr.String(), err)
+	}
+}
+
+// consumerView is what a consumer of a shared informer was sent and handled, so that the state
+// persisted on shutdown never skips the events it didn't handle, either still buffered, queued or
+// dropped. Objects sent are pending until handled, the last object handled being persisted
+// meanwhile, nil when none was
+type consumerView struct {
+	sync.Mutex
+	watchesKey func(key string) bool
+	listed     bool
+	objects    map[string]runtime.Object // Sent to the consumer
+	pending    map[string]*pendingObject
+}
+
+// pendingObject is the object last handled by a consumer and the one it was sent last
+type pendingObject struct {
+	handled runtime.Object
+	sent    runtime.Object
+}
+
+func newConsumerView(watchesKey func(key string) bool) *consumerView {
+	return &consumerView{
+		watchesKey: watchesKey,
+		objects:    make(map[string]runtime.Object),
+		pending:    make(map[string]*pendingObject),
+	}
+}
+
+// list records the listed objects as sent, the ones changed since the objects previously sent
+// are pending, which the whole first list is
+func (v *consumerView) list(objects []interface{}) {
+	v.Lock()
+	defer v.Unlock()
+	listed := make(map[string]runtime.Object, len(objects))
+	for _, obj := range objects {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil || !v.watchesKey(key) {
+			continue
+		}
+		listed[key] = obj.(runtime.Object)
+	}
+	for key, obj := range v.objects {
+		if _, ok := listed[key]; !ok {
+			v.sent(key, obj, nil)
+		}
+	}
+	for key, obj := range listed {
+		if !sameObject(v.objects[key], obj) {
+			v.sent(key, v.objects[key], obj)
+		}
+	}
+	v.objects = listed
+	v.listed = true
+}
+
+// send records the object sent, nil when deleted, return the watch event to send if any
+func (v *consumerView) send(key string, obj runtime.Object) (watch.EventType, bool) {
+	v.Lock()
+	defer v.Unlock()
+	known, exists := v.objects[key]
+	eventType := watch.Added
+	switch {
+	case obj == nil && !exists:
+		return "", false
+	case obj == nil:
+		eventType = watch.Deleted
+		delete(v.objects, key)
+	case exists && resourceVersion(known) != "" && sameObject(known, obj):
+		return "", false
+	case exists:
+		eventType = watch.Modified
+	}
+	if obj != nil {
+		v.objects[key] = obj
+	}
+	v.sent(key, known, obj)
+	return eventType, true
+}
+
+// sent records the object as pending, handled being what was sent before when not pending
+// already, must be called with the lock held
+func (v *consumerView) sent(key string, handled, obj runtime.Object) {
+	p, ok := v.pending[key]
+	if !ok {
+		p = &pendingObject{handled: handled}
+		v.pending[key] = p
+	}
+	p.sent = obj
+}
+
+// handled records the object handled, nil when deleted, it's no longer pending once the last
+// object sent is handled
+func (v *consumerView) handled(key string, obj runtime.Object) {
+	v.Lock()
+	defer v.Unlock()
+	p, ok := v.pending[key]
+	if !ok {
+		return
+	}
+	if sameObject(p.sent, obj) {
+		delete(v.pending, key)
+		return
+	}
+	p.handled = obj
+}
+
+// track wraps the kooper handler function so that its successful events are recorded as handled,
+// kooper only passes the object of added events, a nil function is kept nil
+func (v *consumerView) track(fn func(context.Context, *common.K8sEvent) error) func(context.Context, *common.K8sEvent) error {
+	if fn == nil {
+		return nil
+	}
+	return func(ctx context.Context, evt *common.K8sEvent) error {
+		if err := fn(ctx, evt); err != nil {
+			return err
+		}
+		v.handled(evt.Key, evt.Object)
+		return nil
+	}
+}
+
+// merge the objects handled by the consumer into the stored objects, return whether any differ
+func (v *consumerView) merge(objects map[string]runtime.Object, stored map[string]runtime.Object) bool {
+	v.Lock()
+	defer v.Unlock()
+	if !v.listed {
+		return false
+	}
+	keys := make(map[string]bool, len(stored))
+	for key := range stored {
+		keys[key] = v.watchesKey(key)
+	}
+	for key := range v.objects {
+		keys[key] = true
+	}
+	for key := range v.pending {
+		keys[key] = true
+	}
+
+	differ := false
+	for key, watched := range keys {
+		if !watched {
+			continue
+		}
+		handled := v.objects[key]
+		if p, ok := v.pending[key]; ok {
+			handled = p.handled
+		}
+		if sameObject(handled, stored[key]) {
+			continue
+		}
+		differ = true
+		if handled == nil {
+			delete(objects, key)
+		} else {
+			objects[key] = handled
+		}
+	}
+	return differ
+}
+
+// sameObject return whether both objects are missing or at the same resource version
+func sameObject(a, b runtime.Object) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return resourceVersion(a) == resourceVersion(b)
+}
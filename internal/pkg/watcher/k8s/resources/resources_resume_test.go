@@ -0,0 +1,331 @@
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newStateDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kwatchman-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestInformerStateFile(t *testing.T) {
+	dir := newStateDir(t)
+	defer os.RemoveAll(dir)
+
+	key := informerKey{
+		gvr:        corev1.SchemeGroupVersion.WithResource("services"),
+		objectType: reflect.TypeOf(&corev1.Service{}),
+	}
+	f := newInformerStateFile(dir, key)
+	if list, _, err := f.load(); list != nil || err != nil {
+		t.Errorf("nothing should be resumed without a state, got %#v, err: %v", list, err)
+	}
+
+	if err := f.save([]interface{}{newFakeServiceVersion("default", "svc", "5")}, "7", false); err != nil {
+		t.Fatal(err)
+	}
+	list, relist, err := f.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, _ := meta.ExtractList(list)
+	if list.ResourceVersion != "7" || len(items) != 1 || items[0].(*corev1.Service).ResourceVersion != "5" || relist {
+		t.Errorf("the persisted objects should have been loaded to be resumed, got %#v", list)
+	}
+	// A state is resumed once only, it's kept to be relisted until replaced
+	list, relist, err = f.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := meta.ExtractList(list); len(items) != 1 || !relist {
+		t.Errorf("the state should have been kept to be relisted once loaded, got %#v", list)
+	}
+
+	// Another informer never resumes from it, neither secrets are persisted
+	other := key
+	other.labelSelector = "app=myApp"
+	if f.path == newInformerStateFile(dir, other).path {
+		t.Error("every informer should be persisted on its own")
+	}
+	if newInformerStateFile("", key) != nil {
+		t.Error("nothing should be persisted without a state directory")
+	}
+	key.gvr = corev1.SchemeGroupVersion.WithResource("secrets")
+	if newInformerStateFile(dir, key) != nil {
+		t.Error("secrets should never be persisted")
+	}
+}
+
+func TestInformerStateFileUnstructured(t *testing.T) {
+	dir := newStateDir(t)
+	defer os.RemoveAll(dir)
+
+	f := newInformerStateFile(dir, informerKey{
+		gvr:        corev1.SchemeGroupVersion.WithResource("rollouts"),
+		objectType: reflect.TypeOf(&unstructured.Unstructured{}),
+	})
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("argoproj.io/v1alpha1")
+	obj.SetKind("Rollout")
+	obj.SetName("app")
+	if err := f.save([]interface{}{obj}, "3", false); err != nil {
+		t.Fatal(err)
+	}
+	list, _, err := f.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, _ := meta.ExtractList(list)
+	if len(items) != 1 || !reflect.DeepEqual(items[0], obj) {
+		t.Errorf("the persisted object should have been loaded, got %#v", items)
+	}
+}
+
+func TestConsumerView(t *testing.T) {
+	v := newConsumerView(func(key string) bool { return key != "kube-system/svc" })
+	stored := map[string]runtime.Object{
+		"default/svc":     newFakeServiceVersion("default", "svc", "1"),
+		"kube-system/svc": newFakeServiceVersion("kube-system", "svc", "1"),
+	}
+	objects := map[string]runtime.Object{}
+	if v.merge(objects, stored) || len(objects) != 0 {
+		t.Error("a consumer which never listed has nothing to merge")
+	}
+
+	// The first list is pending until handled, other namespaces are ignored
+	v.list([]interface{}{stored["default/svc"], stored["kube-system/svc"]})
+	if !v.merge(objects, stored) || len(objects) != 0 {
+		t.Errorf("nothing should have been handled yet, got %v", objects)
+	}
+	v.handled("default/svc", stored["default/svc"])
+	if v.merge(objects, stored) {
+		t.Error("the handled objects should be the stored ones")
+	}
+
+	// Sent objects are pending, the object handled before being merged meanwhile
+	eventType, ok := v.send("default/svc", newFakeServiceVersion("default", "svc", "2"))
+	if !ok || eventType != watch.Modified {
+		t.Errorf("the service should have been sent as modified, got %s", eventType)
+	}
+	if _, ok := v.send("default/svc", newFakeServiceVersion("default", "svc", "2")); ok {
+		t.Error("an unchanged object should not be sent")
+	}
+	v.send("default/other", newFakeServiceVersion("default", "other", "3"))
+	v.send("default/svc", nil)
+	stored = map[string]runtime.Object{"default/other": newFakeServiceVersion("default", "other", "3")}
+	objects = map[string]runtime.Object{"default/other": stored["default/other"]}
+	if !v.merge(objects, stored) || len(objects) != 1 || resourceVersion(objects["default/svc"]) != "1" {
+		t.Errorf("only the service handled before should have been merged, got %v", objects)
+	}
+
+	// Handling an object sent before the last one keeps it pending
+	v.handled("default/other", newFakeServiceVersion("default", "other", "3"))
+	v.handled("default/svc", newFakeServiceVersion("default", "svc", "2"))
+	objects = map[string]runtime.Object{"default/other": stored["default/other"]}
+	if !v.merge(objects, stored) || resourceVersion(objects["default/svc"]) != "2" {
+		t.Errorf("the last handled service should have been merged, got %v", objects)
+	}
+	v.handled("default/svc", nil)
+	if v.merge(objects, stored) {
+		t.Error("every sent object should have been handled")
+	}
+}
+
+// runSharedInformer lists and watches the services through the shared informers, the listed
+// services are handled right away
+func runSharedInformer(t *testing.T, informers *SharedInformers, fake *fakeServiceRetriever) (
+	keys []string, w watch.Interface, view *consumerView) {
+
+	lw := informers.listerWatcher(
+		ResourceWatcherArgs{}, corev1.SchemeGroupVersion.WithResource("services"), fake.retriever())
+	list, err := lw.List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	view = lw.(*sharedListerWatcher).view
+	items, _ := meta.ExtractList(list)
+	for _, item := range items {
+		key, _ := cache.MetaNamespaceKeyFunc(item)
+		keys = append(keys, key)
+		view.handled(key, item)
+	}
+	if w, err = lw.Watch(metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return keys, w, view
+}
+
+// handleEvent receives the next event of the watch and handles it
+func handleEvent(t *testing.T, w watch.Interface, view *consumerView) watch.Event {
+	evt := receiveEvent(t, w)
+	key, _ := cache.MetaNamespaceKeyFunc(evt.Object)
+	if evt.Type == watch.Deleted {
+		view.handled(key, nil)
+	} else {
+		view.handled(key, evt.Object)
+	}
+	return evt
+}
+
+func TestSharedInformersResume(t *testing.T) {
+	dir := newStateDir(t)
+	defer os.RemoveAll(dir)
+
+	// The first run lists, then a service is added, handled and persisted on shutdown
+	informers := NewSharedInformers(dir)
+	fake := &fakeServiceRetriever{watcher: watch.NewFake()}
+	_, w, view := runSharedInformer(t, informers, fake)
+	fake.watcher.Add(newFakeServiceVersion("default", "other", "2"))
+	handleEvent(t, w, view)
+	informers.Shutdown()
+
+	// The second run resumes the watch with no list
+	informers = NewSharedInformers(dir)
+	defer informers.Shutdown()
+	resumed := &fakeServiceRetriever{watcher: watch.NewFake()}
+	keys, w, _ := runSharedInformer(t, informers, resumed)
+	defer w.Stop()
+
+	if !reflect.DeepEqual(keys, []string{"default/other", "default/svc"}) &&
+		!reflect.DeepEqual(keys, []string{"default/svc", "default/other"}) {
+		t.Errorf("the persisted services should have been listed, got %v instead", keys)
+	}
+	resumed.Lock()
+	defer resumed.Unlock()
+	if resumed.lists != 0 || !reflect.DeepEqual(resumed.versions, []string{"2"}) {
+		t.Errorf("the watch should have been resumed from 2 with no list, got %d lists watching from %v",
+			resumed.lists, resumed.versions)
+	}
+}
+
+func TestSharedInformersRelistWhenGone(t *testing.T) {
+	dir := newStateDir(t)
+	defer os.RemoveAll(dir)
+
+	informers := NewSharedInformers(dir)
+	fake := &fakeServiceRetriever{watcher: watch.NewFake()}
+	_, w, view := runSharedInformer(t, informers, fake)
+	fake.watcher.Add(newFakeServiceVersion("default", "removed", "2"))
+	handleEvent(t, w, view)
+	informers.Shutdown()
+
+	// The resource version is gone, the relisted services are compared against the persisted ones
+	informers = NewSharedInformers(dir)
+	defer informers.Shutdown()
+	resumed := &fakeServiceRetriever{
+		watcher:  watch.NewFake(),
+		watchErr: apierrors.NewResourceExpired("too old resource version: 2 (5)"),
+	}
+	_, w, _ = runSharedInformer(t, informers, resumed)
+	defer w.Stop()
+
+	evt := receiveEvent(t, w)
+	if evt.Type != watch.Deleted || evt.Object.(*corev1.Service).Name != "removed" {
+		t.Errorf("the service removed meanwhile should have been deleted, got %#v instead", evt)
+	}
+	if lists, _ := resumed.calls(); lists != 1 {
+		t.Errorf("the resource should have been relisted once, got %d lists", lists)
+	}
+}
+
+func TestSharedInformersRelistUnhandled(t *testing.T) {
+	dir := newStateDir(t)
+	defer os.RemoveAll(dir)
+
+	// The added service is received but never handled before shutting down
+	informers := NewSharedInformers(dir)
+	fake := &fakeServiceRetriever{watcher: watch.NewFake()}
+	_, w, _ := runSharedInformer(t, informers, fake)
+	added := newFakeServiceVersion("default", "other", "2")
+	fake.watcher.Add(added)
+	receiveEvent(t, w)
+	informers.Shutdown()
+
+	// The persisted state lags behind, it's relisted rather than resumed from 2
+	informers = NewSharedInformers(dir)
+	defer informers.Shutdown()
+	existing := newFakeService("default")
+	existing.ResourceVersion = "1"
+	resumed := &fakeServiceRetriever{watcher: watch.NewFake(), items: []corev1.Service{existing, *added}}
+	keys, w, _ := runSharedInformer(t, informers, resumed)
+	defer w.Stop()
+	if !reflect.DeepEqual(keys, []string{"default/svc"}) {
+		t.Errorf("only the handled service should have been resumed, got %v instead", keys)
+	}
+
+	evt := receiveEvent(t, w)
+	if evt.Type != watch.Added || evt.Object.(*corev1.Service).Name != "other" {
+		t.Errorf("the service never handled should have been added again, got %#v instead", evt)
+	}
+	if lists, _ := resumed.calls(); lists != 1 {
+		t.Errorf("the resource should have been relisted once, got %d lists", lists)
+	}
+}
+
+func TestSharedInformersCheckpoint(t *testing.T) {
+	dir := newStateDir(t)
+	defer os.RemoveAll(dir)
+
+	// The added service is handled and persisted by a checkpoint, then kwatchman crashes
+	informers := NewSharedInformers(dir)
+	defer informers.Shutdown()
+	informers.checkpointInterval = 10 * time.Millisecond
+	fake := &fakeServiceRetriever{watcher: watch.NewFake()}
+	_, w, view := runSharedInformer(t, informers, fake)
+	defer w.Stop()
+	fake.watcher.Add(newFakeServiceVersion("default", "removed", "2"))
+	handleEvent(t, w, view)
+
+	f := newInformerStateFile(dir, informerKey{
+		gvr:        corev1.SchemeGroupVersion.WithResource("services"),
+		objectType: reflect.TypeOf(&corev1.Service{}),
+	})
+	deadline := time.Now().Add(time.Second)
+	for {
+		list, relist, err := f.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list != nil {
+			if items, _ := meta.ExtractList(list); len(items) == 2 && relist {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the handled services should have been persisted to be relisted, got %#v", list)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The checkpoint is relisted and compared against the listed services
+	restarted := NewSharedInformers(dir)
+	defer restarted.Shutdown()
+	resumed := &fakeServiceRetriever{watcher: watch.NewFake()}
+	_, rw, _ := runSharedInformer(t, restarted, resumed)
+	defer rw.Stop()
+
+	evt := receiveEvent(t, rw)
+	if evt.Type != watch.Deleted || evt.Object.(*corev1.Service).Name != "removed" {
+		t.Errorf("the service removed meanwhile should have been deleted, got %#v instead", evt)
+	}
+	if lists, _ := resumed.calls(); lists != 1 {
+		t.Errorf("the resource should have been relisted once, got %d lists", lists)
+	}
+}
@@ -0,0 +1,206 @@
+package resources
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/snebel29/kooper/operator/common"
+	"github.com/snebel29/kwatchman/internal/pkg/handler"
+)
+
+// Retries wait the initial interval after the first failure, doubling after every
+// consecutive failure up to the max interval
+const (
+	initialRetryInterval = time.Second
+	maxRetryInterval     = 2 * time.Minute
+)
+
+// errStopped is returned by retry when the resource watcher is stopped meanwhile
+var errStopped = errors.New("stopped while retrying")
+
+// fatalError is an error retrying can't recover from, such as a resource not served by the
+// API server, which stops kwatchman rather than leaving a resource silently unwatched
+type fatalError struct {
+	error
+}
+
+// fatal flags the error as fatal, wrapping it further keeps it fatal
+func fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fatalError{err}
+}
+
+// isFatal return whether the error, or the one it wraps, is fatal
+func isFatal(err error) bool {
+	_, ok := errors.Cause(err).(fatalError)
+	return ok
+}
+
+// IsFatal return whether a resource watcher failed with an error it can't recover from, any
+// other error returned by its Run is retried by running it again
+func IsFatal(err error) bool {
+	return isFatal(err)
+}
+
+// RetryInterval return the time to wait after the given number of consecutive failures
+func RetryInterval(failures int) time.Duration {
+	return retryInterval(failures)
+}
+
+// retryInterval return the time to wait after the given number of consecutive failures
+func retryInterval(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	interval := initialRetryInterval
+	for i := 1; i < failures && interval < maxRetryInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxRetryInterval {
+		return maxRetryInterval
+	}
+	return interval
+}
+
+// retry calls fn until it succeeds or fails with a fatal error, reporting the failures through
+// events and waiting with exponential backoff in between, errStopped is returned once stopC is
+// closed
+func retry(stopC <-chan struct{}, events *watchEvents, fn func() error) error {
+	for failures := 1; ; failures++ {
+		err := fn()
+		if err == nil || isFatal(err) {
+			return err
+		}
+		events.failed(err)
+
+		select {
+		case <-time.After(retryInterval(failures)):
+		case <-stopC:
+			return errStopped
+		}
+	}
+}
+
+// watchEvents sends a WatchError event through the chain of handlers once the watch of a resource
+// fails, so that notifications tell the resource is not watched, and a WatchRecovered event once
+// it's watched again, failures in between are only logged. Events are sent in order on a goroutine
+// of their own, never blocking the list-watch reporting them
+type watchEvents struct {
+	sync.Mutex
+	arg      ResourceWatcherArgs
+	kind     string
+	inflight *inflightEvents // Tracks the events sent when given, so that the watcher waits for them
+	failing  bool
+	queue    []watchEvent   // Waiting to be sent
+	sending  sync.WaitGroup // Done once the queue is empty
+}
+
+// watchEvent is a WatchError or WatchRecovered event waiting to be sent
+type watchEvent struct {
+	kind    string
+	payload string
+}
+
+func newWatchEvents(arg ResourceWatcherArgs, kind string, inflight *inflightEvents) *watchEvents {
+	return &watchEvents{arg: arg, kind: kind, inflight: inflight}
+}
+
+// failed sends a WatchError event unless the watch was already failing
+func (w *watchEvents) failed(err error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.failing {
+		log.Debugf("Watch of %s still failing: %s", w.describe(), err)
+		return
+	}
+	w.failing = true
+	log.Warnf("Watch of %s failed, changes are missed until it recovers: %s", w.describe(), err)
+	w.enqueue(handler.WatchErrorEvent, err.Error())
+}
+
+// recovered sends a WatchRecovered event when the watch was failing
+func (w *watchEvents) recovered() {
+	w.Lock()
+	defer w.Unlock()
+	if !w.failing {
+		return
+	}
+	w.failing = false
+	log.Infof("Watch of %s recovered", w.describe())
+	w.enqueue(handler.WatchRecoveredEvent, "")
+}
+
+// describe return the resource kind along with its namespace and cluster when given
+func (w *watchEvents) describe() string {
+	description := w.kind
+	if w.arg.Namespace != "" {
+		description += " within namespace " + w.arg.Namespace
+	}
+	if w.arg.Cluster != "" {
+		description += " from cluster " + w.arg.Cluster
+	}
+	return description
+}
+
+// enqueue the event to be sent, starting the sender unless already sending, must be called with
+// the lock held. Events enqueued are in flight, so that a stopping watcher waits for them
+func (w *watchEvents) enqueue(kind, payload string) {
+	if w.arg.ChainOfHandlers == nil {
+		return
+	}
+	if w.inflight != nil && !w.inflight.start() {
+		log.Debugf("Dropping %s event for %s while stopping", kind, w.kind)
+		return
+	}
+	w.queue = append(w.queue, watchEvent{kind: kind, payload: payload})
+	if len(w.queue) == 1 {
+		w.sending.Add(1)
+		go w.sendQueued()
+	}
+}
+
+// sendQueued sends the queued events one after the other until the queue is empty
+func (w *watchEvents) sendQueued() {
+	defer w.sending.Done()
+	w.Lock()
+	for len(w.queue) > 0 {
+		evt := w.queue[0]
+		w.Unlock()
+		w.send(evt.kind, evt.payload)
+		if w.inflight != nil {
+			w.inflight.wg.Done()
+		}
+		w.Lock()
+		w.queue = w.queue[1:]
+	}
+	w.Unlock()
+}
+
+// wait for the events enqueued to be sent
+func (w *watchEvents) wait() {
+	w.sending.Wait()
+}
+
+// send the event through the chain of handlers, the key being the watched namespace if any
+func (w *watchEvents) send(kind, payload string) {
+	ctx, cancel := handlerContext(context.Background(), w.arg.Context)
+	defer cancel()
+
+	err := w.arg.ChainOfHandlers.Run(ctx, &handler.Event{
+		K8sEvt:       &common.K8sEvent{Kind: kind, Key: w.arg.Namespace, HasSynced: true},
+		RunNext:      true,
+		Cluster:      w.arg.Cluster,
+		ResourceKind: w.kind,
+		K8sManifest:  []byte{},
+		Payload:      []byte(payload),
+	})
+	if err != nil {
+		log.Errorf("Error processing %s event for %s: %s", kind, w.kind, err)
+	}
+}
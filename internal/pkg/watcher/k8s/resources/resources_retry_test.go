@@ -0,0 +1,244 @@
+package resources
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/handler"
+)
+
+// eventsRecorder records the events it runs
+type eventsRecorder struct {
+	sync.Mutex
+	events []*handler.Event
+}
+
+func (r *eventsRecorder) Run(ctx context.Context, evt *handler.Event) error {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, evt)
+	return nil
+}
+
+func (r *eventsRecorder) kinds() []string {
+	r.Lock()
+	defer r.Unlock()
+	var kinds []string
+	for _, evt := range r.events {
+		kinds = append(kinds, evt.K8sEvt.Kind)
+	}
+	return kinds
+}
+
+func newRecordedWatchEvents(namespace string) (*watchEvents, *eventsRecorder) {
+	recorder := &eventsRecorder{}
+	arg := ResourceWatcherArgs{
+		ChainOfHandlers: handler.NewChainOfHandlers(recorder),
+		Cluster:         "production",
+		Namespace:       namespace,
+	}
+	return newWatchEvents(arg, "deployment", nil), recorder
+}
+
+func TestRetryInterval(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		0:   0,
+		1:   time.Second,
+		2:   2 * time.Second,
+		4:   8 * time.Second,
+		100: maxRetryInterval,
+	} {
+		if interval := retryInterval(failures); interval != expected {
+			t.Errorf("%d failures should wait %s, got %s instead", failures, expected, interval)
+		}
+	}
+}
+
+func TestIsFatal(t *testing.T) {
+	err := errors.New("not served")
+	if isFatal(err) || isFatal(nil) {
+		t.Error("errors shouldn't be fatal unless flagged")
+	}
+	if !isFatal(fatal(err)) || !isFatal(errors.Wrap(fatal(err), "wrapped")) {
+		t.Error("fatal errors should be kept fatal when wrapped")
+	}
+	if fatal(nil) != nil {
+		t.Error("no error should be kept nil")
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	events, recorder := newRecordedWatchEvents("default")
+
+	events.recovered()
+	events.failed(errors.New("forbidden"))
+	events.failed(errors.New("still forbidden"))
+	events.recovered()
+	events.recovered()
+	events.wait()
+
+	kinds := recorder.kinds()
+	if len(kinds) != 2 || kinds[0] != handler.WatchErrorEvent || kinds[1] != handler.WatchRecoveredEvent {
+		t.Fatalf("a single error and recovery should have been sent, got %v instead", kinds)
+	}
+	evt := recorder.events[0]
+	if string(evt.Payload) != "forbidden" || evt.K8sEvt.Key != "default" || !evt.K8sEvt.HasSynced ||
+		evt.Cluster != "production" || evt.ResourceKind != "deployment" {
+		t.Errorf("the error should have been sent for the watched resource, got %#v instead", evt)
+	}
+}
+
+// blockingRecorder records the events once unblocked
+type blockingRecorder struct {
+	eventsRecorder
+	unblock chan struct{}
+}
+
+func (r *blockingRecorder) Run(ctx context.Context, evt *handler.Event) error {
+	<-r.unblock
+	return r.eventsRecorder.Run(ctx, evt)
+}
+
+func TestWatchEventsAsync(t *testing.T) {
+	recorder := &blockingRecorder{unblock: make(chan struct{})}
+	inflight := &inflightEvents{}
+	events := newWatchEvents(ResourceWatcherArgs{ChainOfHandlers: handler.NewChainOfHandlers(recorder)}, "deployment", inflight)
+
+	// Reporting never waits for the chain of handlers, events are sent in order
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		events.failed(errors.New("forbidden"))
+		events.recovered()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reporting should not wait for the chain of handlers")
+	}
+
+	close(recorder.unblock)
+	inflight.stop()
+	kinds := recorder.kinds()
+	if len(kinds) != 2 || kinds[0] != handler.WatchErrorEvent || kinds[1] != handler.WatchRecoveredEvent {
+		t.Errorf("the events sent should have been waited for in order, got %v instead", kinds)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	events, recorder := newRecordedWatchEvents("")
+
+	calls := 0
+	err := retry(nil, events, func() error {
+		calls++
+		if calls == 1 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("the failure should have been retried, got %d calls and %v", calls, err)
+	}
+	events.wait()
+	if kinds := recorder.kinds(); len(kinds) != 1 || kinds[0] != handler.WatchErrorEvent {
+		t.Errorf("the failure should have been reported, got %v instead", kinds)
+	}
+
+	calls = 0
+	err = retry(nil, events, func() error {
+		calls++
+		return fatal(errors.New("not served"))
+	})
+	if !isFatal(err) || calls != 1 {
+		t.Errorf("fatal errors shouldn't be retried, got %d calls and %v", calls, err)
+	}
+
+	stopC := make(chan struct{})
+	close(stopC)
+	if err := retry(stopC, events, func() error { return errors.New("connection refused") }); err != errStopped {
+		t.Errorf("retrying should have been stopped, got %v instead", err)
+	}
+}
+
+func TestWatchHealthEvents(t *testing.T) {
+	events, recorder := newRecordedWatchEvents("")
+	h := newWatchHealth(time.Minute)
+	h.subscribe(events)
+
+	h.watching(apierrors.NewResourceExpired("too old resource version"))
+	if h.retryInterval() != 0 || len(recorder.kinds()) != 0 {
+		t.Error("an expired resource version should be relisted right away")
+	}
+
+	h.listed(apierrors.NewForbidden(schema.GroupResource{Resource: "deployments"}, "", nil))
+	h.watching(errors.New("connection refused"))
+	if h.retryInterval() != 2*time.Second {
+		t.Errorf("consecutive failures should back off, got %s instead", h.retryInterval())
+	}
+
+	// Watch events subscribed while failing are reported the failure too
+	late, lateRecorder := newRecordedWatchEvents("")
+	h.subscribe(late)
+	late.wait()
+	if kinds := lateRecorder.kinds(); len(kinds) != 1 || kinds[0] != handler.WatchErrorEvent {
+		t.Errorf("the ongoing failure should have been reported, got %v instead", kinds)
+	}
+
+	h.unsubscribe(late)
+	h.watching(nil)
+	if h.retryInterval() != 0 {
+		t.Error("failures should be reset once watching")
+	}
+	events.wait()
+	kinds := recorder.kinds()
+	if len(kinds) != 2 || kinds[0] != handler.WatchErrorEvent || kinds[1] != handler.WatchRecoveredEvent {
+		t.Errorf("a single error and recovery should have been sent, got %v instead", kinds)
+	}
+	if len(lateRecorder.kinds()) != 1 {
+		t.Error("unsubscribed watch events shouldn't be sent anymore")
+	}
+}
+
+func TestK8sResourceWatcherRetriesDiscovery(t *testing.T) {
+	recorder := &eventsRecorder{}
+	arg := ResourceWatcherArgs{ChainOfHandlers: handler.NewChainOfHandlers(recorder)}
+	rw := newK8sResourceWatcher("ingress", arg, newResourceHandlerFunc(arg, "ingress"), nil,
+		&retrieve.Resource{}).(*K8sResourceWatcher)
+	rw.gvr = schema.GroupVersionResource{Group: "extensions", Version: "v1beta1", Resource: "ingresses"}
+	rw.discovery = &fakeDiscovery{err: errors.New("connection refused")}
+
+	errC := make(chan error)
+	go func() {
+		errC <- rw.Run()
+	}()
+	deadline := time.After(time.Second)
+	for len(recorder.kinds()) == 0 {
+		select {
+		case err := <-errC:
+			t.Fatalf("discovery failures should have been retried, got %v instead", err)
+		case <-deadline:
+			t.Fatal("the discovery failure should have been reported")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	rw.Shutdown()
+	if err := <-errC; err != nil {
+		t.Errorf("a resource watcher shut down while retrying should return no error, got %v", err)
+	}
+
+	rw = newK8sResourceWatcher("ingress", arg, newResourceHandlerFunc(arg, "ingress"), nil,
+		&retrieve.Resource{}).(*K8sResourceWatcher)
+	rw.gvr = schema.GroupVersionResource{Group: "extensions", Version: "v1beta1", Resource: "deployments"}
+	rw.discovery = newFakeDiscovery()
+	if err := rw.Run(); !isFatal(err) {
+		t.Errorf("a resource not served should stop the resource watcher, got %v instead", err)
+	}
+}
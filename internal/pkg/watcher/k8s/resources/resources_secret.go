@@ -0,0 +1,120 @@
+package resources
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/pkg/errors"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+const (
+	// SECRET const used by registration process
+	SECRET = "secret"
+
+	// lastAppliedAnnotation holds the whole object as applied by kubectl, secret values included
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+func init() {
+	registerResource(SECRET, namespaced, NewSecretWatcher)
+}
+
+// NewSecretWatcher return a watcher for k8s secrets, whose values are replaced by their
+// salted hashes before entering the chain of handlers
+func NewSecretWatcher(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+
+	resourceKind := SECRET
+
+	retr := &retrieve.Resource{
+		Object: &corev1.Secret{},
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return arg.Clientset.CoreV1().Secrets(arg.Namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return arg.Clientset.CoreV1().Secrets(arg.Namespace).Watch(options)
+			},
+		},
+	}
+
+	return newTypedResourceWatcher(
+		arg, resourceKind, corev1.SchemeGroupVersion.WithResource("secrets"), retr)
+}
+
+// redactedSecret is marshaled as the secret it embeds, but with its data and stringData
+// values as hashes, which shadow the embedded ones
+type redactedSecret struct {
+	*corev1.Secret
+	Data       map[string]string `json:"data,omitempty"`
+	StringData map[string]string `json:"stringData,omitempty"`
+}
+
+// redactSecrets return the object with its secret values redacted, either a typed secret or
+// an unstructured one, any other object is returned as is
+func redactSecrets(obj interface{}, salt []byte) (interface{}, error) {
+	switch v := obj.(type) {
+	case *corev1.Secret:
+		return redactSecret(v, salt), nil
+
+	case *unstructured.Unstructured:
+		if v.GetAPIVersion() != "v1" || v.GetKind() != "Secret" {
+			return obj, nil
+		}
+		secret := &corev1.Secret{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(v.Object, secret); err != nil {
+			return nil, errors.Wrap(err, "redactSecrets")
+		}
+		return redactSecret(secret, salt), nil
+	}
+	return obj, nil
+}
+
+// redactSecret return the secret with its values replaced by their salted hashes, so that
+// the changes of every key are still reported without exposing them, as well as the kubectl
+// last applied configuration, which holds them in plain text
+func redactSecret(secret *corev1.Secret, salt []byte) *redactedSecret {
+	s := secret.DeepCopy()
+	if s.Kind == "" {
+		s.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+	}
+	redacted := &redactedSecret{Secret: s}
+
+	if len(s.Data) > 0 {
+		redacted.Data = make(map[string]string, len(s.Data))
+		for k, v := range s.Data {
+			redacted.Data[k] = hashSecretValue(salt, v)
+		}
+	}
+	if len(s.StringData) > 0 {
+		redacted.StringData = make(map[string]string, len(s.StringData))
+		for k, v := range s.StringData {
+			redacted.StringData[k] = hashSecretValue(salt, []byte(v))
+		}
+	}
+	s.Data = nil
+	s.StringData = nil
+
+	if v, ok := s.Annotations[lastAppliedAnnotation]; ok {
+		s.Annotations[lastAppliedAnnotation] = hashSecretValue(salt, []byte(v))
+	}
+	return redacted
+}
+
+// hashSecretValue return the salted hash of a secret value, the salt keeps values
+// from being guessed by hashing candidates
+func hashSecretValue(salt, value []byte) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(value)
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,103 @@
+package resources
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/snebel29/kooper/operator/common"
+	"github.com/snebel29/kwatchman/internal/pkg/handler"
+)
+
+func newFakeSecret(password string) *corev1.Secret {
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db",
+			Namespace: "default",
+			Annotations: map[string]string{
+				lastAppliedAnnotation: `{"stringData":{"password":"` + password + `"}}`,
+			},
+		},
+		Data:       map[string][]byte{"password": []byte(password), "user": []byte("admin")},
+		StringData: map[string]string{"token": password},
+		Type:       corev1.SecretTypeOpaque,
+	}
+}
+
+func getSecretManifest(t *testing.T, obj interface{}, salt string) string {
+	redacted, err := redactSecrets(obj, []byte(salt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := getManifest(redacted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(manifest)
+}
+
+func TestRedactSecret(t *testing.T) {
+	secret := newFakeSecret("s3cr3t")
+	manifest := getSecretManifest(t, secret, "salt")
+
+	for _, value := range []string{"s3cr3t", "YWRtaW4=", "czNjcjN0"} {
+		if strings.Contains(manifest, value) {
+			t.Errorf("secret value %s should have been redacted from %s", value, manifest)
+		}
+	}
+	for _, field := range []string{`"password":"hmac-sha256:`, `"user":"hmac-sha256:`, `"token":"hmac-sha256:`, `"name":"db"`, `"type":"Opaque"`} {
+		if !strings.Contains(manifest, field) {
+			t.Errorf("%s should be within %s", field, manifest)
+		}
+	}
+	if string(secret.Data["password"]) != "s3cr3t" {
+		t.Error("the watched secret should not be modified")
+	}
+
+	if manifest != getSecretManifest(t, newFakeSecret("s3cr3t"), "salt") {
+		t.Error("the same values should have the same hashes")
+	}
+	if manifest == getSecretManifest(t, newFakeSecret("other"), "salt") {
+		t.Error("changed values should have different hashes")
+	}
+	if manifest == getSecretManifest(t, newFakeSecret("s3cr3t"), "other salt") {
+		t.Error("hashes should depend on the salt")
+	}
+}
+
+func TestRedactUnstructuredSecret(t *testing.T) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(newFakeSecret("s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := getSecretManifest(t, &unstructured.Unstructured{Object: content}, "salt")
+	if manifest != getSecretManifest(t, newFakeSecret("s3cr3t"), "salt") {
+		t.Errorf("unstructured secrets should be redacted as typed ones, got %s", manifest)
+	}
+
+	// Secrets are never marshaled unless redacted
+	if _, err := getManifest(newFakeSecret("s3cr3t")); err == nil {
+		t.Error("a secret should not be marshaled without being redacted")
+	}
+}
+
+func TestKooperHandlerFunctionRedactsSecrets(t *testing.T) {
+	h := handler.NewMockHandler()
+	fn := newKooperHandlerFunction(ResourceWatcherArgs{
+		ChainOfHandlers: handler.NewChainOfHandlers(h),
+		SecretSalt:      []byte("salt"),
+	}, SECRET)
+
+	if err := fn(context.TODO(), &common.K8sEvent{Kind: "Add", Object: newFakeSecret("s3cr3t")}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(h.PassedK8sManifest), "s3cr3t") {
+		t.Errorf("the secret value should not reach the handlers, got %s", h.PassedK8sManifest)
+	}
+}
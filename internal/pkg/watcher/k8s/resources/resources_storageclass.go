@@ -0,0 +1,43 @@
+package resources
+
+import (
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+)
+
+const (
+	// STORAGECLASS const used by registration process
+	STORAGECLASS = "storageclass"
+)
+
+func init() {
+	registerResource(STORAGECLASS, clusterScoped, NewStorageClassWatcher)
+}
+
+// NewStorageClassWatcher return a watcher for k8s storage classes, which are cluster scoped
+func NewStorageClassWatcher(arg ResourceWatcherArgs) watcher.ResourceWatcher {
+
+	resourceKind := STORAGECLASS
+
+	retr := &retrieve.Resource{
+		Object: &storagev1.StorageClass{},
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return arg.Clientset.StorageV1().StorageClasses().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return arg.Clientset.StorageV1().StorageClasses().Watch(options)
+			},
+		},
+	}
+
+	return newTypedResourceWatcher(
+		arg, resourceKind, storagev1.SchemeGroupVersion.WithResource("storageclasses"), retr)
+}
@@ -29,7 +29,17 @@ func TestNewResourceWatcher(t *testing.T) {
 		NewStatefulsetWatcher,
 		NewDaemonsetWatcher,
 		NewServiceWatcher,
-		NewIngressWatcher,
+		NewSecretWatcher,
+		NewConfigMapWatcher,
+		NewJobWatcher,
+		NewRoleWatcher,
+		NewClusterRoleWatcher,
+		NewRoleBindingWatcher,
+		NewClusterRoleBindingWatcher,
+		NewNamespaceWatcher,
+		NewNodeWatcher,
+		NewStorageClassWatcher,
+		NewNetworkPolicyWatcher,
 	}
 
 	chainOfHandlers := handler.NewChainOfHandlers(log.NewLogHandler(config.Handler{}))
@@ -43,4 +53,38 @@ func TestNewResourceWatcher(t *testing.T) {
 	for _, r := range resourcesFactoryToTest {
 		k8sIndividualResourceWatcherHelper(r(rwa), t)
 	}
+
+	// Ingress apigroup is selected through discovery
+	rw, ok := NewIngressWatcher(rwa).(*DynamicResourceWatcher)
+	if !ok {
+		t.Fatal("ingress should be watched by a *DynamicResourceWatcher")
+	}
+	if len(rw.candidates) == 0 {
+		t.Error("ingress should have candidate group versions")
+	}
+
+	// CronJob, HPA and PDB versions are selected through discovery as well
+	for _, fn := range []func(ResourceWatcherArgs) watcher.ResourceWatcher{
+		NewCronJobWatcher,
+		NewHorizontalPodAutoscalerWatcher,
+		NewPodDisruptionBudgetWatcher,
+	} {
+		rw, ok = fn(rwa).(*DynamicResourceWatcher)
+		if !ok || len(rw.candidates) < 2 {
+			t.Error("a *DynamicResourceWatcher with candidate group versions should be returned")
+		}
+	}
+}
+
+func TestResourceScopes(t *testing.T) {
+	for _, kind := range []string{CLUSTERROLE, CLUSTERROLEBINDING, NAMESPACE, NODE, STORAGECLASS} {
+		if resourceScopes[kind] != clusterScoped {
+			t.Errorf("%s should be registered as cluster scoped", kind)
+		}
+	}
+	for _, kind := range []string{DEPLOYMENT, SERVICE, ROLE, INGRESS, CRONJOB, NETWORKPOLICY, HORIZONTALPODAUTOSCALER, PODDISRUPTIONBUDGET} {
+		if _, ok := resourceScopes[kind]; !ok || resourceScopes[kind] != namespaced {
+			t.Errorf("%s should be registered as namespaced", kind)
+		}
+	}
 }
@@ -1,60 +1,356 @@
 package resources
 
 import (
-	"fmt"
+	"context"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"sync"
 	"time"
 
-	"github.com/snebel29/kooper/monitoring/metrics"
+	"github.com/snebel29/kooper/operator/common"
 	"github.com/snebel29/kooper/operator/controller"
 	"github.com/snebel29/kooper/operator/handler"
 	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/metrics"
 	"github.com/snebel29/kwatchman/internal/pkg/watcher"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
 )
 
+// defaultResyncInterval is the time between replays of every object when not configured
+const defaultResyncInterval = 30 * time.Second
+
 // K8sResourceWatcher represent the resourceWatcher
 type K8sResourceWatcher struct {
-	kind  string
-	stopC chan struct{}
-	ctrl  controller.Controller
+	kind      string
+	stopC     chan struct{}
+	stopOnce  sync.Once
+	ctrl      controller.Controller
+	newCtrl   func() controller.Controller // Creates the controller again once it failed
+	gvr       schema.GroupVersionResource
+	discovery discovery.ServerResourcesInterface
+	health    *watchHealth
+	initial   *initialSync
+	inflight  *inflightEvents
+	workers   *keyedWorkers
+	events    *watchEvents
 }
 
 // Run the resource watcher
 func (r *K8sResourceWatcher) Run() error {
 	log.Printf("Run K8sResourceWatcher with kind %v\n", r.kind)
 
-	// Start our controller.
-	if err := r.ctrl.Run(r.stopC); err != nil {
-		return fmt.Errorf("error running controller: %s", err)
+	// Typed resources are bound to the group version of the client, we make sure it's
+	// still served to fail early and clearly otherwise, discovery failures are retried
+	if r.discovery != nil {
+		err := retry(r.stopC, r.events, func() error {
+			_, _, err := selectServedResource(r.discovery, r.kind, r.gvr)
+			return err
+		})
+		if err == errStopped {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Infof("Resource %s served as %s", r.kind, r.gvr.String())
+	}
+
+	if r.workers != nil {
+		r.workers.start()
 	}
+	// List and watch failures are retried by the informer, they are reported meanwhile
+	if r.health != nil {
+		r.health.subscribe(r.events)
+	}
+
+	// Start our controller, it runs until stopC is closed, a controller failing to start can't
+	// be run again so that a new one is retried
+	err := retry(r.stopC, r.events, func() error {
+		err := r.ctrl.Run(r.stopC)
+		if err == nil || r.stopped() {
+			return nil
+		}
+		r.ctrl = r.newCtrl()
+		return errors.Wrapf(err, "K8sResourceWatcher %s controller", r.kind)
+	})
+	if r.health != nil {
+		r.health.unsubscribe(r.events)
+	}
+
+	// The controller doesn't wait for its workers, we wait for the events being handled
+	// while the ones still queued are dropped
+	r.inflight.stop()
+	if r.workers != nil {
+		r.workers.stop()
+	}
+
+	if err != nil && err != errStopped {
+		return err
+	}
+	log.Infof("K8sResourceWatcher with kind %s stopped", r.kind)
 	return nil
 }
 
-// Shutdown the resource watcher
+func (r *K8sResourceWatcher) stopped() bool {
+	select {
+	case <-r.stopC:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops the resource watcher controller, Run returns once the events
+// being handled are finished
 func (r *K8sResourceWatcher) Shutdown() {
-	// FIXME: Shutdown is not really stopping the kooper controller, althought upstream
-	// the stop signal is trigerring a general shutdown followed by exit, this may change in the future!!
-	log.Printf("Shutdown signal received for K8sResourceWatcher with kind %v, the controller is not being explicitly stopped, althought the whole kwatchman exits upstream so this is not a big deal\n", r.kind)
-	r.stopC <- struct{}{}
+	log.Infof("Shutdown K8sResourceWatcher with kind %s", r.kind)
+	// Closing rather than sending so that it never blocks, even if the controller already
+	// finished, and every stopC receiver (controller and informer) gets notified
+	r.stopOnce.Do(func() {
+		close(r.stopC)
+	})
+}
+
+// Ready return an error until the initial list has been handled
+func (r *K8sResourceWatcher) Ready() error {
+	if r.initial == nil {
+		return nil
+	}
+	return errors.Wrapf(r.initial.Ready(), "%s", r.kind)
+}
+
+// Live return an error when the resource watch has been disconnected for too long
+func (r *K8sResourceWatcher) Live() error {
+	if r.health == nil {
+		return nil
+	}
+	return errors.Wrapf(r.health.Live(), "%s", r.kind)
+}
+
+// newK8sResourceWatcher return a resource watcher running the handler functions with the resync
+// interval and workers of arg, and synced with the keys of the first list when given once they
+// have been handled, which is tracked as an event in flight along with the watch events
+func newK8sResourceWatcher(
+	kind string,
+	arg ResourceWatcherArgs,
+	hand *handler.HandlerFunc,
+	synced func(context.Context, []string) error,
+	retr *retrieve.Resource) watcher.ResourceWatcher {
+
+	inflight := &inflightEvents{}
+	rw := &K8sResourceWatcher{
+		kind:     kind,
+		stopC:    make(chan struct{}),
+		inflight: inflight,
+		events:   newWatchEvents(arg, kind, inflight),
+	}
+	// Health and the initial sync are tracked by the resource lister watcher wrapping every resource
+	lw, tracked := retr.ListerWatcher.(*resourceListerWatcher)
+	if tracked {
+		rw.initial = &initialSync{}
+		hand = &handler.HandlerFunc{
+			AddFunc:    rw.initial.track(hand.AddFunc),
+			DeleteFunc: rw.initial.track(hand.DeleteFunc),
+		}
+	}
+	// What is handled from a shared informer is what its persisted state resumes from
+	if tracked && lw.shared {
+		shared := lw.lw.(*sharedListerWatcher)
+		hand = &handler.HandlerFunc{
+			AddFunc:    shared.view.track(hand.AddFunc),
+			DeleteFunc: shared.view.track(hand.DeleteFunc),
+		}
+	}
+
+	wrapped := &handler.HandlerFunc{
+		AddFunc:    inflight.track(hand.AddFunc),
+		DeleteFunc: inflight.track(hand.DeleteFunc),
+	}
+	if arg.Workers > 1 {
+		rw.workers = newKeyedWorkers(kind, arg.Workers, inflight, rw.stopC)
+		wrapped = &handler.HandlerFunc{
+			AddFunc:    rw.workers.dispatch(hand.AddFunc),
+			DeleteFunc: rw.workers.dispatch(hand.DeleteFunc),
+		}
+	}
+	rw.newCtrl = func() controller.Controller {
+		return newK8sController(kind, arg.ResyncInterval, wrapped, retr)
+	}
+	rw.ctrl = rw.newCtrl()
+	if tracked {
+		rw.health = lw.health
+		lw.initial = rw.initial
+		if !lw.shared {
+			lw.stopC = rw.stopC
+		}
+		if synced != nil {
+			rw.initial.onSynced = func(keys []string) {
+				if !inflight.start() {
+					return
+				}
+				defer inflight.wg.Done()
+				if err := synced(context.Background(), keys); err != nil {
+					log.Errorf("K8sResourceWatcher with kind %s failed to sync its first list: %s", kind, err)
+				}
+			}
+		}
+	}
+	return rw
+}
+
+// inflightEvents tracks the events being handled, so that a stopped
+// resource watcher waits for them while dropping new ones
+type inflightEvents struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	stopping bool
+}
+
+func (i *inflightEvents) start() bool {
+	i.Lock()
+	defer i.Unlock()
+	if i.stopping {
+		return false
+	}
+	i.wg.Add(1)
+	return true
+}
+
+// stop dropping new events and wait for the ones being handled
+func (i *inflightEvents) stop() {
+	i.Lock()
+	i.stopping = true
+	i.Unlock()
+	i.wg.Wait()
+}
+
+// track wraps the kooper handler function, a nil function is kept nil
+func (i *inflightEvents) track(fn func(context.Context, *common.K8sEvent) error) func(context.Context, *common.K8sEvent) error {
+	if fn == nil {
+		return nil
+	}
+	return func(ctx context.Context, evt *common.K8sEvent) error {
+		if !i.start() {
+			log.Debugf("Dropping %s event for %s while stopping", evt.Kind, evt.Key)
+			return nil
+		}
+		defer i.wg.Done()
+		return fn(ctx, evt)
+	}
+}
+
+// invalidResourceWatcher fails to run a resource which configuration is invalid
+type invalidResourceWatcher struct {
+	err error
+}
+
+// Run return the configuration error, which is fatal
+func (r invalidResourceWatcher) Run() error {
+	return fatal(r.err)
+}
+
+// Shutdown has nothing to stop
+func (r invalidResourceWatcher) Shutdown() {}
+
+// ResourceWatcherGroup runs together the resource watchers of a resource, such as one
+// per watched namespace
+type ResourceWatcherGroup []watcher.ResourceWatcher
+
+// Run every resource watcher of the group until all finish or any of them fails, which shuts down
+// the others. Its resource watchers retry their failures on their own and only return fatal errors
+// since a shut down resource watcher can't run again, any other error is a bug returned as fatal
+// too so that the group is never run again watching nothing
+func (g ResourceWatcherGroup) Run() error {
+	var wg sync.WaitGroup
+	errC := make(chan error, len(g))
+
+	for _, rw := range g {
+		wg.Add(1)
+		go func(r watcher.ResourceWatcher) {
+			defer wg.Done()
+			if err := r.Run(); err != nil {
+				if !isFatal(err) {
+					log.Errorf("Resource watcher failed with a non fatal error, which should have been retried: %s", err)
+					err = fatal(err)
+				}
+				errC <- err
+			}
+		}(rw)
+	}
+
+	go func() {
+		wg.Wait()
+		close(errC)
+	}()
+
+	// Either the first error or nil when all of them finished successfully
+	if err := <-errC; err != nil {
+		g.Shutdown()
+		return err
+	}
+	return nil
 }
 
-func newK8sResourceWatcher(kind string, hand *handler.HandlerFunc, retr *retrieve.Resource) watcher.ResourceWatcher {
-	// Create the controller that will refresh every 30 seconds.
-	ctrl := newK8sController(kind, hand, retr)
-	stopC := make(chan struct{})
+// Shutdown every resource watcher of the group
+func (g ResourceWatcherGroup) Shutdown() {
+	for _, rw := range g {
+		rw.Shutdown()
+	}
+}
+
+// Ready return the first resource watcher not ready if any
+func (g ResourceWatcherGroup) Ready() error {
+	return checkResourceWatchers(g, watcher.HealthChecker.Ready)
+}
 
-	return &K8sResourceWatcher{
-		kind:  kind,
-		ctrl:  ctrl,
-		stopC: stopC,
+// Live return the first resource watcher not live if any
+func (g ResourceWatcherGroup) Live() error {
+	return checkResourceWatchers(g, watcher.HealthChecker.Live)
+}
+
+// checkResourceWatchers runs the check over the resource watchers able to report their health
+func checkResourceWatchers(rws []watcher.ResourceWatcher, check func(watcher.HealthChecker) error) error {
+	for _, rw := range rws {
+		if hc, ok := rw.(watcher.HealthChecker); ok {
+			if err := check(hc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newTypedResourceWatcher return a resource watcher for typed resources which applies the
+// configured selectors and namespaces, and checks that the group version resource is served
+// before running, when clientset is available
+func newTypedResourceWatcher(
+	arg ResourceWatcherArgs, kind string, gvr schema.GroupVersionResource, retr *retrieve.Resource) watcher.ResourceWatcher {
+
+	retr.ListerWatcher = arg.listerWatcher(gvr, retr)
+	rw := newK8sResourceWatcher(
+		kind, arg, newResourceHandlerFunc(arg, kind), newSyncedFunction(arg, kind), retr).(*K8sResourceWatcher)
+	rw.gvr = gvr
+	if arg.Clientset != nil {
+		rw.discovery = arg.Clientset.Discovery()
 	}
+	return rw
 }
 
-func newK8sController(name string, hand *handler.HandlerFunc, retr *retrieve.Resource) controller.Controller {
+// newK8sController return a single worker kooper controller, see keyedWorkers for running events
+// concurrently, resyncing every 30 seconds unless a resync interval is given
+func newK8sController(
+	name string, resync time.Duration, hand *handler.HandlerFunc, retr *retrieve.Resource) controller.Controller {
+
+	if resync <= 0 {
+		resync = defaultResyncInterval
+	}
 	cfg := &controller.Config{
 		Name:              name,
 		ConcurrentWorkers: 1,
-		ResyncInterval:    30 * time.Second,
+		ResyncInterval:    resync,
 	}
-	return controller.New(cfg, hand, retr, nil, nil, metrics.Dummy, log.StandardLogger())
+	// kooper leader election gates the whole controller, instead every replica keeps watching
+	// and the chain of handlers is gated, see handler.NewLeaderChainOfHandlers
+	return controller.New(cfg, hand, retr, nil, nil, metrics.Controller, log.StandardLogger())
 }
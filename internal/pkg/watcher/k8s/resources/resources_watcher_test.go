@@ -1,8 +1,13 @@
 package resources
 
 import (
+	"context"
+	"errors"
+	"github.com/snebel29/kooper/operator/common"
+	"github.com/snebel29/kooper/operator/controller"
 	"github.com/snebel29/kooper/operator/handler"
 	"github.com/snebel29/kooper/operator/retrieve"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"sync"
 	"testing"
 	"time"
@@ -19,7 +24,7 @@ func (w *KooperControllerMock) Run(stopper <-chan struct{}) error {
 
 func TestK8sResourceWatcher(t *testing.T) {
 	kind := "foo"
-	w := newK8sResourceWatcher(kind, &handler.HandlerFunc{}, &retrieve.Resource{})
+	w := newK8sResourceWatcher(kind, ResourceWatcherArgs{}, &handler.HandlerFunc{}, nil, &retrieve.Resource{})
 	rw := w.(*K8sResourceWatcher)
 
 	if rw.kind == "" {
@@ -60,3 +65,135 @@ func TestK8sResourceWatcher(t *testing.T) {
 		t.Error("ctrl.Run() should have been called")
 	}
 }
+
+// failingControllerMock fails to run as a controller which can't be started
+type failingControllerMock struct{}
+
+func (c *failingControllerMock) Run(stopper <-chan struct{}) error {
+	return errors.New("simulated error")
+}
+
+func TestK8sResourceWatcherRetriesController(t *testing.T) {
+	w := newK8sResourceWatcher("foo", ResourceWatcherArgs{}, &handler.HandlerFunc{}, nil, &retrieve.Resource{})
+	rw := w.(*K8sResourceWatcher)
+	rw.ctrl = &failingControllerMock{}
+	created := 0
+	rw.newCtrl = func() controller.Controller {
+		created++
+		return &KooperControllerMock{}
+	}
+
+	if err := rw.Run(); err != nil {
+		t.Errorf("a failing controller should have been retried, got %v instead", err)
+	}
+	if created != 1 {
+		t.Errorf("a new controller should have been run once the first one failed, got %d", created)
+	}
+}
+
+func TestK8sResourceWatcherFailsWhenNotServed(t *testing.T) {
+	w := newK8sResourceWatcher("foo", ResourceWatcherArgs{}, &handler.HandlerFunc{}, nil, &retrieve.Resource{})
+	rw := w.(*K8sResourceWatcher)
+	rw.ctrl = &KooperControllerMock{}
+	rw.discovery = newFakeDiscovery()
+	rw.gvr = schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}
+
+	if err := rw.Run(); err == nil {
+		t.Error("Run() should fail when the resource is not served")
+	}
+
+	rw.gvr = schema.GroupVersionResource{Group: "extensions", Version: "v1beta1", Resource: "ingresses"}
+	if err := rw.Run(); err != nil {
+		t.Error(err)
+	}
+}
+
+type resourceWatcherMock struct {
+	sync.Mutex
+	err            error
+	runCalled      bool
+	shutdownCalled bool
+}
+
+func (w *resourceWatcherMock) Run() error {
+	w.Lock()
+	defer w.Unlock()
+	w.runCalled = true
+	return w.err
+}
+
+func (w *resourceWatcherMock) Shutdown() {
+	w.Lock()
+	defer w.Unlock()
+	w.shutdownCalled = true
+}
+
+func TestResourceWatcherGroup(t *testing.T) {
+	w1, w2 := &resourceWatcherMock{}, &resourceWatcherMock{}
+	if err := (ResourceWatcherGroup{w1, w2}).Run(); err != nil {
+		t.Error(err)
+	}
+	if !w1.runCalled || !w2.runCalled {
+		t.Error("every resource watcher should have been run")
+	}
+
+	w3 := &resourceWatcherMock{err: fatal(errors.New("simulated error"))}
+	if err := (ResourceWatcherGroup{w1, w3}).Run(); !IsFatal(err) {
+		t.Errorf("the fatal resource watcher error should have been returned, got %v instead", err)
+	}
+	if !w1.shutdownCalled || !w3.shutdownCalled {
+		t.Error("every resource watcher should have been shutdown after an error")
+	}
+
+	// The shut down group can't run again, so that a non fatal error is returned as fatal
+	w4 := &resourceWatcherMock{err: errors.New("simulated error")}
+	if err := (ResourceWatcherGroup{w4}).Run(); !IsFatal(err) {
+		t.Errorf("a non fatal resource watcher error should have been returned as fatal, got %v instead", err)
+	}
+}
+
+func TestInflightEvents(t *testing.T) {
+	inflight := &inflightEvents{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handled := 0
+
+	fn := inflight.track(func(ctx context.Context, evt *common.K8sEvent) error {
+		close(started)
+		<-release
+		handled++
+		return nil
+	})
+	if inflight.track(nil) != nil {
+		t.Error("nil functions should be kept nil")
+	}
+
+	go func() {
+		if err := fn(context.TODO(), &common.K8sEvent{Kind: "Add"}); err != nil {
+			t.Error(err)
+		}
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		inflight.stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("stop should wait for the events being handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-stopped
+	if handled != 1 {
+		t.Errorf("the event in flight should have been handled, %d handled instead", handled)
+	}
+
+	if err := fn(context.TODO(), &common.K8sEvent{Kind: "Add"}); err != nil || handled != 1 {
+		t.Error("new events should be dropped once stopped")
+	}
+}
@@ -0,0 +1,131 @@
+package resources
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/util/workqueue"
+
+	kooper_metrics "github.com/snebel29/kooper/monitoring/metrics"
+	"github.com/snebel29/kooper/operator/common"
+	"github.com/snebel29/kwatchman/internal/pkg/metrics"
+)
+
+const (
+	keyedWorkersQueue   = 100 // Number of events queued per worker before the controller blocks
+	keyedWorkersRetries = 3   // Retries of a failing event, as kooper default ProcessingJobRetries
+)
+
+// keyedWorkers handles the events of different objects concurrently while the events of a same
+// object are handled one after the other, in the order they were received.
+//
+// Running several kooper workers instead would break that order, since every event is queued on
+// its own and the object is read from the informer store before being handled, so an older
+// object could be handled after a newer one. Instead a single kooper worker reads the events in
+// order and hands them to the worker owning their key.
+//
+// Failing events are retried by their worker with the kooper rate limiter, rather than requeued
+// behind newer events of the same object, the events of the worker waiting meanwhile
+type keyedWorkers struct {
+	kind     string
+	inflight *inflightEvents
+	queues   []chan keyedEvent
+	wg       sync.WaitGroup
+	limiter  workqueue.RateLimiter
+	stopC    <-chan struct{} // Interrupts the retries, closed once the resource watcher is stopped
+}
+
+type keyedEvent struct {
+	ctx context.Context
+	evt *common.K8sEvent
+	fn  func(context.Context, *common.K8sEvent) error
+}
+
+// newKeyedWorkers return the workers, they have to be started before handling any event
+func newKeyedWorkers(kind string, workers int, inflight *inflightEvents, stopC <-chan struct{}) *keyedWorkers {
+	k := &keyedWorkers{
+		kind:     kind,
+		inflight: inflight,
+		queues:   make([]chan keyedEvent, workers),
+		limiter:  workqueue.DefaultControllerRateLimiter(),
+		stopC:    stopC,
+	}
+	for i := range k.queues {
+		k.queues[i] = make(chan keyedEvent, keyedWorkersQueue)
+	}
+	return k
+}
+
+// start every worker, which runs until stop is called
+func (k *keyedWorkers) start() {
+	for _, queue := range k.queues {
+		k.wg.Add(1)
+		go func(q chan keyedEvent) {
+			defer k.wg.Done()
+			for e := range q {
+				k.handle(e)
+			}
+		}(queue)
+	}
+}
+
+// stop the workers once the events in flight are handled, it must be called after inflight
+// stopped so that no event is dispatched anymore
+func (k *keyedWorkers) stop() {
+	for _, queue := range k.queues {
+		close(queue)
+	}
+	k.wg.Wait()
+}
+
+// handle the event retrying it when failing, the controller already returned so it can't
+// requeue the event, retries are given up once stopped
+func (k *keyedWorkers) handle(e keyedEvent) {
+	defer k.inflight.wg.Done()
+	defer k.limiter.Forget(e.evt)
+	for {
+		err := e.fn(e.ctx, e.evt)
+		if err == nil {
+			return
+		}
+		if k.limiter.NumRequeues(e.evt) >= keyedWorkersRetries {
+			log.Errorf("Error processing %s %s: %s", k.kind, e.evt.Key, err)
+			return
+		}
+		log.Warnf("Error processing %s %s (retried): %s", k.kind, e.evt.Key, err)
+		metrics.Controller.IncResourceEventQueued(k.kind, kooper_metrics.RequeueEvent)
+		select {
+		case <-time.After(k.limiter.When(e.evt)):
+		case <-k.stopC:
+			log.Errorf("Error processing %s %s, not retried while stopping: %s", k.kind, e.evt.Key, err)
+			return
+		}
+	}
+}
+
+// dispatch wraps the kooper handler function so that events are handled by the worker owning
+// their key, the event is tracked as in flight until handled, a nil function is kept nil
+func (k *keyedWorkers) dispatch(fn func(context.Context, *common.K8sEvent) error) func(context.Context, *common.K8sEvent) error {
+	if fn == nil {
+		return nil
+	}
+	return func(ctx context.Context, evt *common.K8sEvent) error {
+		if !k.inflight.start() {
+			log.Debugf("Dropping %s event for %s while stopping", evt.Kind, evt.Key)
+			return nil
+		}
+		// Blocks the controller while the worker is busy, events keep being queued by kooper
+		k.queues[keyWorker(evt.Key, len(k.queues))] <- keyedEvent{ctx: ctx, evt: evt, fn: fn}
+		return nil
+	}
+}
+
+// keyWorker return the worker a key is always handled by
+func keyWorker(key string, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(workers))
+}
@@ -0,0 +1,188 @@
+package resources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/snebel29/kooper/operator/common"
+	"github.com/snebel29/kooper/operator/handler"
+	"github.com/snebel29/kooper/operator/retrieve"
+	"github.com/snebel29/kwatchman/internal/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestKeyedWorkersKeepKeyOrder(t *testing.T) {
+	inflight := &inflightEvents{}
+	workers := newKeyedWorkers("foo", 4, inflight, nil)
+	workers.start()
+
+	var mu sync.Mutex
+	handled := map[string][]int{}
+	dispatch := workers.dispatch(func(ctx context.Context, evt *common.K8sEvent) error {
+		seq := int(evt.Object.(*corev1.Pod).Generation)
+		// Give other events of the same key the chance to overtake this one
+		time.Sleep(time.Duration(seq%3) * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		handled[evt.Key] = append(handled[evt.Key], seq)
+		return nil
+	})
+
+	keys := []string{"ns/a", "ns/b", "ns/c", "ns/d", "ns/e"}
+	for seq := 0; seq < 20; seq++ {
+		for _, key := range keys {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Generation: int64(seq)}}
+			evt := &common.K8sEvent{Key: key, Object: pod}
+			if err := dispatch(context.Background(), evt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	inflight.stop()
+	workers.stop()
+
+	for _, key := range keys {
+		if len(handled[key]) != 20 {
+			t.Fatalf("%s should have handled 20 events, got %v instead", key, handled[key])
+		}
+		for i, seq := range handled[key] {
+			if seq != i {
+				t.Fatalf("%s events should have been handled in order, got %v instead", key, handled[key])
+			}
+		}
+	}
+}
+
+func TestKeyedWorkersRunKeysConcurrently(t *testing.T) {
+	inflight := &inflightEvents{}
+	workers := newKeyedWorkers("foo", 2, inflight, nil)
+	workers.start()
+	defer workers.stop()
+	defer inflight.stop()
+
+	// Find two keys owned by different workers, both must be handled at once
+	keys := []string{"ns/a"}
+	for i := 0; len(keys) < 2; i++ {
+		if key := fmt.Sprintf("ns/%d", i); keyWorker(key, 2) != keyWorker(keys[0], 2) {
+			keys = append(keys, key)
+		}
+	}
+	var started sync.WaitGroup
+	started.Add(2)
+	release := make(chan struct{})
+	dispatch := workers.dispatch(func(ctx context.Context, evt *common.K8sEvent) error {
+		started.Done()
+		<-release
+		return nil
+	})
+	for _, key := range keys {
+		if err := dispatch(context.Background(), &common.K8sEvent{Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("events of different keys should have been handled concurrently")
+	}
+	close(release)
+}
+
+func TestKeyedWorkersDropWhileStopping(t *testing.T) {
+	inflight := &inflightEvents{}
+	workers := newKeyedWorkers("foo", 2, inflight, nil)
+	workers.start()
+	inflight.stop()
+
+	called := false
+	dispatch := workers.dispatch(func(ctx context.Context, evt *common.K8sEvent) error {
+		called = true
+		return nil
+	})
+	if err := dispatch(context.Background(), &common.K8sEvent{Key: "ns/a"}); err != nil {
+		t.Error(err)
+	}
+	workers.stop()
+	if called {
+		t.Error("events should have been dropped while stopping")
+	}
+	if workers.dispatch(nil) != nil {
+		t.Error("nil handler functions should be kept nil")
+	}
+}
+
+func TestKeyedWorkersRetry(t *testing.T) {
+	inflight := &inflightEvents{}
+	stopC := make(chan struct{})
+	workers := newKeyedWorkers("foo", 2, inflight, stopC)
+	workers.limiter = workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond)
+	workers.start()
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+	dispatch := workers.dispatch(func(ctx context.Context, evt *common.K8sEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[evt.Key]++
+		if evt.Key == "ns/failing" || calls[evt.Key] == 1 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	for _, key := range []string{"ns/failing", "ns/recovering"} {
+		if err := dispatch(context.Background(), &common.K8sEvent{Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inflight.stop()
+	workers.stop()
+
+	if calls["ns/failing"] != keyedWorkersRetries+1 || calls["ns/recovering"] != 2 {
+		t.Errorf("failing events should have been retried up to %d times, got %v instead", keyedWorkersRetries, calls)
+	}
+
+	// Retries are given up once stopped
+	inflight = &inflightEvents{}
+	workers = newKeyedWorkers("foo", 1, inflight, stopC)
+	workers.limiter = workqueue.NewItemExponentialFailureRateLimiter(time.Hour, time.Hour)
+	workers.start()
+	close(stopC)
+	dispatch = workers.dispatch(func(ctx context.Context, evt *common.K8sEvent) error {
+		return errors.New("connection refused")
+	})
+	if err := dispatch(context.Background(), &common.K8sEvent{Key: "ns/failing"}); err != nil {
+		t.Fatal(err)
+	}
+	inflight.stop()
+	workers.stop()
+}
+
+func TestK8sResourceWatcherWorkers(t *testing.T) {
+	rw := newK8sResourceWatcher("foo", ResourceWatcherArgs{}, &handler.HandlerFunc{}, nil, &retrieve.Resource{})
+	if rw.(*K8sResourceWatcher).workers != nil {
+		t.Error("a single worker should run events within the controller")
+	}
+	rw = newK8sResourceWatcher("foo", ResourceWatcherArgs{Workers: 4}, &handler.HandlerFunc{}, nil, &retrieve.Resource{})
+	if w := rw.(*K8sResourceWatcher).workers; w == nil || len(w.queues) != 4 {
+		t.Errorf("4 keyed workers should have been created, got %#v instead", w)
+	}
+}
+
+func TestResourceWatcherArgsForResourceController(t *testing.T) {
+	arg := ResourceWatcherArgs{}.forResource(config.Resource{ResyncInterval: time.Hour, Workers: 4})
+	if arg.ResyncInterval != time.Hour || arg.Workers != 4 {
+		t.Errorf("resource controller settings should have been kept, got %#v instead", arg)
+	}
+}
@@ -11,3 +11,11 @@ type ResourceWatcher interface {
 	Run() error
 	Shutdown()
 }
+
+// HealthChecker is implemented by watchers able to report their health
+type HealthChecker interface {
+	// Ready return an error until the initial sync has been completed
+	Ready() error
+	// Live return an error when the watcher is stuck, such as disconnected for too long
+	Live() error
+}